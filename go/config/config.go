@@ -29,6 +29,55 @@ type AlmondConfig struct {
 	DatabaseProxyURL       string `yaml:"DATABASE_PROXY_URL" json:"DATABASE_PROXY_URL"`
 	JWTSigningKey          string `yaml:"JWT_SIGNING_KEY"    json:"JWT_SIGNING_KEY"`
 	EnableDeveloperBackend bool   `yaml:"ENABLE_DEVELOPER_BACKEND"    json:"ENABLE_DEVELOPER_BACKEND"`
+	// SharedBackendMaxEngines caps the engines placed on one shared backend, 0 if unlimited
+	SharedBackendMaxEngines int `yaml:"SHARED_BACKEND_MAX_ENGINES" json:"SHARED_BACKEND_MAX_ENGINES"`
+	// BackendDrainRate is the number of users per minute migrated off a draining shared backend, 10 if unset
+	BackendDrainRate int `yaml:"BACKEND_DRAIN_RATE" json:"BACKEND_DRAIN_RATE"`
+	// EngineStatusPollSeconds is the interval between status checks of a running engine, 10 if unset
+	EngineStatusPollSeconds int `yaml:"ENGINE_STATUS_POLL_SECONDS" json:"ENGINE_STATUS_POLL_SECONDS"`
+	// EngineMigrationTimeoutSeconds bounds the wait for an old backend to drain an engine, 30 if unset
+	EngineMigrationTimeoutSeconds int `yaml:"ENGINE_MIGRATION_TIMEOUT_SECONDS" json:"ENGINE_MIGRATION_TIMEOUT_SECONDS"`
+	// EngineMaxFailures is the number of failed starts or crashes of an engine within
+	// EngineFailureWindowSeconds after which it is no longer retried, 5 and 600 if unset
+	EngineMaxFailures          int `yaml:"ENGINE_MAX_FAILURES" json:"ENGINE_MAX_FAILURES"`
+	EngineFailureWindowSeconds int `yaml:"ENGINE_FAILURE_WINDOW_SECONDS" json:"ENGINE_FAILURE_WINDOW_SECONDS"`
+	// EngineIdleTimeoutSeconds is how long an engine can be inactive before its backend reports
+	// it idle, the default of the backend if unset
+	EngineIdleTimeoutSeconds int `yaml:"ENGINE_IDLE_TIMEOUT_SECONDS" json:"ENGINE_IDLE_TIMEOUT_SECONDS"`
+	// EngineKeepWarmSeconds is how long an idle engine keeps running before it is shut down, 0 if unset
+	EngineKeepWarmSeconds int `yaml:"ENGINE_KEEP_WARM_SECONDS" json:"ENGINE_KEEP_WARM_SECONDS"`
+	// EngineAlwaysOnWithAutomations keeps the engines of users with apps in user_app running while idle
+	EngineAlwaysOnWithAutomations bool `yaml:"ENGINE_ALWAYS_ON_WITH_AUTOMATIONS" json:"ENGINE_ALWAYS_ON_WITH_AUTOMATIONS"`
+	// DeploymentRolloutRate is the number of user deployments per minute updated to a changed template, 10 if unset
+	DeploymentRolloutRate int `yaml:"DEPLOYMENT_ROLLOUT_RATE" json:"DEPLOYMENT_ROLLOUT_RATE"`
+	// TemplateReloadSeconds is the interval between checks of the config directory for changed templates, 30 if unset
+	TemplateReloadSeconds int `yaml:"TEMPLATE_RELOAD_SECONDS" json:"TEMPLATE_RELOAD_SECONDS"`
+	// MaxConcurrentReconciles is the number of users the controller reconciles in parallel, 10 if unset
+	MaxConcurrentReconciles int `yaml:"MAX_CONCURRENT_RECONCILES" json:"MAX_CONCURRENT_RECONCILES"`
+	// ReconcileBaseDelayMillis is the first retry delay of a failed reconcile, doubled on each failure, 5 if unset
+	ReconcileBaseDelayMillis int `yaml:"RECONCILE_BASE_DELAY_MILLIS" json:"RECONCILE_BASE_DELAY_MILLIS"`
+	// ReconcileMaxDelaySeconds caps the retry delay of a failed reconcile, 1000 if unset
+	ReconcileMaxDelaySeconds int `yaml:"RECONCILE_MAX_DELAY_SECONDS" json:"RECONCILE_MAX_DELAY_SECONDS"`
+	// ReconcileQPS and ReconcileBurst bound the rate of reconcile retries overall, 10 and 100 if unset
+	ReconcileQPS   float64 `yaml:"RECONCILE_QPS" json:"RECONCILE_QPS"`
+	ReconcileBurst int     `yaml:"RECONCILE_BURST" json:"RECONCILE_BURST"`
+	// BackendMaxConcurrentStarts caps the engines starting at once on one backend, 10 if unset
+	BackendMaxConcurrentStarts int `yaml:"BACKEND_MAX_CONCURRENT_STARTS" json:"BACKEND_MAX_CONCURRENT_STARTS"`
+	// EngineStartTimeoutSeconds is how long a starting engine counts against BackendMaxConcurrentStarts
+	// if it never reports running, 120 if unset
+	EngineStartTimeoutSeconds int `yaml:"ENGINE_START_TIMEOUT_SECONDS" json:"ENGINE_START_TIMEOUT_SECONDS"`
+	// UserCacheSize bounds the database entries of users cached by the controller, 10000 if unset
+	UserCacheSize int `yaml:"USER_CACHE_SIZE" json:"USER_CACHE_SIZE"`
+	// UserCacheTTLSeconds is how long the controller caches database entries of users, 600 if unset
+	UserCacheTTLSeconds int `yaml:"USER_CACHE_TTL_SECONDS" json:"USER_CACHE_TTL_SECONDS"`
+	// EngineAPISigningKey signs requests from the controller to the engine API of backends. It is
+	// required unless EngineAPIAllowUnsigned is set
+	EngineAPISigningKey string `yaml:"ENGINE_API_SIGNING_KEY" json:"ENGINE_API_SIGNING_KEY"`
+	// EngineAPIAllowUnsigned lets the engine API run unsigned when EngineAPISigningKey is unset,
+	// for networks where backends are not reachable by anything untrusted
+	EngineAPIAllowUnsigned bool `yaml:"ENGINE_API_ALLOW_UNSIGNED" json:"ENGINE_API_ALLOW_UNSIGNED"`
+	// SyncConflictResolvers maps sync table names to a conflict resolver name
+	SyncConflictResolvers map[string]string `yaml:"SYNC_CONFLICT_RESOLVERS" json:"SYNC_CONFLICT_RESOLVERS"`
 }
 
 var almondConfig *AlmondConfig
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
@@ -50,7 +51,24 @@ func (token *accessTokenClaims) Valid() error {
 }
 
 func parseAccessToken(c *gin.Context) (*jwt.Token, error) {
-	header := c.Request.Header.Get("Authorization")
+	return parseAuthorizationHeader(c.Request.Header.Get("Authorization"))
+}
+
+// VerifyToken verifies the access token in an Authorization header and returns the user id it was signed for
+func VerifyToken(header string) (int64, error) {
+	token, err := parseAuthorizationHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	claims := token.Claims.(*accessTokenClaims)
+	uid, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subject: %s", claims.Subject)
+	}
+	return uid, nil
+}
+
+func parseAuthorizationHeader(header string) (*jwt.Token, error) {
 	if len(header) == 0 {
 		return nil, errors.New("missing authorization header")
 	}
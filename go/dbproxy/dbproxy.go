@@ -35,6 +35,10 @@ var (
 	flagSet = flag.NewFlagSet("dbproxy", flag.ExitOnError)
 	port    = flagSet.Int("port", 8200, "port")
 	tlsCert = flagSet.String("aws-tls-cert", "", "path to aws rds tls cert")
+	// maxSyncBatchSize bounds both directions of a bounded sync round trip
+	maxSyncBatchSize = flagSet.Int("sync-max-batch-size", 1000, "maximum number of changes in one bounded sync round trip")
+	// maxClockDrift bounds client timestamps ahead of the server clock, later ones are clamped
+	maxClockDrift = flagSet.Duration("sync-max-clock-drift", sql.DefaultMaxClockDrift, "maximum drift of client timestamps ahead of the server clock")
 )
 
 func Usage() {
@@ -52,6 +56,14 @@ func Run(args []string) {
 		}
 	}
 	sql.InitMySQL(almondConfig.DatabaseURL)
+	sql.GetSyncTable().SetMaxClockDrift(*maxClockDrift)
+	for tableName, name := range almondConfig.SyncConflictResolvers {
+		resolver, err := sql.NewConflictResolver(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sql.SetConflictResolver(tableName, resolver)
+	}
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
 		debugDumpRequest(c.Request)
@@ -75,6 +87,7 @@ func Run(args []string) {
 	r.GET("/synctable/:name/:uniqueid", syncTableGetOne)
 	r.GET("/synctable/raw/:name", syncTableGetRaw)
 	r.GET("/synctable/changes/:name/:millis", syncTableGetChangesAfter)
+	r.GET("/synctable/devices/:name", syncTableGetDevices)
 	r.POST("/synctable/changes/:name", syncTableHandleChanges)
 	r.POST("/synctable/sync/:name/:millis", syncTableSyncAt)
 	r.POST("/synctable/replace/:name", syncTableReplaceAll)
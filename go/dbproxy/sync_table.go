@@ -15,6 +15,7 @@ package dbproxy
 
 import (
 	"almond-cloud/sql"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -103,6 +104,10 @@ func syncTableGetChangesAfter(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := ackDevice(m, userID, c, lastModified); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	rows, err := syncTable.GetChangesAfter(m, lastModified, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -111,6 +116,26 @@ func syncTableGetChangesAfter(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": rows})
 }
 
+func syncTableGetDevices(c *gin.Context) {
+	syncTable := sql.GetSyncTable()
+	m, ok := sql.NewSyncRow(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "table name not found"})
+		return
+	}
+	userID, err := parseUserID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	devices, err := syncTable.GetDevices(m, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": devices})
+}
+
 func syncTableHandleChanges(c *gin.Context) {
 	syncTable := sql.GetSyncTable()
 	m, ok := sql.NewSyncRow(c.Param("name"))
@@ -139,7 +164,8 @@ func syncTableHandleChanges(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": results})
+	// data keeps the done flags for older clients, results carries the conflict resolution.
+	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": sql.DoneFlags(results), "results": results})
 }
 
 func syncTableSyncAt(c *gin.Context) {
@@ -172,17 +198,58 @@ func syncTableSyncAt(c *gin.Context) {
 		return
 	}
 
+	if err := ackDevice(m, userID, c, lastModified); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	m.SetKey(sql.Key{UserID: userID})
-	latest, ourChanges, done, err := syncTable.SyncAt(m.NewSyncRecord(lastModified), srows)
+	if len(c.Query("limit")) > 0 {
+		syncTableSyncAtBounded(c, m.NewSyncRecord(lastModified), srows)
+		return
+	}
+	latest, ourChanges, results, err := syncTable.SyncAt(m.NewSyncRecord(lastModified), srows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ret := struct {
+		LastModified sql.Timestamp    `json:"lastModified"`
+		OurChanges   []sql.SyncRecord `json:"ourChanges"`
+		Done         []bool           `json:"done"`
+		Results      []sql.SyncResult `json:"results"`
+	}{sql.Timestamp(latest), ourChanges, sql.DoneFlags(results), results}
+	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": ret})
+}
+
+// syncTableSyncAtBounded handles a sync request with a limit query. The response carries
+// at most limit changes and a continuation timestamp while more changes remain.
+func syncTableSyncAtBounded(c *gin.Context, sr sql.SyncRecord, pushedChanges []sql.SyncRecord) {
+	syncTable := sql.GetSyncTable()
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+	if limit > *maxSyncBatchSize {
+		limit = *maxSyncBatchSize
+	}
+	if len(pushedChanges) > *maxSyncBatchSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("too many changes, push at most %d changes per request", *maxSyncBatchSize)})
+		return
+	}
+	batch, err := syncTable.SyncAtBounded(sr, pushedChanges, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	ret := struct {
-		LastModified int64            `json:"lastModified"`
+		LastModified sql.Timestamp    `json:"lastModified"`
 		OurChanges   []sql.SyncRecord `json:"ourChanges"`
 		Done         []bool           `json:"done"`
-	}{latest, ourChanges, done}
+		Results      []sql.SyncResult `json:"results"`
+		More         bool             `json:"more"`
+	}{sql.Timestamp(batch.LastModified), batch.OurChanges, sql.DoneFlags(batch.Results), batch.Results, batch.More}
 	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": ret})
 }
 
@@ -273,7 +340,7 @@ func syncTableInsertOne(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": lastModified})
+	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": sql.Timestamp(lastModified)})
 }
 
 func syncTableDeleteIfRecent(c *gin.Context) {
@@ -326,5 +393,5 @@ func syncTableDeleteOne(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": lastModified})
+	c.JSON(http.StatusOK, gin.H{"result": "ok", "data": sql.Timestamp(lastModified)})
 }
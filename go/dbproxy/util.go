@@ -64,3 +64,13 @@ func parseKey(c *gin.Context) (*sql.Key, error) {
 	}
 	return &sql.Key{UniqueID: uniqueID, UserID: userID}, nil
 }
+
+// ackDevice persists the timestamp the device in the device query has synced up to.
+// Requests without a device are from clients that predate device cursors.
+func ackDevice(m sql.SyncRow, userID int64, c *gin.Context, lastModified int64) error {
+	deviceID := c.Query("device")
+	if len(deviceID) == 0 {
+		return nil
+	}
+	return sql.GetSyncTable().AckDevice(m, userID, deviceID, lastModified)
+}
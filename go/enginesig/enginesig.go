@@ -0,0 +1,172 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package enginesig signs and verifies requests to the engine API of backends with
+// HMAC-SHA256. The signature covers the method, the request URI, a timestamp, a nonce
+// and a hash of the body:
+//
+//	METHOD "\n" REQUEST_URI "\n" TIMESTAMP "\n" NONCE "\n" hex(sha256(BODY))
+//
+// The timestamp is in unix seconds and is sent in the TimestampHeader; the nonce is
+// random for every request and is sent in the NonceHeader; the hex signature is sent
+// in the SignatureHeader. Requests that change state are accepted once per nonce.
+// src/util/engine_api_auth.ts implements the same scheme for backends.
+package enginesig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TimestampHeader carries the time the request was signed, in unix seconds
+	TimestampHeader = "X-Almond-Timestamp"
+	// NonceHeader carries a random value that makes every signed request unique
+	NonceHeader = "X-Almond-Nonce"
+	// SignatureHeader carries the hex HMAC-SHA256 signature of the request
+	SignatureHeader = "X-Almond-Signature"
+	// MaxSkew is how far the timestamp of a request may be from the time it is verified
+	MaxSkew = 5 * time.Minute
+)
+
+func signature(key []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Sign adds the signature headers to an outgoing request. The body is read and replaced.
+func Sign(req *http.Request, key []byte, now time.Time) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(random[:])
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signature(key, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+// Verify checks the signature headers of an incoming request. The body is read and replaced.
+func Verify(req *http.Request, key []byte, now time.Time) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	signed := req.Header.Get(SignatureHeader)
+	if len(timestamp) == 0 || len(nonce) == 0 || len(signed) == 0 {
+		return errors.New("missing request signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed request timestamp")
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > MaxSkew || skew < -MaxSkew {
+		return errors.New("request timestamp out of range")
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	expected := signature(key, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signed)) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// Nonces remembers the nonces of accepted requests until their timestamp is out of
+// range, to reject replays. It is safe for concurrent use.
+type Nonces struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewNonces returns an empty set of nonces
+func NewNonces() *Nonces {
+	return &Nonces{expires: make(map[string]time.Time)}
+}
+
+// use records a nonce that can be replayed until expires, and reports whether it was new
+func (n *Nonces) use(nonce string, expires, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !now.Before(n.nextSweep) {
+		for used, exp := range n.expires {
+			if exp.Before(now) {
+				delete(n.expires, used)
+			}
+		}
+		n.nextSweep = now.Add(MaxSkew)
+	}
+	if _, ok := n.expires[nonce]; ok {
+		return false
+	}
+	n.expires[nonce] = expires
+	return true
+}
+
+// VerifyOnce is Verify for requests that change state: a request is accepted once, a
+// replay of it is rejected while its timestamp is in range.
+func VerifyOnce(req *http.Request, key []byte, now time.Time, nonces *Nonces) error {
+	if err := Verify(req, key, now); err != nil {
+		return err
+	}
+	ts, _ := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if !nonces.use(req.Header.Get(NonceHeader), time.Unix(ts, 0).Add(MaxSkew), now) {
+		return errors.New("request replayed")
+	}
+	return nil
+}
+
+// Middleware rejects requests that are not signed with key
+func Middleware(key []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := Verify(req, key, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package enginesig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1600000000, 0)
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://backend:8100/run-engine?x=1", strings.NewReader(`{"userId":1}`))
+		require.NoError(t, Sign(req, key, now))
+		return req
+	}
+
+	require.NoError(t, Verify(newRequest(), key, now.Add(time.Minute)))
+	require.Error(t, Verify(newRequest(), []byte("other"), now))
+	require.Error(t, Verify(newRequest(), key, now.Add(MaxSkew+time.Second)))
+	require.Error(t, Verify(httptest.NewRequest("GET", "/kill-engine?userid=1", nil), key, now))
+
+	req := newRequest()
+	req.Body = http.NoBody
+	require.Error(t, Verify(req, key, now), "body changed")
+
+	req = newRequest()
+	req.URL.RawQuery = "x=2"
+	require.Error(t, Verify(req, key, now), "uri changed")
+
+	req = newRequest()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix()+1, 10))
+	require.Error(t, Verify(req, key, now), "timestamp changed")
+
+	req = newRequest()
+	req.Header.Set(NonceHeader, "0123")
+	require.Error(t, Verify(req, key, now), "nonce changed")
+
+	req = newRequest()
+	req.Header.Del(NonceHeader)
+	require.Error(t, Verify(req, key, now), "no nonce")
+
+	// requests are unique even when signed at the same time
+	require.NotEqual(t, newRequest().Header.Get(NonceHeader), newRequest().Header.Get(NonceHeader))
+}
+
+func TestVerifyOnce(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1600000000, 0)
+	nonces := NewNonces()
+	req := httptest.NewRequest("GET", "/kill-engine?userid=1", nil)
+	require.NoError(t, Sign(req, key, now))
+	replay := req.Clone(req.Context())
+
+	require.NoError(t, VerifyOnce(req, key, now, nonces))
+	require.Error(t, VerifyOnce(replay, key, now.Add(time.Minute), nonces))
+	require.Error(t, VerifyOnce(replay, key, now.Add(MaxSkew+time.Second), nonces), "timestamp out of range")
+
+	other := httptest.NewRequest("GET", "/kill-engine?userid=1", nil)
+	require.NoError(t, Sign(other, key, now))
+	require.NoError(t, VerifyOnce(other, key, now, nonces))
+
+	// nonces are forgotten once their requests expire
+	later := now.Add(3 * MaxSkew)
+	fresh := httptest.NewRequest("GET", "/kill-engine?userid=1", nil)
+	require.NoError(t, Sign(fresh, key, later))
+	require.NoError(t, VerifyOnce(fresh, key, later, nonces))
+	require.Len(t, nonces.expires, 1)
+}
+
+func TestMiddleware(t *testing.T) {
+	key := []byte("secret")
+	h := Middleware(key, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/kill-engine?userid=1", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest("GET", "/kill-engine?userid=1", nil)
+	require.NoError(t, Sign(req, key, time.Now()))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -11,6 +11,9 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
+
+// +kubebuilder:object:generate=true
+// +groupName=backend.almond.stanford.edu
 package v1
 
 import (
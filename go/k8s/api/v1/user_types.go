@@ -16,6 +16,7 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -23,16 +24,128 @@ import (
 
 // UserSpec defines the desired state of User
 type UserSpec struct {
-	ID   int64  `json:"id,omitempty"`
+	ID int64 `json:"id,omitempty"`
+	// Mode is where the engine runs. If unset, members of a developer org run in developer
+	// mode when the developer backend is enabled, and other users in shared mode.
+	// +kubebuilder:validation:Enum=shared;developer;dedicated
 	Mode string `json:"mode,omitempty"`
+	// Resources are the resources of the engine container in developer and dedicated mode,
+	// those of the deployment template if unset
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Suspended stops the engine and removes the deployment of the user
+	// while keeping the User. Setting it back to false starts the engine again.
+	Suspended bool `json:"suspended,omitempty"`
+	// Idle overrides the idle policy of the controller config for this user
+	Idle *IdlePolicy `json:"idle,omitempty"`
 }
 
+// IdlePolicy decides when the engine of an inactive user is shut down. Unset fields
+// take the value of the controller config.
+type IdlePolicy struct {
+	// TimeoutSeconds is how long the engine can be inactive before its backend reports it idle
+	// +kubebuilder:validation:Minimum=0
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+	// KeepWarmSeconds is how long an idle engine keeps running before it is shut down
+	// +kubebuilder:validation:Minimum=0
+	KeepWarmSeconds *int32 `json:"keepWarmSeconds,omitempty"`
+	// AlwaysOn keeps the engine running while it is idle
+	AlwaysOn *bool `json:"alwaysOn,omitempty"`
+}
+
+// User modes
+const (
+	// UserModeShared runs the engine on a shared backend
+	UserModeShared = "shared"
+	// UserModeDeveloper runs the engine on a deployment of the user, from the developer template
+	UserModeDeveloper = "developer"
+	// UserModeDedicated runs the engine on a deployment of the user, from the dedicated template
+	UserModeDedicated = "dedicated"
+)
+
+// UserState is the lifecycle state of the engine of a user
+// +kubebuilder:validation:Enum=pending;starting;running;idle;draining;migrating;stopping;stopped;suspended;error;failed
+type UserState string
+
+const (
+	// UserPending means the engine waits for a backend
+	UserPending UserState = "pending"
+	// UserStarting means the backend is starting the engine
+	UserStarting UserState = "starting"
+	// UserRunning means the engine is running
+	UserRunning UserState = "running"
+	// UserIdle means the engine is running but has been inactive for a while
+	UserIdle UserState = "idle"
+	// UserDraining means the old backend is checkpointing the engine before it moves
+	UserDraining UserState = "draining"
+	// UserMigrating means the engine is starting on the new backend after a drain
+	UserMigrating UserState = "migrating"
+	// UserStopping means the engine is stopped because the user is deleted
+	UserStopping UserState = "stopping"
+	// UserStopped means the backend has no engine for the user
+	UserStopped UserState = "stopped"
+	// UserSuspended means the engine is stopped because the spec suspends the user
+	UserSuspended UserState = "suspended"
+	// UserError means the last reconcile failed, see LastError
+	UserError UserState = "error"
+	// UserFailed means the engine failed too many times in a row and is no longer retried
+	// until the spec changes or the retry annotation is set
+	UserFailed UserState = "failed"
+)
+
+// User condition types
+const (
+	// UserReady is true when the engine runs on an assigned backend and is not degraded
+	UserReady = "Ready"
+	// UserBackendAssigned is true when the user has a backend
+	UserBackendAssigned = "BackendAssigned"
+	// UserEngineRunning is true when the engine is running or idle
+	UserEngineRunning = "EngineRunning"
+	// UserDegraded is true when the last reconcile failed
+	UserDegraded = "Degraded"
+	// UserCleanupBlocked is true when a deleted user is kept by its finalizer because the cleanup failed
+	UserCleanupBlocked = "CleanupBlocked"
+)
+
 // UserStatus defines the observed state of User
 type UserStatus struct {
-	Backend string `json:"backend"`
-	State   string `json:"state"`
+	Backend string    `json:"backend"`
+	State   UserState `json:"state"`
+	// Mode is the mode the engine runs in, from the spec or chosen by the controller
+	Mode string `json:"mode,omitempty"`
+	// MigratingFrom is the backend the engine is drained from while it moves to Backend
+	MigratingFrom string `json:"migratingFrom,omitempty"`
+	// MigrationStarted is when the old backend was asked to drain the engine
+	MigrationStarted *metav1.Time `json:"migrationStarted,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed from
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RestartCount is the number of times a running engine had to be started again
+	RestartCount int32 `json:"restartCount,omitempty"`
+	// ConsecutiveFailures is the number of failed engine starts and crashes since FirstFailureTime
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+	// FirstFailureTime is when the current run of failures started
+	FirstFailureTime *metav1.Time `json:"firstFailureTime,omitempty"`
+	// NextRetryTime is when the engine is started again after a failure
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// IdleSince is when the backend first reported the engine idle, while it is kept warm
+	IdleSince *metav1.Time `json:"idleSince,omitempty"`
+	// IdleShutdownTime is when the idle engine was shut down, it stays stopped until the user is woken up
+	IdleShutdownTime *metav1.Time `json:"idleShutdownTime,omitempty"`
+	// LastError is the message of the last failed reconcile
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorTime is when LastError happened
+	LastErrorTime *metav1.Time `json:"lastErrorTime,omitempty"`
+	// Conditions are the Ready, BackendAssigned, EngineRunning, Degraded and CleanupBlocked conditions
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.status.mode`
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Backend",type=string,JSONPath=`.status.backend`
+// +kubebuilder:printcolumn:name="Restarts",type=integer,JSONPath=`.status.restartCount`
+// +kubebuilder:printcolumn:name="Last Error",type=string,JSONPath=`.status.lastError`,priority=1
+
 // User is the Schema for the users API
 type User struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -42,6 +155,8 @@ type User struct {
 	Status UserStatus `json:"status,omitempty"`
 }
 
+// +kubebuilder:object:root=true
+
 // UserList contains a list of User
 type UserList struct {
 	metav1.TypeMeta `json:",inline"`
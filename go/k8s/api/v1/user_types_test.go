@@ -0,0 +1,99 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	crdFile     = "../../../../k8s/components/controller/crd/base/backend.almond.stanford.edu_users.yaml"
+	testCRDFile = "../../../../tests/thingpedia-integration/k8s/controller/crd/backend.almond.stanford.edu_users.yaml"
+)
+
+// schemaProperties returns the property names of an object schema in file order
+func schemaProperties(t *testing.T, schema *yaml.Node, path ...string) []string {
+	for _, key := range path {
+		schema = mappingValue(schema, key)
+		require.NotNil(t, schema, "no %s in %v", key, path)
+	}
+	properties := mappingValue(schema, "properties")
+	require.NotNil(t, properties, "no properties in %v", path)
+	var names []string
+	for i := 0; i < len(properties.Content); i += 2 {
+		names = append(names, properties.Content[i].Value)
+	}
+	return names
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.DocumentNode {
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.SequenceNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the sorted JSON field names of a struct
+func jsonFields(v interface{}) []string {
+	typ := reflect.TypeOf(v)
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestUserCRD checks that the CRD generated by `make manifests` matches the types
+func TestUserCRD(t *testing.T) {
+	data, err := ioutil.ReadFile(crdFile)
+	require.NoError(t, err)
+	testData, err := ioutil.ReadFile(testCRDFile)
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(testData), "the integration test CRD is a copy")
+
+	var crd yaml.Node
+	require.NoError(t, yaml.Unmarshal(data, &crd))
+	schema := []string{"spec", "versions", "schema", "openAPIV3Schema", "properties"}
+	for _, c := range []struct {
+		path []string
+		obj  interface{}
+	}{
+		{append(schema, "spec"), UserSpec{}},
+		{append(schema, "spec", "properties", "idle"), IdlePolicy{}},
+		{append(schema, "status"), UserStatus{}},
+	} {
+		// controller-gen lists properties in alphabetical order
+		require.Equal(t, jsonFields(c.obj), schemaProperties(t, &crd, c.path...), "%v", c.path)
+	}
+}
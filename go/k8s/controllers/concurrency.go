@@ -0,0 +1,138 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+)
+
+const (
+	kDefaultMaxConcurrentReconciles = 10
+	kDefaultReconcileBaseDelay      = 5 * time.Millisecond
+	kDefaultReconcileMaxDelay       = 1000 * time.Second
+	kDefaultReconcileQPS            = 10
+	kDefaultReconcileBurst          = 100
+	kDefaultBackendMaxStarts        = 10
+	kDefaultEngineStartTimeout      = 2 * time.Minute
+)
+
+// errBackendBusy is returned when a backend is already starting as many engines as
+// it is allowed to. The user is retried shortly without recording an error.
+var errBackendBusy = errors.New("too many engines starting on backend")
+
+// controllerOptions returns the worker count and rate limiter of the User controller.
+// Failed reconciles are retried with per-user exponential backoff, and all retries
+// together are bounded by a token bucket.
+func (r *UserReconciler) controllerOptions() controller.Options {
+	c := r.almondConfig
+	workers := c.MaxConcurrentReconciles
+	if workers <= 0 {
+		workers = kDefaultMaxConcurrentReconciles
+	}
+	baseDelay := time.Duration(c.ReconcileBaseDelayMillis) * time.Millisecond
+	if baseDelay <= 0 {
+		baseDelay = kDefaultReconcileBaseDelay
+	}
+	maxDelay := time.Duration(c.ReconcileMaxDelaySeconds) * time.Second
+	if maxDelay <= 0 {
+		maxDelay = kDefaultReconcileMaxDelay
+	}
+	qps := c.ReconcileQPS
+	if qps <= 0 {
+		qps = kDefaultReconcileQPS
+	}
+	burst := c.ReconcileBurst
+	if burst <= 0 {
+		burst = kDefaultReconcileBurst
+	}
+	return controller.Options{
+		MaxConcurrentReconciles: workers,
+		RateLimiter: workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(qps), burst)},
+		),
+	}
+}
+
+// startLimiter caps the engines starting at once on each backend, so a backend that
+// comes back is not flooded by every user it hosted at once. A start holds its slot
+// until the engine is no longer starting, or the start times out.
+type startLimiter struct {
+	mu      sync.Mutex
+	max     int
+	timeout time.Duration
+	// starting maps each backend to the users whose engine is starting there, with the
+	// time their slot is given back if the engine never reports running
+	starting map[string]map[int64]time.Time
+}
+
+func newStartLimiter(max int, timeout time.Duration) *startLimiter {
+	if max <= 0 {
+		max = kDefaultBackendMaxStarts
+	}
+	if timeout <= 0 {
+		timeout = kDefaultEngineStartTimeout
+	}
+	return &startLimiter{max: max, timeout: timeout, starting: make(map[string]map[int64]time.Time)}
+}
+
+// tryAcquire takes a start slot of a backend for a user, it returns false if there is none
+// left. A user starting again keeps its slot.
+func (l *startLimiter) tryAcquire(backendURL string, userID int64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	starting := l.starting[backendURL]
+	for uid, expires := range starting {
+		if !now.Before(expires) {
+			delete(starting, uid)
+		}
+	}
+	if _, ok := starting[userID]; !ok && len(starting) >= l.max {
+		return false
+	}
+	if starting == nil {
+		starting = make(map[int64]time.Time)
+		l.starting[backendURL] = starting
+	}
+	starting[userID] = now.Add(l.timeout)
+	return true
+}
+
+// release gives back the start slot of a user, once its engine runs or its start failed.
+func (l *startLimiter) release(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for backendURL, starting := range l.starting {
+		delete(starting, userID)
+		if len(starting) == 0 {
+			delete(l.starting, backendURL)
+		}
+	}
+}
+
+// startFinished reports whether an engine in this state no longer holds a start slot.
+func startFinished(state UserState) bool {
+	switch state {
+	case Running, Idle, Stopped, Stopping, Failed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"almond-cloud/config"
+)
+
+func TestControllerOptions(t *testing.T) {
+	r := &UserReconciler{almondConfig: &config.AlmondConfig{}}
+	opts := r.controllerOptions()
+	require.Equal(t, kDefaultMaxConcurrentReconciles, opts.MaxConcurrentReconciles)
+	require.Equal(t, kDefaultReconcileBaseDelay, opts.RateLimiter.When("a"))
+	require.Equal(t, 2*kDefaultReconcileBaseDelay, opts.RateLimiter.When("a"))
+
+	r.almondConfig = &config.AlmondConfig{MaxConcurrentReconciles: 4, ReconcileBaseDelayMillis: 100, ReconcileMaxDelaySeconds: 1}
+	opts = r.controllerOptions()
+	require.Equal(t, 4, opts.MaxConcurrentReconciles)
+	for _, delay := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		require.Equal(t, delay*time.Millisecond, opts.RateLimiter.When("a"))
+	}
+	opts.RateLimiter.Forget("a")
+	require.Equal(t, 100*time.Millisecond, opts.RateLimiter.When("a"))
+}
+
+func TestStartLimiter(t *testing.T) {
+	now := time.Now()
+	l := newStartLimiter(2, time.Minute)
+	require.True(t, l.tryAcquire("a", 1, now))
+	require.True(t, l.tryAcquire("a", 2, now))
+	require.False(t, l.tryAcquire("a", 3, now))
+	require.True(t, l.tryAcquire("a", 1, now), "a user starting again keeps its slot")
+	require.True(t, l.tryAcquire("b", 3, now), "backends are limited separately")
+	l.release(1)
+	require.True(t, l.tryAcquire("a", 4, now))
+
+	// the slot of an engine that never reports running is given back after the timeout
+	require.False(t, l.tryAcquire("a", 5, now.Add(30*time.Second)))
+	require.True(t, l.tryAcquire("a", 5, now.Add(time.Minute)))
+
+	for _, uid := range []int64{3, 4, 5} {
+		l.release(uid)
+	}
+	require.Empty(t, l.starting)
+}
@@ -0,0 +1,287 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+const (
+	// kDrainAnnotation on a shared-backend pod cordons it: no new users are placed
+	// on it and its users are migrated off at BACKEND_DRAIN_RATE users per minute.
+	kDrainAnnotation = "backend.almond.stanford.edu/drain"
+	// kDrainRemainingAnnotation reports the number of users left on a draining pod.
+	kDrainRemainingAnnotation = "backend.almond.stanford.edu/drain-remaining"
+
+	kDefaultDrainRate = 10
+)
+
+// drainTracker paces the migrations off draining backends and counts the users left
+// on them. The counts follow the statuses written by Reconcile, every user is
+// reconciled when the controller starts so they are complete after the first sync.
+type drainTracker struct {
+	mu       sync.Mutex
+	lastMove map[string]time.Time
+	// pending holds the moves allowed to users whose migration has not started yet
+	pending map[int64]pendingMove
+	// placed is the backends of each user, its backend and the one it migrates from
+	placed map[int64][]string
+	users  map[string]int
+	// draining maps the URL of each draining backend to its pod
+	draining map[string]string
+}
+
+// pendingMove is a move token taken by a user, with the time of the previous move so
+// the token can be given back if the user does not move.
+type pendingMove struct {
+	url      string
+	taken    time.Time
+	previous time.Time
+}
+
+func newDrainTracker() *drainTracker {
+	return &drainTracker{
+		lastMove: make(map[string]time.Time),
+		pending:  make(map[int64]pendingMove),
+		placed:   make(map[int64][]string),
+		users:    make(map[string]int),
+		draining: make(map[string]string),
+	}
+}
+
+// allowMove reports whether one more user can leave the backend, at most one per interval.
+// The move is reserved for the user until moveStarted or releaseMove.
+func (t *drainTracker) allowMove(url string, interval time.Duration, uid int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.lastMove[url]
+	if ok && time.Since(last) < interval {
+		return false
+	}
+	now := time.Now()
+	t.lastMove[url] = now
+	t.pending[uid] = pendingMove{url: url, taken: now, previous: last}
+	return true
+}
+
+// moveStarted consumes the move reserved by the user, its migration has started.
+func (t *drainTracker) moveStarted(uid int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, uid)
+}
+
+// releaseMove gives back the move reserved by the user if it did not start, so the
+// next user can leave without waiting for the drain rate. It returns true if there
+// was such a move.
+func (t *drainTracker) releaseMove(uid int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	move, ok := t.pending[uid]
+	if !ok {
+		return false
+	}
+	delete(t.pending, uid)
+	if t.lastMove[move.url].Equal(move.taken) {
+		if move.previous.IsZero() {
+			delete(t.lastMove, move.url)
+		} else {
+			t.lastMove[move.url] = move.previous
+		}
+	}
+	return true
+}
+
+// place records the backends of a user and returns the draining backends whose count
+// changed, with their pod. A user without backends is forgotten.
+func (t *drainTracker) place(uid int64, backends ...string) map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var placed []string
+	for _, b := range backends {
+		if len(b) > 0 {
+			placed = append(placed, b)
+		}
+	}
+	changed := make(map[string]string)
+	for _, b := range t.placed[uid] {
+		t.users[b]--
+		if t.users[b] <= 0 {
+			delete(t.users, b)
+		}
+		if pod, ok := t.draining[b]; ok {
+			changed[b] = pod
+		}
+	}
+	for _, b := range placed {
+		t.users[b]++
+		if pod, ok := t.draining[b]; ok {
+			changed[b] = pod
+		}
+	}
+	if len(placed) == 0 {
+		delete(t.placed, uid)
+	} else {
+		t.placed[uid] = placed
+	}
+	return changed
+}
+
+// remaining returns the number of users on a backend.
+func (t *drainTracker) remaining(url string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.users[url]
+}
+
+// setDraining records whether a backend is draining.
+func (t *drainTracker) setDraining(b backendEndpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b.Draining && len(b.Pod) > 0 {
+		t.draining[b.URL] = b.Pod
+	} else {
+		delete(t.draining, b.URL)
+	}
+}
+
+// isDraining reports whether a backend is draining.
+func (t *drainTracker) isDraining(url string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.draining[url]
+	return ok
+}
+
+func podDraining(pod *corev1.Pod) bool {
+	draining, _ := strconv.ParseBool(pod.Annotations[kDrainAnnotation])
+	return draining
+}
+
+func (r *UserReconciler) drainInterval() time.Duration {
+	rate := r.almondConfig.BackendDrainRate
+	if rate <= 0 {
+		rate = kDefaultDrainRate
+	}
+	return time.Minute / time.Duration(rate)
+}
+
+// drainRequeue bounds the requeue delay of a shared user by the drain interval while
+// its backend is draining, so a user refused a move tries again when the next move is
+// allowed instead of at the next resync.
+func (r *UserReconciler) drainRequeue(backend string, after time.Duration) time.Duration {
+	if interval := r.drainInterval(); r.drains.isDraining(backend) && interval < after {
+		return interval
+	}
+	return after
+}
+
+// markDrainingBackends flags the backends whose pod has the drain annotation.
+func (r *UserReconciler) markDrainingBackends(ctx context.Context, namespace string, backends []backendEndpoint) {
+	for i := range backends {
+		if len(backends[i].Pod) == 0 {
+			continue
+		}
+		pod := &corev1.Pod{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: backends[i].Pod}, pod); err != nil {
+			r.Log.Error(err, "failed to get backend pod", "pod", backends[i].Pod)
+			continue
+		}
+		backends[i].Draining = podDraining(pod)
+		r.drains.setDraining(backends[i])
+	}
+}
+
+// reportDrainProgress records the placement of a user and, for the draining backends it
+// joined or left, the number of users left on their pod, so `kubectl get pod` shows
+// when the pod is empty. A deleted user has no backends.
+func (r *UserReconciler) reportDrainProgress(ctx context.Context, namespace string, uid int64, backends ...string) {
+	for backend, podName := range r.drains.place(uid, backends...) {
+		remaining := r.drains.remaining(backend)
+		r.Log.Info("draining backend:", "backend", podName, "remaining", remaining)
+
+		pod := &corev1.Pod{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: podName}, pod); err != nil {
+			r.Log.Error(err, "failed to get backend pod", "pod", podName)
+			continue
+		}
+		value := strconv.Itoa(remaining)
+		if pod.Annotations[kDrainRemainingAnnotation] == value {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		pod.Annotations[kDrainRemainingAnnotation] = value
+		if err := r.Patch(ctx, pod, patch); err != nil {
+			r.Log.Error(err, "failed to report drain progress", "pod", podName)
+		}
+	}
+}
+
+// drainAnnotationChanged passes the pods whose drain annotation was set or changed.
+var drainAnnotationChanged = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		_, ok := e.Object.GetAnnotations()[kDrainAnnotation]
+		return ok
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.ObjectOld.GetAnnotations()[kDrainAnnotation] != e.ObjectNew.GetAnnotations()[kDrainAnnotation]
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// usersForDrainingPod maps a change of the drain annotation of a backend pod to the users
+// on that backend, so they start moving off as soon as the pod is cordoned.
+func (r *UserReconciler) usersForDrainingPod(obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || len(pod.Status.PodIP) == 0 {
+		return nil
+	}
+	users := &backendv1.UserList{}
+	if err := r.List(context.Background(), users, client.InNamespace(pod.Namespace)); err != nil {
+		r.Log.Error(err, "failed to list users for drain change")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, u := range users.Items {
+		if backendHost(u.Status.Backend) == pod.Status.PodIP || backendHost(u.Status.MigratingFrom) == pod.Status.PodIP {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: u.Namespace, Name: u.Name}})
+		}
+	}
+	r.Log.Info("backend drain changed:", "pod", pod.Name, "draining", podDraining(pod), "users", len(requests))
+	return requests
+}
+
+// backendHost returns the host of a backend URL, empty if it is not one.
+func backendHost(backend string) string {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
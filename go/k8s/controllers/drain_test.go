@@ -0,0 +1,221 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+	"almond-cloud/sql"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, backendv1.AddToScheme(scheme))
+	return scheme
+}
+
+func TestDrainTrackerAllowMove(t *testing.T) {
+	tracker := newDrainTracker()
+	require.True(t, tracker.allowMove("a", time.Minute, 1))
+	require.False(t, tracker.allowMove("a", time.Minute, 2))
+	require.True(t, tracker.allowMove("b", time.Minute, 3))
+	require.True(t, tracker.allowMove("a", 0, 4))
+
+	// a move that does not start gives the token back, a started one keeps it
+	tracker = newDrainTracker()
+	require.True(t, tracker.allowMove("a", time.Minute, 1))
+	require.False(t, tracker.releaseMove(2))
+	require.True(t, tracker.releaseMove(1))
+	require.False(t, tracker.releaseMove(1))
+	require.True(t, tracker.allowMove("a", time.Minute, 2))
+	tracker.moveStarted(2)
+	require.False(t, tracker.releaseMove(2))
+	require.False(t, tracker.allowMove("a", time.Minute, 3))
+
+	r := &UserReconciler{almondConfig: &config.AlmondConfig{}}
+	require.Equal(t, 6*time.Second, r.drainInterval())
+	r.almondConfig.BackendDrainRate = 60
+	require.Equal(t, time.Second, r.drainInterval())
+}
+
+func TestPickSharedBackendDraining(t *testing.T) {
+	busy := newLoadServer(t, BackendLoad{Engines: 5})
+	idle := newLoadServer(t, BackendLoad{Engines: 3})
+	backends := []backendEndpoint{{Name: "busy", URL: busy.URL}, {Name: "idle", URL: idle.URL, Draining: true}}
+	r := &UserReconciler{Log: logr.Discard(), almondConfig: &config.AlmondConfig{}, loads: newLoadTracker(), drains: newDrainTracker(),
+		engines: testEngineClient()}
+	ctx := context.Background()
+
+	// new users skip the draining backend even if it is the least loaded
+	url, err := r.pickSharedBackend(ctx, 1, "", backends)
+	require.NoError(t, err)
+	require.Equal(t, busy.URL, url)
+
+	// one user leaves the draining backend, the next one waits for the drain rate
+	url, err = r.pickSharedBackend(ctx, 2, idle.URL, backends)
+	require.NoError(t, err)
+	require.Equal(t, busy.URL, url)
+	url, err = r.pickSharedBackend(ctx, 3, idle.URL, backends)
+	require.NoError(t, err)
+	require.Equal(t, idle.URL, url)
+
+	// users stay when every backend is draining
+	backends[0].Draining = true
+	r.drains = newDrainTracker()
+	url, err = r.pickSharedBackend(ctx, 2, idle.URL, backends)
+	require.NoError(t, err)
+	require.Equal(t, idle.URL, url)
+	_, err = r.pickSharedBackend(ctx, 4, "", backends)
+	require.Error(t, err)
+}
+
+func TestDrainProgress(t *testing.T) {
+	const url = "http://10.0.0.1:8100"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "shared-backend-1",
+			Namespace:   "default",
+			Annotations: map[string]string{kDrainAnnotation: "true"},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	user := func(id int64, backend, from string) *backendv1.User {
+		return &backendv1.User{
+			ObjectMeta: metav1.ObjectMeta{Name: userName(id), Namespace: "default"},
+			Spec:       backendv1.UserSpec{ID: id},
+			Status:     backendv1.UserStatus{Backend: backend, MigratingFrom: from},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+		pod, user(1, url, ""), user(2, "http://10.0.0.2:8100", url), user(3, "http://10.0.0.2:8100", "")).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{}, drains: newDrainTracker()}
+	ctx := context.Background()
+
+	backends := []backendEndpoint{{Name: "shared-backend-1", URL: url, Pod: "shared-backend-1"}, {Name: "10.0.0.2", URL: "http://10.0.0.2:8100"}}
+	r.markDrainingBackends(ctx, "default", backends)
+	require.True(t, backends[0].Draining)
+	require.False(t, backends[1].Draining)
+
+	// the annotation counts the users on the pod and the users migrating off it
+	remaining := func() string {
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(pod), pod))
+		return pod.Annotations[kDrainRemainingAnnotation]
+	}
+	r.reportDrainProgress(ctx, "default", 1, url)
+	require.Equal(t, "1", remaining())
+	r.reportDrainProgress(ctx, "default", 2, "http://10.0.0.2:8100", url)
+	require.Equal(t, "2", remaining())
+	r.reportDrainProgress(ctx, "default", 3, "http://10.0.0.2:8100")
+	require.Equal(t, "2", remaining())
+
+	// user 1 moves away, user 2 is deleted
+	r.reportDrainProgress(ctx, "default", 1, "http://10.0.0.2:8100")
+	require.Equal(t, "1", remaining())
+	r.reportDrainProgress(ctx, "default", 2)
+	require.Equal(t, "0", remaining())
+
+	// cordoning the pod reconciles the users on it
+	requests := r.usersForDrainingPod(pod)
+	require.Len(t, requests, 2)
+	require.Equal(t, userName(1), requests[0].Name)
+	require.Equal(t, userName(2), requests[1].Name)
+}
+
+func TestReconcileDrainMove(t *testing.T) {
+	const draining, target = "http://10.0.0.1:8100", "http://10.0.0.2:8100"
+	endpoints := sharedBackends("10.0.0.1", "10.0.0.2")
+	endpoints.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: "shared-backend-1"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "shared-backend-1",
+		Namespace:   "default",
+		Annotations: map[string]string{kDrainAnnotation: "true"},
+	}}
+	rt := newReconcileTest(t, &config.AlmondConfig{BackendDrainRate: 1}, fakeUsers{1: {ID: 1}, 2: {ID: 2}},
+		endpoints, pod, testUser(1, draining, Running), testUser(2, draining, Running))
+	rt.backend.setState(draining, 1, Running)
+	rt.backend.setState(draining, 2, Running)
+
+	// the new backend cannot be reached, the user stays and the move is given back
+	rt.backend.setDown(target, true)
+	rt.reconcile(1)
+	require.Equal(t, draining, rt.user(1).Status.Backend)
+	require.Empty(t, rt.backend.callsTo("drain-engine"))
+
+	// the next user can still leave, then the drain rate holds the first one
+	rt.backend.setDown(target, false)
+	rt.reconcile(2)
+	require.Equal(t, target, rt.user(2).Status.Backend)
+	require.Equal(t, []string{draining + " 2"}, rt.backend.callsTo("drain-engine"))
+	rt.reconcile(1)
+	require.Equal(t, draining, rt.user(1).Status.Backend)
+
+	require.NoError(t, rt.c.Get(rt.ctx, client.ObjectKeyFromObject(pod), pod))
+	require.Equal(t, "1", pod.Annotations[kDrainRemainingAnnotation])
+}
+
+func TestReconcileDrainPacing(t *testing.T) {
+	const draining, target = "http://10.0.0.1:8100", "http://10.0.0.2:8100"
+	endpoints := sharedBackends("10.0.0.1", "10.0.0.2")
+	endpoints.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: "shared-backend-1"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "shared-backend-1",
+		Namespace:   "default",
+		Annotations: map[string]string{kDrainAnnotation: "true"},
+	}}
+	users := fakeUsers{}
+	objs := []client.Object{endpoints, pod}
+	for uid := int64(1); uid <= 3; uid++ {
+		users[uid] = &sql.User{ID: uid}
+		objs = append(objs, testUser(uid, draining, Running))
+	}
+	rt := newReconcileTest(t, &config.AlmondConfig{BackendDrainRate: 600}, users, objs...)
+	interval := rt.r.drainInterval()
+	for uid := int64(1); uid <= 3; uid++ {
+		rt.backend.setState(draining, uid, Running)
+	}
+
+	// one user leaves per interval, the others come back when the next move is allowed
+	for round := 1; round <= 3; round++ {
+		moved := 0
+		for uid := int64(1); uid <= 3; uid++ {
+			if rt.user(uid).Status.Backend == target {
+				moved++
+				continue
+			}
+			result := rt.reconcile(uid)
+			if rt.user(uid).Status.Backend == target {
+				moved++
+			} else {
+				require.Equal(t, interval, result.RequeueAfter, "user %d", uid)
+			}
+		}
+		require.Equal(t, round, moved)
+		time.Sleep(interval)
+	}
+}
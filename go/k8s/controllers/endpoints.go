@@ -0,0 +1,96 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// kSharedBackend is the name of the Service and Endpoints of the shared backends
+const kSharedBackend = "shared-backend"
+
+const kDefaultEngineStatusPoll = 10 * time.Second
+
+// engineStatusInterval is the interval between status checks of running engines. Backend
+// changes are watched, so the checks only catch engines going idle or crashing, and
+// are a safety net when backends report engine events.
+func (r *UserReconciler) engineStatusInterval() time.Duration {
+	if r.almondConfig.EngineStatusPollSeconds > 0 {
+		return time.Duration(r.almondConfig.EngineStatusPollSeconds) * time.Second
+	}
+	if r.engineEvents {
+		return kSafetyNetPoll
+	}
+	return kDefaultEngineStatusPoll
+}
+
+// engineStatusPoll is how long a running engine waits for its next status check. It is
+// jittered so that users started together do not poll together.
+func (r *UserReconciler) engineStatusPoll() time.Duration {
+	return wait.Jitter(r.engineStatusInterval(), 0.2)
+}
+
+func isSharedBackendEndpoints(obj client.Object) bool {
+	return obj.GetName() == kSharedBackend
+}
+
+// usersForEndpoints maps a change of the shared-backend Endpoints to the users it affects.
+func (r *UserReconciler) usersForEndpoints(obj client.Object) []reconcile.Request {
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok {
+		return nil
+	}
+	users := &backendv1.UserList{}
+	if err := r.List(context.Background(), users, client.InNamespace(endpoints.Namespace)); err != nil {
+		r.Log.Error(err, "failed to list users for endpoints change")
+		return nil
+	}
+	ready := make(map[string]bool)
+	for _, b := range sharedBackendEndpoints(endpoints) {
+		ready[b.URL] = true
+	}
+	requests := affectedUsers(users.Items, ready)
+	r.Log.Info("shared backends changed:", "backends", len(ready), "users", len(requests))
+	return requests
+}
+
+// affectedUsers returns the shared users whose backend is no longer ready, and the users
+// waiting for a backend, which may now find one.
+func affectedUsers(users []backendv1.User, ready map[string]bool) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, u := range users {
+		if len(u.Status.Mode) > 0 && u.Status.Mode != backendv1.UserModeShared {
+			continue
+		}
+		affected := len(u.Status.Backend) == 0 || !ready[u.Status.Backend] ||
+			(len(u.Status.MigratingFrom) > 0 && !ready[u.Status.MigratingFrom]) ||
+			u.Status.State == Pending || u.Status.State == Error
+		if affected {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: u.Namespace, Name: u.Name},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func TestUsersForEndpoints(t *testing.T) {
+	user := func(id int64, mode, backend string, state UserState) *backendv1.User {
+		return &backendv1.User{
+			ObjectMeta: metav1.ObjectMeta{Name: userName(id), Namespace: "default"},
+			Spec:       backendv1.UserSpec{ID: id},
+			Status:     backendv1.UserStatus{Backend: backend, State: state, Mode: mode},
+		}
+	}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: kSharedBackend, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8100}},
+		}},
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+		user(1, "shared", "http://10.0.0.1:8100", Running),
+		user(2, "shared", "http://10.0.0.2:8100", Running),
+		user(3, "shared", "", Error),
+		user(4, "developer", "http://10.1.0.1:8100", Running),
+		user(5, "shared", "http://10.0.0.1:8100", Error),
+		user(6, "dedicated", "http://10.1.0.2:8100", Error),
+	).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard()}
+
+	var names []string
+	for _, req := range r.usersForEndpoints(endpoints) {
+		names = append(names, req.Name)
+	}
+	require.ElementsMatch(t, []string{"user-2", "user-3", "user-5"}, names)
+	require.True(t, isSharedBackendEndpoints(endpoints))
+	require.False(t, isSharedBackendEndpoints(&corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "user-1"}}))
+}
+
+func TestEngineStatusPoll(t *testing.T) {
+	r := &UserReconciler{almondConfig: &config.AlmondConfig{}}
+	poll := r.engineStatusPoll()
+	require.GreaterOrEqual(t, poll, 10*time.Second)
+	require.LessOrEqual(t, poll, 12*time.Second)
+
+	r.almondConfig.EngineStatusPollSeconds = 60
+	require.GreaterOrEqual(t, r.engineStatusPoll(), time.Minute)
+}
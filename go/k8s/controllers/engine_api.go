@@ -0,0 +1,258 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"almond-cloud/enginesig"
+)
+
+// EngineClient is the engine API of backends. Each call addresses the backend at
+// backendURL, and the engine of userID where relevant.
+type EngineClient interface {
+	// RunEngine starts an engine with the given options
+	RunEngine(ctx context.Context, backendURL string, options *PlatformOptions) error
+	// KillEngine stops an engine immediately
+	KillEngine(ctx context.Context, backendURL string, userID int64) error
+	// DrainEngine asks a backend to stop an engine once its state is saved. Draining
+	// again returns how the drain is going.
+	DrainEngine(ctx context.Context, backendURL string, userID int64) (DrainResult, error)
+	// EngineStatus returns the state of one engine
+	EngineStatus(ctx context.Context, backendURL string, userID int64) (UserState, error)
+	// EngineStatuses returns the states of all engines of a backend
+	EngineStatuses(ctx context.Context, backendURL string) (map[int64]UserState, error)
+	// BackendLoad returns the number of engines of a backend and its capacity
+	BackendLoad(ctx context.Context, backendURL string) (BackendLoad, error)
+}
+
+// DrainResult is the checkpoint of an engine drained off a backend
+type DrainResult string
+
+const (
+	// DrainDraining means the engine is still saving its state
+	DrainDraining DrainResult = "draining"
+	// DrainDrained means the engine stopped and its state is stored in the database
+	DrainDrained DrainResult = "drained"
+	// DrainFailed means the engine stopped with an error before its state was saved
+	DrainFailed DrainResult = "failed"
+	// DrainNotRunning means the backend has no engine and no recent drain of the user
+	DrainNotRunning DrainResult = "not-running"
+)
+
+const (
+	// kEngineAPITimeout bounds a whole request to the engine API of a backend
+	kEngineAPITimeout = 10 * time.Second
+	// kBackendCAFile is the optional CA bundle in the config directory that signs
+	// the certificates of https backends
+	kBackendCAFile = "backend-ca.crt"
+	// kBackendClientCertFile and kBackendClientKeyFile are the optional client
+	// certificate presented to https backends
+	kBackendClientCertFile = "backend-client.crt"
+	kBackendClientKeyFile  = "backend-client.key"
+)
+
+// httpEngineClient talks to backends over HTTP, signing requests when a key is set
+type httpEngineClient struct {
+	client     *http.Client
+	signingKey []byte
+	log        logr.Logger
+}
+
+// errEngineAPIUnsigned is returned when there is no key to sign engine API requests with
+var errEngineAPIUnsigned = errors.New("ENGINE_API_SIGNING_KEY is not set, set ENGINE_API_ALLOW_UNSIGNED to use the engine API unsigned")
+
+// NewHTTPEngineClient returns an EngineClient for the engine API served by backends
+// over HTTP. TLS settings are read from configDir. Without a signing key, requests go
+// unsigned only if allowUnsigned is set.
+func NewHTTPEngineClient(configDir string, signingKey string, allowUnsigned bool, log logr.Logger) (EngineClient, error) {
+	if len(signingKey) == 0 && !allowUnsigned {
+		return nil, errEngineAPIUnsigned
+	}
+	client, err := newEngineHTTPClient(configDir)
+	if err != nil {
+		return nil, err
+	}
+	c := &httpEngineClient{client: client, log: log}
+	if len(signingKey) > 0 {
+		c.signingKey = []byte(signingKey)
+	}
+	return c, nil
+}
+
+func (c *httpEngineClient) do(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
+	c.log.Info(fmt.Sprintf("HTTP %v url:%v", method, url))
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.signingKey != nil {
+		if err := enginesig.Sign(req, c.signingKey, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return c.client.Do(req)
+}
+
+// get calls a route of the engine API and decodes the data of its response into data
+func (c *httpEngineClient) get(ctx context.Context, url string, data interface{}) error {
+	resp, err := c.do(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed GET %s http status: %+v", url, resp)
+	}
+	if data == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(&JSONResponse{Data: data})
+}
+
+func (c *httpEngineClient) RunEngine(ctx context.Context, backendURL string, options *PlatformOptions) error {
+	b, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "POST", fmt.Sprintf("%s/run-engine", backendURL), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed runEngine http status: %+v", resp)
+	}
+	return nil
+}
+
+func (c *httpEngineClient) KillEngine(ctx context.Context, backendURL string, userID int64) error {
+	return c.get(ctx, fmt.Sprintf("%s/kill-engine?userid=%d", backendURL, userID), nil)
+}
+
+func (c *httpEngineClient) DrainEngine(ctx context.Context, backendURL string, userID int64) (DrainResult, error) {
+	var reported interface{}
+	if err := c.get(ctx, fmt.Sprintf("%s/drain-engine?userid=%d", backendURL, userID), &reported); err != nil {
+		return "", err
+	}
+	switch r := reported.(type) {
+	case string:
+		switch result := DrainResult(r); result {
+		case DrainDraining, DrainDrained, DrainFailed, DrainNotRunning:
+			return result, nil
+		}
+	case bool:
+		// backends before drain results report whether an engine was found
+		if r {
+			return DrainDraining, nil
+		}
+		return DrainNotRunning, nil
+	}
+	return "", fmt.Errorf("unknown drain result %v", reported)
+}
+
+func (c *httpEngineClient) EngineStatus(ctx context.Context, backendURL string, userID int64) (UserState, error) {
+	var reported string
+	if err := c.get(ctx, fmt.Sprintf("%s/engine-status?userid=%d", backendURL, userID), &reported); err != nil {
+		return "", err
+	}
+	c.log.Info("engine status:", "user", userID, "state", reported)
+	return engineState(reported)
+}
+
+func (c *httpEngineClient) EngineStatuses(ctx context.Context, backendURL string) (map[int64]UserState, error) {
+	reported := make(map[int64]string)
+	if err := c.get(ctx, fmt.Sprintf("%s/engine-statuses", backendURL), &reported); err != nil {
+		return nil, err
+	}
+	states := make(map[int64]UserState, len(reported))
+	for userID, s := range reported {
+		state, err := engineState(s)
+		if err != nil {
+			return nil, err
+		}
+		states[userID] = state
+	}
+	return states, nil
+}
+
+func (c *httpEngineClient) BackendLoad(ctx context.Context, backendURL string) (BackendLoad, error) {
+	load := BackendLoad{}
+	err := c.get(ctx, fmt.Sprintf("%s/load", backendURL), &load)
+	return load, err
+}
+
+// newEngineHTTPClient returns the client used to talk to the engine API of backends,
+// with timeouts and the TLS settings found in configDir.
+func newEngineHTTPClient(configDir string) (*http.Client, error) {
+	tlsConfig, err := backendTLSConfig(configDir)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: kEngineAPITimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: kEngineAPITimeout}, nil
+}
+
+func backendTLSConfig(configDir string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	ca, err := os.ReadFile(path.Join(configDir, kBackendCAFile))
+	if err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", kBackendCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	certFile := path.Join(configDir, kBackendClientCertFile)
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, path.Join(configDir, kBackendClientKeyFile))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"almond-cloud/enginesig"
+)
+
+// testEngineClient talks to httptest backends without signing
+func testEngineClient() EngineClient {
+	return &httpEngineClient{client: http.DefaultClient, log: logr.Discard()}
+}
+
+func TestEngineAPISigned(t *testing.T) {
+	key := "secret"
+	srv := httptest.NewServer(enginesig.Middleware([]byte(key), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"result":"ok","data":"running"}`))
+	})))
+	defer srv.Close()
+	ctx := context.Background()
+
+	_, err := NewHTTPEngineClient(t.TempDir(), "", false, logr.Discard())
+	require.Error(t, err, "no key without the opt-in")
+	unsigned, err := NewHTTPEngineClient(t.TempDir(), "", true, logr.Discard())
+	require.NoError(t, err)
+	_, err = unsigned.EngineStatus(ctx, srv.URL, 1)
+	require.Error(t, err, "unsigned requests are rejected")
+
+	signed, err := NewHTTPEngineClient(t.TempDir(), key, false, logr.Discard())
+	require.NoError(t, err)
+	state, err := signed.EngineStatus(ctx, srv.URL, 1)
+	require.NoError(t, err)
+	require.Equal(t, Running, state)
+	require.NoError(t, signed.KillEngine(ctx, srv.URL, 1))
+	require.NoError(t, signed.RunEngine(ctx, srv.URL, &PlatformOptions{UserID: 1}))
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig, err := backendTLSConfig(dir)
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig.RootCAs)
+	require.Empty(t, tlsConfig.Certificates)
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"almond-cloud/dbproxy"
+	"almond-cloud/enginesig"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// EngineEvent is reported by a backend when an engine changes state
+type EngineEvent struct {
+	UserID int64  `json:"userId"`
+	Event  string `json:"event"`
+	// Pod is the name of the backend pod that runs the engine
+	Pod string `json:"pod"`
+}
+
+// Engine events reported by backends
+const (
+	EngineStartedEvent = "started"
+	EngineIdleEvent    = "idle"
+	EngineCrashedEvent = "crashed"
+	EngineStoppedEvent = "stopped"
+)
+
+// kEngineEventsLabel marks the manager pod that serves engine events. Only the leader runs
+// the engine event server, and the engine-events Service selects the pod with the label.
+const kEngineEventsLabel = "backend.almond.stanford.edu/engine-events"
+
+// kSafetyNetPoll is the default interval of the status poller when backends report
+// engine events, it only catches events that were lost.
+const kSafetyNetPoll = 60 * time.Second
+
+func engineEventState(e string) (UserState, error) {
+	switch e {
+	case EngineStartedEvent:
+		return Running, nil
+	case EngineIdleEvent:
+		return Idle, nil
+	case EngineCrashedEvent, EngineStoppedEvent:
+		return Stopped, nil
+	}
+	return "", fmt.Errorf("unknown engine event %q", e)
+}
+
+// engineEventServer receives engine events pushed by backends to the manager process.
+// Backends sign events with the engine API signing key, like the controller signs its
+// requests to them, and send the dbproxy access token of the user, so an engine can
+// only report about itself. Events name the backend pod they come from, and only events
+// from the current backend of the user are recorded.
+type engineEventServer struct {
+	r          *UserReconciler
+	addr       string
+	namespace  string
+	pod        string
+	events     chan event.GenericEvent
+	signingKey []byte
+	nonces     *enginesig.Nonces
+}
+
+// EngineEventServer returns a manager.Runnable serving engine events on addr. The
+// status poller slows down to a safety net once backends report events. The manager pod,
+// in namespace, is labeled for the engine-events Service while it serves events.
+func (r *UserReconciler) EngineEventServer(addr, namespace, pod string) manager.Runnable {
+	r.engineEvents = true
+	s := &engineEventServer{r: r, addr: addr, namespace: namespace, pod: pod, events: r.statusEvents,
+		nonces: enginesig.NewNonces()}
+	if len(r.almondConfig.EngineAPISigningKey) > 0 {
+		s.signingKey = []byte(r.almondConfig.EngineAPISigningKey)
+	}
+	return s
+}
+
+// Start implements manager.Runnable
+func (s *engineEventServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/engine-events", s)
+	srv := &http.Server{Addr: s.addr, Handler: mux}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if err := labelEngineEventsPod(ctx, s.r.Client, s.namespace, s.pod, true); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := labelEngineEventsPod(shutdownCtx, s.r.Client, s.namespace, s.pod, false); err != nil {
+			s.r.Log.Error(err, "failed to unlabel the engine events pod")
+		}
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// UnlabelEngineEventsPod removes the engine events label left on the manager pod by a
+// previous run of the manager in the same pod, before a new leader is elected.
+func (r *UserReconciler) UnlabelEngineEventsPod(ctx context.Context, namespace, pod string) error {
+	return labelEngineEventsPod(ctx, r.Client, namespace, pod, false)
+}
+
+// labelEngineEventsPod sets or removes the engine events label of a manager pod. Without a
+// pod name, the manager does not run in a pod and there is nothing to label.
+func labelEngineEventsPod(ctx context.Context, c client.Client, namespace, pod string, serving bool) error {
+	if len(pod) == 0 {
+		return nil
+	}
+	var value interface{}
+	if serving {
+		value = "true"
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{kEngineEventsLabel: value}},
+	})
+	if err != nil {
+		return err
+	}
+	obj := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: pod, Namespace: namespace}}
+	return c.Patch(ctx, obj, client.RawPatch(types.MergePatchType, patch))
+}
+
+func (s *engineEventServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.signingKey != nil {
+		if err := enginesig.VerifyOnce(req, s.signingKey, time.Now(), s.nonces); err != nil {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	} else if !s.r.almondConfig.EngineAPIAllowUnsigned {
+		writeJSONError(w, http.StatusUnauthorized, errEngineAPIUnsigned.Error())
+		return
+	}
+	uid, err := dbproxy.VerifyToken(req.Header.Get("Authorization"))
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	var e EngineEvent
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if e.UserID != uid {
+		writeJSONError(w, http.StatusForbidden, "token does not match user")
+		return
+	}
+	state, err := engineEventState(e.Event)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.handle(req.Context(), e.UserID, e.Pod, state); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&JSONResponse{Result: "ok"})
+}
+
+// handle records the state reported by pod and enqueues a reconcile of the user
+func (s *engineEventServer) handle(ctx context.Context, userID int64, pod string, state UserState) error {
+	user := &backendv1.User{}
+	if err := s.r.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: userName(userID)}, user); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	current, err := s.fromCurrentBackend(ctx, user, pod)
+	if err != nil {
+		return err
+	}
+	if !current {
+		// the engine moved away from the pod, or the pod is not ready: the poller catches up
+		s.r.Log.Info("dropped engine event:", "user", userID, "state", state, "pod", pod, "backend", user.Status.Backend)
+		return nil
+	}
+	s.r.Log.Info("engine event:", "user", userID, "state", state)
+	s.r.statuses.update(user.Status.Backend, userID, state)
+	select {
+	case s.events <- event.GenericEvent{Object: user}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// fromCurrentBackend returns whether pod is the current backend of the user. Without the
+// check, the stopped event of an engine drained off its old backend would be recorded
+// against the new backend. Users with their own deployment are matched against the
+// pods behind their service.
+func (s *engineEventServer) fromCurrentBackend(ctx context.Context, user *backendv1.User, pod string) (bool, error) {
+	if len(pod) == 0 || len(user.Status.Backend) == 0 {
+		return false, nil
+	}
+	name := kSharedBackend
+	deployment := len(user.Status.Mode) > 0 && user.Status.Mode != backendv1.UserModeShared
+	if deployment {
+		name = userName(user.Spec.ID)
+	}
+	endpoints := &corev1.Endpoints{}
+	if err := s.r.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: name}, endpoints); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	for _, b := range sharedBackendEndpoints(endpoints) {
+		if b.Name == pod && (deployment || b.URL == user.Status.Backend) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&JSONResponse{Result: "error", Data: message})
+}
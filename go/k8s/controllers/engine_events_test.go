@@ -0,0 +1,220 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"almond-cloud/config"
+	"almond-cloud/dbproxy"
+	"almond-cloud/enginesig"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// sharedBackendPods returns the shared-backend Endpoints of backend pods at ips, named
+// shared-backend-0, shared-backend-1...
+func sharedBackendPods(ips ...string) *corev1.Endpoints {
+	endpoints := sharedBackends(ips...)
+	for i := range endpoints.Subsets[0].Addresses {
+		endpoints.Subsets[0].Addresses[i].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: fmt.Sprintf("shared-backend-%d", i)}
+	}
+	return endpoints
+}
+
+func TestEngineEventServer(t *testing.T) {
+	signingKey := config.GetAlmondConfig().JWTSigningKey
+	config.GetAlmondConfig().JWTSigningKey = "test-signing-key"
+	defer func() { config.GetAlmondConfig().JWTSigningKey = signingKey }()
+
+	user := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(1), Namespace: "default"},
+		Spec:       backendv1.UserSpec{ID: 1},
+		Status:     backendv1.UserStatus{Backend: "http://10.0.0.1:8100", State: Running, Mode: backendv1.UserModeShared},
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(user, sharedBackendPods("10.0.0.1", "10.0.0.2")).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{EngineAPIAllowUnsigned: true},
+		statuses: newEngineStatusCache(), statusEvents: make(chan event.GenericEvent, 1)}
+	r.statuses.set("http://10.0.0.1:8100", map[int64]UserState{1: Running})
+	server := r.EngineEventServer(":0", "default", "").(*engineEventServer)
+	require.Equal(t, kSafetyNetPoll, r.engineStatusInterval())
+
+	post := func(token, body string) int {
+		req := httptest.NewRequest("POST", "/engine-events", strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+	token1, err := dbproxy.SignToken(1)
+	require.NoError(t, err)
+	token2, err := dbproxy.SignToken(2)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusUnauthorized, post("", `{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+	require.Equal(t, http.StatusForbidden, post(token2, `{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+	require.Equal(t, http.StatusBadRequest, post(token1, `{"userId":1,"event":"exploded","pod":"shared-backend-0"}`))
+
+	// the event updates the polled state and enqueues the user
+	require.Equal(t, http.StatusOK, post(token1, `{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+	state, ok := r.statuses.get("http://10.0.0.1:8100", 1, time.Minute)
+	require.True(t, ok)
+	require.Equal(t, Idle, state)
+	e := <-r.statusEvents
+	require.Equal(t, userName(1), e.Object.GetName())
+
+	// events from another backend, like the old backend of a moved engine, are dropped
+	require.Equal(t, http.StatusOK, post(token1, `{"userId":1,"event":"stopped","pod":"shared-backend-1"}`))
+	require.Equal(t, http.StatusOK, post(token1, `{"userId":1,"event":"stopped"}`))
+	state, _ = r.statuses.get("http://10.0.0.1:8100", 1, time.Minute)
+	require.Equal(t, Idle, state)
+	require.Len(t, r.statusEvents, 0)
+
+	// events of users without a User resource are ignored
+	require.Equal(t, http.StatusOK, post(token2, `{"userId":2,"event":"crashed","pod":"shared-backend-0"}`))
+	require.Len(t, r.statusEvents, 0)
+}
+
+func TestEngineEventServerSignature(t *testing.T) {
+	signingKey := config.GetAlmondConfig().JWTSigningKey
+	config.GetAlmondConfig().JWTSigningKey = "test-signing-key"
+	defer func() { config.GetAlmondConfig().JWTSigningKey = signingKey }()
+
+	user := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(1), Namespace: "default"},
+		Spec:       backendv1.UserSpec{ID: 1},
+		Status:     backendv1.UserStatus{Backend: "http://10.0.0.1:8100", State: Running, Mode: backendv1.UserModeShared},
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(user, sharedBackendPods("10.0.0.1", "10.0.0.2")).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{EngineAPISigningKey: "engine-key"},
+		statuses: newEngineStatusCache(), statusEvents: make(chan event.GenericEvent, 1)}
+	server := r.EngineEventServer(":0", "default", "").(*engineEventServer)
+
+	post := func(key string, userID int64) int {
+		req := httptest.NewRequest("POST", "/engine-events", strings.NewReader(`{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+		token, err := dbproxy.SignToken(userID)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if len(key) > 0 {
+			require.NoError(t, enginesig.Sign(req, []byte(key), time.Now()))
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the access token of the user is not enough, the event must be signed by a backend
+	require.Equal(t, http.StatusUnauthorized, post("", 1))
+	require.Equal(t, http.StatusUnauthorized, post("other-key", 1))
+	// a backend still reports only about the engine whose token it holds
+	require.Equal(t, http.StatusForbidden, post("engine-key", 2))
+	require.Equal(t, http.StatusOK, post("engine-key", 1))
+	e := <-r.statusEvents
+	require.Equal(t, userName(1), e.Object.GetName())
+
+	// a signed event is accepted once
+	req := httptest.NewRequest("POST", "/engine-events", strings.NewReader(`{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+	token, err := dbproxy.SignToken(1)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	require.NoError(t, enginesig.Sign(req, []byte("engine-key"), time.Now()))
+	replay := req.Clone(req.Context())
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	<-r.statusEvents
+	replay.Body = ioutil.NopCloser(strings.NewReader(`{"userId":1,"event":"idle","pod":"shared-backend-0"}`))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, replay)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// without a key, events are rejected unless unsigned events are allowed
+	r.almondConfig.EngineAPISigningKey = ""
+	server = r.EngineEventServer(":0", "default", "").(*engineEventServer)
+	require.Equal(t, http.StatusUnauthorized, post("", 1))
+}
+
+func TestEngineEventFromCurrentBackend(t *testing.T) {
+	deployment := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(3), Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.2.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "user-3-abc"}}},
+			Ports:     []corev1.EndpointPort{{Port: 8100}},
+		}},
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(sharedBackendPods("10.0.0.1"), deployment).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{}}
+	server := r.EngineEventServer(":0", "default", "").(*engineEventServer)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		user backendv1.UserStatus
+		pod  string
+		want bool
+	}{
+		{backendv1.UserStatus{Backend: "http://10.0.0.1:8100", Mode: backendv1.UserModeShared}, "shared-backend-0", true},
+		{backendv1.UserStatus{Backend: "http://10.0.0.9:8100", Mode: backendv1.UserModeShared}, "shared-backend-0", false},
+		{backendv1.UserStatus{Backend: "http://10.0.0.1:8100", Mode: backendv1.UserModeShared}, "", false},
+		// the backend of a user with its own deployment is its service
+		{backendv1.UserStatus{Backend: "http://10.1.0.3:8100", Mode: backendv1.UserModeDeveloper}, "user-3-abc", true},
+		{backendv1.UserStatus{Backend: "http://10.1.0.3:8100", Mode: backendv1.UserModeDeveloper}, "shared-backend-0", false},
+		{backendv1.UserStatus{Mode: backendv1.UserModeDeveloper}, "user-3-abc", false},
+	} {
+		user := &backendv1.User{Spec: backendv1.UserSpec{ID: 3}, Status: tc.user}
+		current, err := server.fromCurrentBackend(ctx, user, tc.pod)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, current, "%v %s", tc.user, tc.pod)
+	}
+}
+
+func TestEngineEventsPodLabel(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "controller-manager-abc", Namespace: "default",
+		Labels: map[string]string{"control-plane": "controller-manager"}}}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(pod).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{}}
+	ctx := context.Background()
+	key := client.ObjectKeyFromObject(pod)
+
+	// the leader labels its pod while it serves events
+	require.NoError(t, labelEngineEventsPod(ctx, c, "default", pod.Name, true))
+	labeled := &corev1.Pod{}
+	require.NoError(t, c.Get(ctx, key, labeled))
+	require.Equal(t, map[string]string{"control-plane": "controller-manager", kEngineEventsLabel: "true"}, labeled.Labels)
+
+	// a restarted manager removes the label until it is the leader again
+	require.NoError(t, r.UnlabelEngineEventsPod(ctx, "default", pod.Name))
+	unlabeled := &corev1.Pod{}
+	require.NoError(t, c.Get(ctx, key, unlabeled))
+	require.Equal(t, map[string]string{"control-plane": "controller-manager"}, unlabeled.Labels)
+
+	// outside of a pod there is nothing to label
+	require.NoError(t, r.UnlabelEngineEventsPod(ctx, "default", ""))
+}
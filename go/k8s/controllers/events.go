@@ -0,0 +1,103 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// Event reasons recorded on User resources
+const (
+	EventBackendAssigned   = "BackendAssigned"
+	EventEngineStarted     = "EngineStarted"
+	EventEngineKilled      = "EngineKilled"
+	EventIdleShutdown      = "IdleShutdown"
+	EventDeploymentCreated = "DeploymentCreated"
+	EventServiceCreated    = "ServiceCreated"
+	EventDeploymentUpdated = "DeploymentUpdated"
+	EventServiceUpdated    = "ServiceUpdated"
+	EventReconcileError    = "ReconcileError"
+	EventEngineFailed      = "EngineFailed"
+	EventEngineRetry       = "EngineRetry"
+	EventSuspended         = "Suspended"
+	EventResumed           = "Resumed"
+	EventWokenUp           = "WokenUp"
+)
+
+// kWarningRepeatInterval is how often the same warning is recorded again for a user.
+// The event correlator of client-go aggregates and rate limits what gets through.
+const kWarningRepeatInterval = 5 * time.Minute
+
+type warningRecord struct {
+	message  string
+	recorded time.Time
+}
+
+// warningThrottle drops warnings that repeat the last one of a user. A failing user
+// is reconciled every few seconds and would otherwise record an event each time.
+type warningThrottle struct {
+	mu   sync.Mutex
+	last map[types.NamespacedName]map[string]warningRecord
+}
+
+func newWarningThrottle() *warningThrottle {
+	return &warningThrottle{last: make(map[types.NamespacedName]map[string]warningRecord)}
+}
+
+func (t *warningThrottle) allow(name types.NamespacedName, reason, message string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reasons, ok := t.last[name]
+	if !ok {
+		reasons = make(map[string]warningRecord)
+		t.last[name] = reasons
+	}
+	if last, ok := reasons[reason]; ok && last.message == message && time.Since(last.recorded) < kWarningRepeatInterval {
+		return false
+	}
+	reasons[reason] = warningRecord{message: message, recorded: time.Now()}
+	return true
+}
+
+// forget drops the warnings of a deleted user
+func (t *warningThrottle) forget(name types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.last, name)
+}
+
+func (r *UserReconciler) event(user *backendv1.User, reason, messageFmt string, args ...interface{}) {
+	if user == nil || r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(user, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+func (r *UserReconciler) warning(user *backendv1.User, reason, message string) {
+	if user == nil || r.Recorder == nil {
+		return
+	}
+	name := types.NamespacedName{Namespace: user.Namespace, Name: user.Name}
+	if !r.warnings.allow(name, reason, message) {
+		return
+	}
+	r.Recorder.Event(user, corev1.EventTypeWarning, reason, message)
+}
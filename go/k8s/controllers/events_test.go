@@ -0,0 +1,59 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func TestWarningThrottle(t *testing.T) {
+	throttle := newWarningThrottle()
+	name := types.NamespacedName{Namespace: "default", Name: "user-1"}
+	require.True(t, throttle.allow(name, EventReconcileError, "connection refused"))
+	require.False(t, throttle.allow(name, EventReconcileError, "connection refused"))
+	require.True(t, throttle.allow(name, EventReconcileError, "timeout"))
+	require.True(t, throttle.allow(types.NamespacedName{Namespace: "default", Name: "user-2"}, EventReconcileError, "timeout"))
+
+	throttle.forget(name)
+	require.True(t, throttle.allow(name, EventReconcileError, "timeout"))
+}
+
+func TestRecordEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &UserReconciler{Recorder: recorder, warnings: newWarningThrottle()}
+	user := &backendv1.User{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "user-1"}}
+
+	r.event(user, EventEngineStarted, "Started engine on %s", "http://b")
+	r.warning(user, EventReconcileError, "connection refused")
+	r.warning(user, EventReconcileError, "connection refused")
+	r.event(nil, EventEngineStarted, "deleted users have no events")
+	close(recorder.Events)
+
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	require.Equal(t, []string{
+		"Normal EngineStarted Started engine on http://b",
+		"Warning ReconcileError connection refused",
+	}, events)
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// kRetryAnnotation on a Failed user makes the controller start its engine again. The
+// controller removes the annotation once it has seen it.
+const kRetryAnnotation = "backend.almond.stanford.edu/retry"
+
+const (
+	kDefaultEngineMaxFailures   = 5
+	kDefaultEngineFailureWindow = 10 * time.Minute
+	kEngineRetryBaseDelay       = 2 * time.Second
+	kEngineRetryMaxDelay        = 5 * time.Minute
+)
+
+// An engine that fails to start, or crashes after it started, is started again after
+// an exponential backoff. After too many failures within the failure window the user
+// is Failed and left alone until the spec changes or the retry annotation is set.
+
+func (r *UserReconciler) engineMaxFailures() int32 {
+	if r.almondConfig.EngineMaxFailures > 0 {
+		return int32(r.almondConfig.EngineMaxFailures)
+	}
+	return kDefaultEngineMaxFailures
+}
+
+func (r *UserReconciler) engineFailureWindow() time.Duration {
+	if r.almondConfig.EngineFailureWindowSeconds > 0 {
+		return time.Duration(r.almondConfig.EngineFailureWindowSeconds) * time.Second
+	}
+	return kDefaultEngineFailureWindow
+}
+
+// retryDelay is the backoff after the given number of consecutive failures
+func retryDelay(failures int32) time.Duration {
+	delay := kEngineRetryBaseDelay
+	for i := int32(1); i < failures && delay < kEngineRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > kEngineRetryMaxDelay {
+		delay = kEngineRetryMaxDelay
+	}
+	return delay
+}
+
+// carryOverFailures copies the failure tracking of the previous status
+func carryOverFailures(user *backendv1.User, status *backendv1.UserStatus) {
+	status.ConsecutiveFailures = user.Status.ConsecutiveFailures
+	status.FirstFailureTime = user.Status.FirstFailureTime
+	status.NextRetryTime = user.Status.NextRetryTime
+}
+
+// keepFailed keeps a Failed user Failed, with the error it failed with, when a reconcile
+// stops before it gets to the failed engine, on a transient error or while the
+// deployment of the user is not available.
+func keepFailed(user *backendv1.User, status *backendv1.UserStatus) {
+	if user.Status.State != Failed || retryRequested(user) {
+		return
+	}
+	if status.ConsecutiveFailures != user.Status.ConsecutiveFailures ||
+		!status.FirstFailureTime.Equal(user.Status.FirstFailureTime) {
+		// the reconcile retried the engine and recorded its failures itself
+		return
+	}
+	switch status.State {
+	case Running, Idle, Stopping, Suspended, Failed:
+		return
+	}
+	status.State = Failed
+	status.LastError = user.Status.LastError
+	status.LastErrorTime = user.Status.LastErrorTime
+}
+
+// recordFailure counts a failed start or a crash of the engine. It returns how long to
+// wait before the next start, or false if the user is now Failed.
+func (r *UserReconciler) recordFailure(status *backendv1.UserStatus, err error) (time.Duration, bool) {
+	now := metav1.Now()
+	if status.FirstFailureTime == nil || now.Sub(status.FirstFailureTime.Time) > r.engineFailureWindow() {
+		status.FirstFailureTime = &now
+		status.ConsecutiveFailures = 0
+	}
+	status.ConsecutiveFailures++
+	if status.ConsecutiveFailures >= r.engineMaxFailures() {
+		setError(status, fmt.Errorf("engine failed %d times since %s, giving up: %w",
+			status.ConsecutiveFailures, status.FirstFailureTime.Format(time.RFC3339), err))
+		status.State = Failed
+		status.NextRetryTime = nil
+		return 0, false
+	}
+	setError(status, err)
+	delay := retryDelay(status.ConsecutiveFailures)
+	next := metav1.NewTime(now.Add(delay))
+	status.NextRetryTime = &next
+	return delay, true
+}
+
+// crashLoopError returns why the engine container of a deployment keeps crashing, nil
+// if no pod of the deployment is crash looping.
+func (r *UserReconciler) crashLoopError(ctx context.Context, deployment *appsv1.Deployment) (crash error, err error) {
+	if deployment.Spec.Selector == nil {
+		return nil, nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(deployment.Namespace),
+		client.MatchingLabels(deployment.Spec.Selector.MatchLabels)); err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		for _, c := range pod.Status.ContainerStatuses {
+			if c.State.Waiting == nil || c.State.Waiting.Reason != "CrashLoopBackOff" {
+				continue
+			}
+			reason := c.State.Waiting.Message
+			if last := c.LastTerminationState.Terminated; last != nil {
+				reason = fmt.Sprintf("%s, exit code %d", last.Reason, last.ExitCode)
+			}
+			return fmt.Errorf("container %s of pod %s crashed %d times: %s", c.Name, pod.Name, c.RestartCount, reason), nil
+		}
+	}
+	return nil, nil
+}
+
+// recordCrashLoop counts a crash looping deployment as a failed start, once per retry
+// delay since kubernetes restarts the container on its own. It returns when to check
+// the deployment again.
+func (r *UserReconciler) recordCrashLoop(status *backendv1.UserStatus, crash error) ctrl.Result {
+	if status.NextRetryTime != nil {
+		if backoff := time.Until(status.NextRetryTime.Time); backoff > 0 {
+			setError(status, crash)
+			return ctrl.Result{RequeueAfter: backoff}
+		}
+	}
+	if backoff, retry := r.recordFailure(status, crash); retry {
+		return ctrl.Result{RequeueAfter: backoff}
+	}
+	return ctrl.Result{}
+}
+
+// recordRunning forgets the failures of an engine that has been running for longer
+// than the failure window since they started.
+func (r *UserReconciler) recordRunning(status *backendv1.UserStatus) {
+	status.NextRetryTime = nil
+	if status.FirstFailureTime != nil && time.Since(status.FirstFailureTime.Time) > r.engineFailureWindow() {
+		status.ConsecutiveFailures = 0
+		status.FirstFailureTime = nil
+	}
+}
+
+// retryRequested is true when a Failed user should be started again: its spec changed
+// since it failed, or the retry annotation is set.
+func retryRequested(user *backendv1.User) bool {
+	if user.Generation != user.Status.ObservedGeneration {
+		return true
+	}
+	_, ok := user.Annotations[kRetryAnnotation]
+	return ok
+}
+
+// resetFailures clears the failures of a user that is retried and removes the retry
+// annotation.
+func (r *UserReconciler) resetFailures(ctx context.Context, user *backendv1.User, status *backendv1.UserStatus) error {
+	status.ConsecutiveFailures = 0
+	status.FirstFailureTime = nil
+	status.NextRetryTime = nil
+	if _, ok := user.Annotations[kRetryAnnotation]; !ok {
+		return nil
+	}
+	delete(user.Annotations, kRetryAnnotation)
+	return r.Update(ctx, user)
+}
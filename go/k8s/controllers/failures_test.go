@@ -0,0 +1,74 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func TestRetryDelay(t *testing.T) {
+	require.Equal(t, 2*time.Second, retryDelay(1))
+	require.Equal(t, 4*time.Second, retryDelay(2))
+	require.Equal(t, 16*time.Second, retryDelay(4))
+	require.Equal(t, kEngineRetryMaxDelay, retryDelay(100))
+}
+
+func TestFailureWindow(t *testing.T) {
+	r := &UserReconciler{almondConfig: &config.AlmondConfig{EngineMaxFailures: 2, EngineFailureWindowSeconds: 60}}
+	status := &backendv1.UserStatus{}
+
+	_, retry := r.recordFailure(status, errors.New("boom"))
+	require.True(t, retry)
+	require.Equal(t, Error, status.State)
+
+	// failures older than the window start a new count
+	old := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	status.FirstFailureTime = &old
+	_, retry = r.recordFailure(status, errors.New("boom"))
+	require.True(t, retry)
+	require.Equal(t, int32(1), status.ConsecutiveFailures)
+
+	// a running engine keeps its failures until the window is over
+	r.recordRunning(status)
+	require.Nil(t, status.NextRetryTime)
+	require.Equal(t, int32(1), status.ConsecutiveFailures)
+	_, retry = r.recordFailure(status, errors.New("boom"))
+	require.False(t, retry)
+	require.Equal(t, Failed, status.State)
+
+	status.FirstFailureTime = &old
+	r.recordRunning(status)
+	require.Zero(t, status.ConsecutiveFailures)
+	require.Nil(t, status.FirstFailureTime)
+}
+
+func TestRetryRequested(t *testing.T) {
+	user := &backendv1.User{}
+	user.Generation = 2
+	user.Status.ObservedGeneration = 2
+	require.False(t, retryRequested(user))
+	user.Annotations = map[string]string{kRetryAnnotation: ""}
+	require.True(t, retryRequested(user))
+	user.Annotations = nil
+	user.Generation = 3
+	require.True(t, retryRequested(user))
+}
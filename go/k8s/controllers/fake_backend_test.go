@@ -0,0 +1,213 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"almond-cloud/sql"
+)
+
+// fakeBackend is an in-process EngineClient that simulates the engines of any number
+// of backends. A started engine is Starting until its status is checked once, then
+// Running. Backends can be taken down and operations made to fail.
+type fakeBackend struct {
+	mu       sync.Mutex
+	engines  map[string]map[int64]UserState
+	options  map[int64]*PlatformOptions
+	down     map[string]bool
+	failures map[string]error
+	calls    []string
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		engines:  make(map[string]map[int64]UserState),
+		options:  make(map[int64]*PlatformOptions),
+		down:     make(map[string]bool),
+		failures: make(map[string]error),
+	}
+}
+
+// setState sets the state of an engine, as if it had changed on its own
+func (b *fakeBackend) setState(backendURL string, userID int64, state UserState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.engines[backendURL] == nil {
+		b.engines[backendURL] = make(map[int64]UserState)
+	}
+	b.engines[backendURL][userID] = state
+}
+
+// state returns the state of an engine, Stopped if the backend does not run it
+func (b *fakeBackend) state(backendURL string, userID int64) UserState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if state, ok := b.engines[backendURL][userID]; ok {
+		return state
+	}
+	return Stopped
+}
+
+// setDown makes calls to a backend fail as if it could not be reached
+func (b *fakeBackend) setDown(backendURL string, down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down[backendURL] = down
+}
+
+// fail makes an operation, named after its route, fail with err until cleared with nil
+func (b *fakeBackend) fail(op string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[op] = err
+}
+
+// callsTo returns the calls to an operation, as "backend userID"
+func (b *fakeBackend) callsTo(op string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var calls []string
+	for _, c := range b.calls {
+		if strings.HasPrefix(c, op+" ") {
+			calls = append(calls, strings.TrimPrefix(c, op+" "))
+		}
+	}
+	return calls
+}
+
+// call records a call and returns the error it should fail with. b.mu must be held.
+func (b *fakeBackend) call(op, backendURL string, userID int64) error {
+	b.calls = append(b.calls, fmt.Sprintf("%s %s %d", op, backendURL, userID))
+	if b.down[backendURL] {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return b.failures[op]
+}
+
+func (b *fakeBackend) RunEngine(ctx context.Context, backendURL string, options *PlatformOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("run-engine", backendURL, options.UserID); err != nil {
+		return err
+	}
+	if b.engines[backendURL] == nil {
+		b.engines[backendURL] = make(map[int64]UserState)
+	}
+	b.options[options.UserID] = options
+	if _, ok := b.engines[backendURL][options.UserID]; ok {
+		// like backends, starting an engine that is already there does nothing
+		return nil
+	}
+	b.engines[backendURL][options.UserID] = Starting
+	return nil
+}
+
+func (b *fakeBackend) KillEngine(ctx context.Context, backendURL string, userID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("kill-engine", backendURL, userID); err != nil {
+		return err
+	}
+	delete(b.engines[backendURL], userID)
+	return nil
+}
+
+func (b *fakeBackend) DrainEngine(ctx context.Context, backendURL string, userID int64) (DrainResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("drain-engine", backendURL, userID); err != nil {
+		return "", err
+	}
+	if _, ok := b.engines[backendURL][userID]; !ok {
+		return DrainNotRunning, nil
+	}
+	delete(b.engines[backendURL], userID)
+	return DrainDrained, nil
+}
+
+func (b *fakeBackend) EngineStatus(ctx context.Context, backendURL string, userID int64) (UserState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("engine-status", backendURL, userID); err != nil {
+		return "", err
+	}
+	state, ok := b.engines[backendURL][userID]
+	if !ok {
+		return Stopped, nil
+	}
+	if state == Starting {
+		b.engines[backendURL][userID] = Running
+	}
+	return state, nil
+}
+
+func (b *fakeBackend) EngineStatuses(ctx context.Context, backendURL string) (map[int64]UserState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("engine-statuses", backendURL, 0); err != nil {
+		return nil, err
+	}
+	states := make(map[int64]UserState, len(b.engines[backendURL]))
+	for userID, state := range b.engines[backendURL] {
+		states[userID] = state
+	}
+	return states, nil
+}
+
+func (b *fakeBackend) BackendLoad(ctx context.Context, backendURL string) (BackendLoad, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("load", backendURL, 0); err != nil {
+		return BackendLoad{}, err
+	}
+	load := BackendLoad{Engines: len(b.engines[backendURL])}
+	for _, state := range b.engines[backendURL] {
+		if state == Running {
+			load.Running++
+		}
+	}
+	return load, nil
+}
+
+// fakeUsers is a UserLookup over a fixed set of users
+type fakeUsers map[int64]*sql.User
+
+func (u fakeUsers) GetUser(userID int64) (*sql.User, error) {
+	if user, ok := u[userID]; ok {
+		return user, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (u fakeUsers) GetDeveloperKey(userID int64) (*string, error) {
+	if _, ok := u[userID]; !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return nil, nil
+}
+
+func (u fakeUsers) HasAutomations(userID int64) (bool, error) {
+	if _, ok := u[userID]; !ok {
+		return false, gorm.ErrRecordNotFound
+	}
+	return false, nil
+}
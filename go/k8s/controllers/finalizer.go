@@ -0,0 +1,104 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// kUserFinalizer keeps a deleted User until its engine is killed and its deployment
+// and service are deleted.
+const kUserFinalizer = "backend.almond.stanford.edu/cleanup"
+
+// kPurgeCacheAnnotation on a deleted User drops its cached database entries. The frontend
+// sets it when the account is deleted, Users deleted to stop or restart their engine keep
+// their entries, which expire or follow the cache version, so the engine starts again
+// without going to the database.
+const kPurgeCacheAnnotation = "backend.almond.stanford.edu/purge-cache"
+
+// ensureFinalizer adds the cleanup finalizer to a User that does not have it yet.
+func (r *UserReconciler) ensureFinalizer(ctx context.Context, user *backendv1.User) error {
+	if controllerutil.ContainsFinalizer(user, kUserFinalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(user, kUserFinalizer)
+	return r.Update(ctx, user)
+}
+
+// finalizeUser cleans up after a User marked for deletion and removes the finalizer.
+// It returns true once the finalizer is removed and the User can go away. A failed
+// cleanup leaves the finalizer and is reported in the status.
+func (r *UserReconciler) finalizeUser(ctx context.Context, req ctrl.Request, user *backendv1.User,
+	status *backendv1.UserStatus, deployment bool) bool {
+	status.Backend = user.Status.Backend
+	status.State = Stopping
+	if !controllerutil.ContainsFinalizer(user, kUserFinalizer) {
+		return true
+	}
+	if err := r.cleanupUser(ctx, req, user, deployment); err != nil {
+		setError(status, fmt.Errorf("cleanup failed: %w", err))
+		return false
+	}
+	controllerutil.RemoveFinalizer(user, kUserFinalizer)
+	if err := r.Update(ctx, user); err != nil {
+		setError(status, err)
+		return false
+	}
+	r.warnings.forget(req.NamespacedName)
+	return true
+}
+
+// cleanupUser kills the engine of a user, deletes its deployment and service and, if the
+// User asks for it, drops its cached database entries.
+func (r *UserReconciler) cleanupUser(ctx context.Context, req ctrl.Request, user *backendv1.User, deployment bool) error {
+	userID := user.Spec.ID
+	if deployment {
+		if err := r.deleteDeploymentService(ctx, req, userID); err != nil {
+			return err
+		}
+	} else if err := r.killEngines(ctx, user, "user is being deleted"); err != nil {
+		return err
+	}
+	if purge, _ := strconv.ParseBool(user.Annotations[kPurgeCacheAnnotation]); purge {
+		r.cache.invalidate(userID)
+	}
+	return nil
+}
+
+// killEngines kills the engine of a shared user on its backend, and on the backend it
+// is migrating from if any. Backends that cannot be reached are skipped.
+func (r *UserReconciler) killEngines(ctx context.Context, user *backendv1.User, reason string) error {
+	for _, backend := range []string{user.Status.Backend, user.Status.MigratingFrom} {
+		if len(backend) == 0 {
+			continue
+		}
+		if err := r.engines.KillEngine(ctx, backend, user.Spec.ID); err != nil {
+			if isDialError(err) {
+				// the backend is gone and the engine with it
+				continue
+			}
+			return err
+		}
+		r.event(user, EventEngineKilled, "Killed engine on %s, %s", backend, reason)
+	}
+	return nil
+}
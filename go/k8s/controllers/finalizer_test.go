@@ -0,0 +1,105 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+	"almond-cloud/sql"
+)
+
+func TestUserFinalizer(t *testing.T) {
+	var killed []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		killed = append(killed, req.URL.String())
+		if req.URL.Query().Get("userid") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	user := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(1), Namespace: "default",
+			Annotations: map[string]string{kPurgeCacheAnnotation: "true"}},
+		Spec:   backendv1.UserSpec{ID: 1},
+		Status: backendv1.UserStatus{Backend: backend.URL},
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(user).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{},
+		cache: newUserCache(0, 0), warnings: newWarningThrottle(), engines: testEngineClient()}
+	r.cache.set("user", 1, "", &sql.User{ID: 1})
+	r.cache.set("user", 3, "", &sql.User{ID: 3})
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(user)}
+
+	require.NoError(t, r.ensureFinalizer(ctx, user))
+	require.True(t, controllerutil.ContainsFinalizer(user, kUserFinalizer))
+	require.NoError(t, c.Delete(ctx, user))
+	require.NoError(t, c.Get(ctx, req.NamespacedName, user))
+	require.False(t, user.DeletionTimestamp.IsZero())
+
+	status := backendv1.UserStatus{}
+	require.True(t, r.finalizeUser(ctx, req, user, &status, false))
+	require.Equal(t, Stopping, status.State)
+	require.Equal(t, []string{"/kill-engine?userid=1"}, killed)
+	_, cached := r.cache.get("user", 1)
+	require.False(t, cached)
+	require.True(t, apierrors.IsNotFound(c.Get(ctx, req.NamespacedName, user)))
+
+	// a failed cleanup keeps the finalizer and shows in the status
+	stuck := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(2), Namespace: "default", Finalizers: []string{kUserFinalizer}},
+		Spec:       backendv1.UserSpec{ID: 2},
+		Status:     backendv1.UserStatus{Backend: backend.URL},
+	}
+	require.NoError(t, c.Create(ctx, stuck))
+	require.NoError(t, c.Delete(ctx, stuck))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(stuck), stuck))
+	status = backendv1.UserStatus{}
+	require.False(t, r.finalizeUser(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(stuck)}, stuck, &status, false))
+	require.Equal(t, Error, status.State)
+	require.Contains(t, status.LastError, "cleanup failed")
+	finalizeStatus(stuck, &status)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, backendv1.UserCleanupBlocked))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(stuck), stuck))
+	require.True(t, controllerutil.ContainsFinalizer(stuck, kUserFinalizer))
+
+	// a user deleted without purging the cache keeps its entries
+	idle := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(3), Namespace: "default", Finalizers: []string{kUserFinalizer}},
+		Spec:       backendv1.UserSpec{ID: 3},
+	}
+	require.NoError(t, c.Create(ctx, idle))
+	require.NoError(t, c.Delete(ctx, idle))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(idle), idle))
+	require.True(t, r.finalizeUser(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(idle)}, idle, &status, false))
+	_, cached = r.cache.get("user", 3)
+	require.True(t, cached)
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// Backends report an engine idle once it has been inactive for the idle timeout of the
+// engine. The controller then decides whether the engine is shut down: engines that are
+// always on keep running, others are kept warm for a while before they are killed. The
+// User of an engine that was shut down stays Stopped until the frontend wakes it up.
+
+// kWakeAnnotation on a User whose idle engine was shut down makes the controller start
+// the engine again. The controller removes the annotation once it has seen it.
+const kWakeAnnotation = "backend.almond.stanford.edu/wake"
+
+// idlePolicy is the idle policy of a user, from its spec and the controller config
+type idlePolicy struct {
+	// timeout is passed to the backend, 0 for the default of the backend
+	timeout  time.Duration
+	keepWarm time.Duration
+	alwaysOn bool
+}
+
+// idlePolicy returns the idle policy of a user. Users with automations are always on if
+// the config says so and the spec does not decide. Whether a user has automations is
+// cached like the other database entries of the user.
+func (r *UserReconciler) idlePolicy(user *backendv1.User) (idlePolicy, error) {
+	policy := idlePolicy{
+		timeout:  time.Duration(r.almondConfig.EngineIdleTimeoutSeconds) * time.Second,
+		keepWarm: time.Duration(r.almondConfig.EngineKeepWarmSeconds) * time.Second,
+	}
+	spec := user.Spec.Idle
+	if spec == nil {
+		spec = &backendv1.IdlePolicy{}
+	}
+	if spec.TimeoutSeconds != nil {
+		policy.timeout = time.Duration(*spec.TimeoutSeconds) * time.Second
+	}
+	if spec.KeepWarmSeconds != nil {
+		policy.keepWarm = time.Duration(*spec.KeepWarmSeconds) * time.Second
+	}
+	if spec.AlwaysOn != nil {
+		policy.alwaysOn = *spec.AlwaysOn
+	} else if r.almondConfig.EngineAlwaysOnWithAutomations {
+		v, err := r.getDBEntry("automations", user.Spec.ID, cacheVersion(user), hasAutomations, true)
+		if err != nil {
+			return policy, err
+		}
+		policy.alwaysOn = v.(bool)
+	}
+	return policy, nil
+}
+
+// keepIdleEngine applies the idle policy to an engine reported idle. It returns true if
+// the engine keeps running, with the delay until the user is reconciled again. The
+// keep-warm window starts when the engine is first reported idle.
+func keepIdleEngine(user *backendv1.User, status *backendv1.UserStatus, policy idlePolicy) (bool, time.Duration) {
+	if policy.alwaysOn {
+		return true, wait.Jitter(kEngineStatusResync, 0.2)
+	}
+	idleSince := user.Status.IdleSince
+	if idleSince == nil {
+		now := metav1.Now()
+		idleSince = &now
+	}
+	remaining := policy.keepWarm - time.Since(idleSince.Time)
+	if remaining <= 0 {
+		return false, 0
+	}
+	status.IdleSince = idleSince
+	return true, remaining
+}
+
+// shutdownIdleEngine kills an idle engine, or deletes the deployment and service of a user
+// with its own deployment, and leaves the user Stopped until it is woken up.
+func (r *UserReconciler) shutdownIdleEngine(ctx context.Context, req ctrl.Request, user *backendv1.User,
+	status *backendv1.UserStatus, deployment bool) error {
+	var err error
+	if deployment {
+		err = r.deleteDeploymentService(ctx, req, user.Spec.ID)
+	} else if err = r.engines.KillEngine(ctx, status.Backend, user.Spec.ID); isDialError(err) {
+		// the backend is gone and the engine with it
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("idle shutdown failed: %w", err)
+	}
+	r.event(user, EventIdleShutdown, "Engine is idle, shut it down")
+	now := metav1.Now()
+	status.Backend = ""
+	status.State = Stopped
+	status.IdleShutdownTime = &now
+	return nil
+}
+
+// handleIdleShutdown keeps a user whose idle engine was shut down Stopped. It returns true
+// while the user is not woken up, in which case the reconcile stops there. Once woken up,
+// the engine is placed and started like the engine of a new user.
+func (r *UserReconciler) handleIdleShutdown(ctx context.Context, user *backendv1.User, status *backendv1.UserStatus) (bool, error) {
+	if user.Status.IdleShutdownTime == nil {
+		return false, nil
+	}
+	status.State = Stopped
+	status.IdleShutdownTime = user.Status.IdleShutdownTime
+	if _, ok := user.Annotations[kWakeAnnotation]; !ok {
+		return true, nil
+	}
+	delete(user.Annotations, kWakeAnnotation)
+	if err := r.Update(ctx, user); err != nil {
+		return true, err
+	}
+	r.event(user, EventWokenUp, "Starting the engine of the idle user again")
+	status.State = ""
+	status.IdleShutdownTime = nil
+	return false, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// automationUsers is a UserLookup where some users have automations
+type automationUsers struct {
+	fakeUsers
+	apps map[int64]bool
+}
+
+func (u automationUsers) HasAutomations(userID int64) (bool, error) {
+	return u.apps[userID], nil
+}
+
+func int32Ptr(v int32) *int32 { return &v }
+
+func boolPtr(v bool) *bool { return &v }
+
+func TestIdlePolicy(t *testing.T) {
+	users := automationUsers{fakeUsers: fakeUsers{1: {ID: 1}, 2: {ID: 2}}, apps: map[int64]bool{2: true}}
+	almondConfig := &config.AlmondConfig{EngineIdleTimeoutSeconds: 300, EngineKeepWarmSeconds: 60}
+	rt := newReconcileTest(t, almondConfig, users)
+
+	policy, err := rt.r.idlePolicy(testUser(2, "", ""))
+	require.NoError(t, err)
+	require.Equal(t, idlePolicy{timeout: 5 * time.Minute, keepWarm: time.Minute}, policy, "automations ignored by default")
+
+	almondConfig.EngineAlwaysOnWithAutomations = true
+	policy, err = rt.r.idlePolicy(testUser(1, "", ""))
+	require.NoError(t, err)
+	require.False(t, policy.alwaysOn)
+	policy, err = rt.r.idlePolicy(testUser(2, "", ""))
+	require.NoError(t, err)
+	require.True(t, policy.alwaysOn)
+
+	// the spec overrides the config
+	user := testUser(2, "", "")
+	user.Spec.Idle = &backendv1.IdlePolicy{TimeoutSeconds: int32Ptr(0), KeepWarmSeconds: int32Ptr(3600), AlwaysOn: boolPtr(false)}
+	policy, err = rt.r.idlePolicy(user)
+	require.NoError(t, err)
+	require.Equal(t, idlePolicy{keepWarm: time.Hour}, policy)
+}
+
+func TestReconcileIdleKeepWarm(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	user := testUser(1, "", "")
+	user.Spec.Idle = &backendv1.IdlePolicy{TimeoutSeconds: int32Ptr(120), KeepWarmSeconds: int32Ptr(600)}
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends("10.0.0.1"), user)
+	rt.reconcile(1)
+	require.Equal(t, int64(120000), rt.backend.options[1].IdleTimeoutMillis)
+	require.False(t, rt.backend.options[1].AlwaysOn)
+
+	// an idle engine is kept warm from the first time it is reported idle
+	rt.backend.setState(backend, 1, Idle)
+	result := rt.reconcile(1)
+	require.InDelta(t, float64(10*time.Minute), float64(result.RequeueAfter), float64(time.Second))
+	user = rt.user(1)
+	require.True(t, user.DeletionTimestamp.IsZero())
+	require.Equal(t, Idle, user.Status.State)
+	require.NotNil(t, user.Status.IdleSince)
+	idleSince := user.Status.IdleSince
+
+	rt.reconcile(1)
+	require.Equal(t, idleSince.Unix(), rt.user(1).Status.IdleSince.Unix())
+
+	// once the window is over the engine is killed and the User kept Stopped
+	user = rt.user(1)
+	past := metav1.NewTime(time.Now().Add(-11 * time.Minute))
+	user.Status.IdleSince = &past
+	require.NoError(t, rt.c.Status().Update(rt.ctx, user))
+	rt.reconcile(1)
+	require.Equal(t, Stopped, rt.backend.state(backend, 1))
+	user = rt.user(1)
+	require.True(t, user.DeletionTimestamp.IsZero())
+	require.Equal(t, Stopped, user.Status.State)
+	require.Empty(t, user.Status.Backend)
+	require.Nil(t, user.Status.IdleSince)
+	require.NotNil(t, user.Status.IdleShutdownTime)
+}
+
+func TestReconcileIdleWake(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends("10.0.0.1"), testUser(1, "", ""))
+	rt.reconcile(1)
+	rt.backend.setState(backend, 1, Idle)
+	rt.reconcile(1)
+	require.Equal(t, Stopped, rt.backend.state(backend, 1))
+
+	// the stopped user is left alone until it is woken up
+	result := rt.reconcile(1)
+	require.Zero(t, result.RequeueAfter)
+	require.Len(t, rt.backend.callsTo("run-engine"), 1)
+	require.Equal(t, Stopped, rt.user(1).Status.State)
+	require.NotNil(t, rt.user(1).Status.IdleShutdownTime)
+
+	user := rt.user(1)
+	user.Annotations = map[string]string{kWakeAnnotation: ""}
+	require.NoError(t, rt.c.Update(rt.ctx, user))
+	rt.reconcile(1)
+	require.Len(t, rt.backend.callsTo("run-engine"), 2)
+	user = rt.user(1)
+	require.Equal(t, Starting, user.Status.State)
+	require.Equal(t, backend, user.Status.Backend)
+	require.Nil(t, user.Status.IdleShutdownTime)
+	require.NotContains(t, user.Annotations, kWakeAnnotation)
+}
+
+func TestReconcileIdleDeployment(t *testing.T) {
+	org := 1
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true},
+		fakeUsers{3: {ID: 3, DeveloperOrg: &org}}, testUser(3, "", ""))
+	key := types.NamespacedName{Namespace: "default", Name: userName(3)}
+	rt.reconcile(3)
+	deployment := &appsv1.Deployment{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, deployment))
+	deployment.Status.AvailableReplicas = 1
+	require.NoError(t, rt.c.Status().Update(rt.ctx, deployment))
+	rt.reconcile(3)
+	service := &corev1.Service{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, service))
+	service.Spec.ClusterIP = "10.1.0.3"
+	service.Spec.Ports = []corev1.ServicePort{{Port: 8100}}
+	require.NoError(t, rt.c.Update(rt.ctx, service))
+	rt.reconcile(3)
+	rt.backend.setState("http://10.1.0.3:8100", 3, Idle)
+
+	// the deployment and service of an idle engine are deleted, the User is kept
+	rt.reconcile(3)
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})))
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &corev1.Service{})))
+	user := rt.user(3)
+	require.Equal(t, Stopped, user.Status.State)
+	require.NotNil(t, user.Status.IdleShutdownTime)
+
+	// they are not created again until the user is woken up
+	rt.reconcile(3)
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})))
+}
+
+func TestReconcileIdleAlwaysOn(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	users := automationUsers{fakeUsers: fakeUsers{1: {ID: 1}}, apps: map[int64]bool{1: true}}
+	rt := newReconcileTest(t, &config.AlmondConfig{EngineAlwaysOnWithAutomations: true}, users,
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+	rt.reconcile(1)
+	require.True(t, rt.backend.options[1].AlwaysOn)
+
+	rt.backend.setState(backend, 1, Idle)
+	result := rt.reconcile(1)
+	require.Greater(t, int64(result.RequeueAfter), int64(0))
+	user := rt.user(1)
+	require.True(t, user.DeletionTimestamp.IsZero())
+	require.Equal(t, Idle, user.Status.State)
+	require.Nil(t, user.Status.IdleSince)
+	require.Equal(t, Idle, rt.backend.state(backend, 1))
+}
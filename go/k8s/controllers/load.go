@@ -0,0 +1,160 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BackendLoad is the load report returned by the /load route of a shared backend
+type BackendLoad struct {
+	// Engines is the number of engines hosted by the backend, running or starting
+	Engines int `json:"engines"`
+	// Running is the number of engines that finished starting
+	Running int `json:"running"`
+	// Capacity is the maximum number of engines of the backend, 0 if unlimited
+	Capacity int `json:"capacity"`
+}
+
+const kLoadReportTTL = 5 * time.Second
+
+type loadReport struct {
+	load    BackendLoad
+	fetched time.Time
+}
+
+// loadTracker caches load reports of shared backends. Placements made since a report
+// was fetched are added to it, so a burst of new users does not pile onto the backend
+// that was the least loaded when the report was fetched.
+type loadTracker struct {
+	mu      sync.Mutex
+	reports map[string]*loadReport
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{reports: make(map[string]*loadReport)}
+}
+
+func (t *loadTracker) get(url string) (BackendLoad, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report, ok := t.reports[url]
+	if !ok || time.Since(report.fetched) > kLoadReportTTL {
+		return BackendLoad{}, false
+	}
+	return report.load, true
+}
+
+func (t *loadTracker) set(url string, load BackendLoad) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reports[url] = &loadReport{load: load, fetched: time.Now()}
+}
+
+func (t *loadTracker) assign(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if report, ok := t.reports[url]; ok {
+		report.load.Engines++
+	}
+}
+
+// hasCapacity reports whether load is below the capacity of the backend. maxEngines from
+// the config applies when it is lower than the capacity reported by the backend.
+func (load BackendLoad) hasCapacity(maxEngines int) bool {
+	capacity := load.Capacity
+	if maxEngines > 0 && (capacity == 0 || maxEngines < capacity) {
+		capacity = maxEngines
+	}
+	return capacity == 0 || load.Engines < capacity
+}
+
+// leastLoadedBackend returns the backend with the fewest engines that still has capacity.
+// Ties are broken by rendezvous hashing so that users spread evenly between idle backends.
+// Backends without a load report are skipped. It returns false if no backend has capacity.
+func leastLoadedBackend(uid int64, backends []backendEndpoint, loads map[string]BackendLoad, maxEngines int) (backendEndpoint, bool) {
+	var candidates []backendEndpoint
+	minEngines := -1
+	for _, b := range backends {
+		load, ok := loads[b.URL]
+		if !ok || !load.hasCapacity(maxEngines) {
+			continue
+		}
+		if minEngines < 0 || load.Engines < minEngines {
+			minEngines = load.Engines
+			candidates = candidates[:0]
+		}
+		if load.Engines == minEngines {
+			candidates = append(candidates, b)
+		}
+	}
+	return rendezvousBackend(uid, candidates)
+}
+
+// pickSharedBackend returns the backend of a user. A user keeps its current backend as
+// long as the backend is ready, unless the backend is draining and the drain rate allows
+// one more user to leave. New users go to the least loaded backend with capacity that
+// is not draining.
+func (r *UserReconciler) pickSharedBackend(ctx context.Context, uid int64, current string, backends []backendEndpoint) (string, error) {
+	if len(backends) == 0 {
+		return "", fmt.Errorf("backend endpoints not found")
+	}
+	var accepting []backendEndpoint
+	for _, b := range backends {
+		if !b.Draining {
+			accepting = append(accepting, b)
+		}
+	}
+	for _, b := range backends {
+		if b.URL != current {
+			continue
+		}
+		if !b.Draining || len(accepting) == 0 || !r.drains.allowMove(b.URL, r.drainInterval(), uid) {
+			return current, nil
+		}
+		r.Log.Info("moving user off draining backend:", "user", uid, "backend", b.Name)
+	}
+	if len(accepting) == 0 {
+		return "", fmt.Errorf("all shared backends are draining")
+	}
+	backends = accepting
+	loads := make(map[string]BackendLoad)
+	for _, b := range backends {
+		load, ok := r.loads.get(b.URL)
+		if !ok {
+			var err error
+			if load, err = r.engines.BackendLoad(ctx, b.URL); err != nil {
+				r.Log.Error(err, "failed to get backend load", "backend", b.URL)
+				continue
+			}
+			r.loads.set(b.URL, load)
+		}
+		loads[b.URL] = load
+	}
+	if len(loads) == 0 {
+		// no backend reports its load, fall back to hashing
+		b, _ := rendezvousBackend(uid, backends)
+		return b.URL, nil
+	}
+	b, ok := leastLoadedBackend(uid, backends, loads, r.almondConfig.SharedBackendMaxEngines)
+	if !ok {
+		return "", fmt.Errorf("all shared backends are at capacity")
+	}
+	r.loads.assign(b.URL)
+	return b.URL, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"almond-cloud/config"
+)
+
+func TestBackendLoadHasCapacity(t *testing.T) {
+	require.True(t, BackendLoad{Engines: 100}.hasCapacity(0))
+	require.True(t, BackendLoad{Engines: 9, Capacity: 10}.hasCapacity(0))
+	require.False(t, BackendLoad{Engines: 10, Capacity: 10}.hasCapacity(0))
+	require.False(t, BackendLoad{Engines: 5, Capacity: 10}.hasCapacity(5))
+	require.True(t, BackendLoad{Engines: 5, Capacity: 10}.hasCapacity(20))
+	require.False(t, BackendLoad{Engines: 5}.hasCapacity(5))
+}
+
+func TestLeastLoadedBackend(t *testing.T) {
+	backends := testBackends(3)
+	loads := map[string]BackendLoad{
+		backends[0].URL: {Engines: 10},
+		backends[1].URL: {Engines: 3},
+		backends[2].URL: {Engines: 3, Capacity: 3},
+	}
+	b, ok := leastLoadedBackend(1, backends, loads, 0)
+	require.True(t, ok)
+	require.Equal(t, backends[1], b)
+
+	// backends without a report are skipped
+	delete(loads, backends[1].URL)
+	b, ok = leastLoadedBackend(1, backends, loads, 0)
+	require.True(t, ok)
+	require.Equal(t, backends[0], b)
+
+	_, ok = leastLoadedBackend(1, backends, loads, 10)
+	require.False(t, ok)
+}
+
+func newLoadServer(t *testing.T, load BackendLoad) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/load", req.URL.Path)
+		json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: load})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPickSharedBackend(t *testing.T) {
+	busy := newLoadServer(t, BackendLoad{Engines: 5})
+	idle := newLoadServer(t, BackendLoad{Engines: 3})
+	backends := []backendEndpoint{{Name: "busy", URL: busy.URL}, {Name: "idle", URL: idle.URL}}
+	r := &UserReconciler{Log: logr.Discard(), almondConfig: &config.AlmondConfig{}, loads: newLoadTracker(), engines: testEngineClient()}
+	ctx := context.Background()
+
+	// the current backend is kept while it is ready
+	url, err := r.pickSharedBackend(ctx, 1, busy.URL, backends)
+	require.NoError(t, err)
+	require.Equal(t, busy.URL, url)
+
+	// new users go to the least loaded backend, counting placements since the last report
+	placed := map[string]int{}
+	for uid := int64(1); uid <= 4; uid++ {
+		url, err = r.pickSharedBackend(ctx, uid, "", backends)
+		require.NoError(t, err)
+		placed[url]++
+	}
+	require.Equal(t, map[string]int{idle.URL: 3, busy.URL: 1}, placed)
+
+	r.almondConfig.SharedBackendMaxEngines = 6
+	r.loads = newLoadTracker()
+	_, err = r.pickSharedBackend(ctx, 1, "http://gone:8100", backends)
+	require.NoError(t, err)
+	r.almondConfig.SharedBackendMaxEngines = 3
+	r.loads = newLoadTracker()
+	_, err = r.pickSharedBackend(ctx, 1, "", backends)
+	require.Error(t, err)
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+const kDefaultMigrationTimeout = 30 * time.Second
+
+// An engine moves between backends in two steps. The old backend is asked to drain
+// the engine: it closes the client connections and stops the engine, which persists
+// its state through dbproxy. Once the old backend reports the drain finished, or the
+// migration times out, the engine is started on the new backend.
+
+func (r *UserReconciler) migrationTimeout() time.Duration {
+	if r.almondConfig.EngineMigrationTimeoutSeconds > 0 {
+		return time.Duration(r.almondConfig.EngineMigrationTimeoutSeconds) * time.Second
+	}
+	return kDefaultMigrationTimeout
+}
+
+// startMigration asks the old backend to drain the engine of the user. If the old
+// backend cannot be reached, or the drain finished right away, there is nothing to wait
+// for. It returns true if the engine was drained right away and moves to the new backend.
+func (r *UserReconciler) startMigration(ctx context.Context, userID int64, from string, status *backendv1.UserStatus) bool {
+	result, err := r.engines.DrainEngine(ctx, from, userID)
+	if err != nil {
+		r.Log.Error(err, "drain old engine failed, killing it", "user", userID, "backend", from)
+		if err := r.engines.KillEngine(ctx, from, userID); err != nil {
+			r.Log.Error(err, "kill old engine failed")
+		}
+		return false
+	}
+	if result != DrainDraining {
+		r.logDrainResult(userID, from, result)
+		return result != DrainNotRunning
+	}
+	now := metav1.Now()
+	status.MigratingFrom = from
+	status.MigrationStarted = &now
+	return false
+}
+
+// continueMigration checks the drain on the old backend. It returns true once the engine
+// saved its state and stopped there, or the migration timed out, and the engine can start
+// on the new backend.
+func (r *UserReconciler) continueMigration(ctx context.Context, userID int64, status *backendv1.UserStatus) bool {
+	result, err := r.engines.DrainEngine(ctx, status.MigratingFrom, userID)
+	if err == nil {
+		r.logDrainResult(userID, status.MigratingFrom, result)
+	}
+	if err == nil && result == DrainDraining {
+		if status.MigrationStarted != nil && time.Since(status.MigrationStarted.Time) < r.migrationTimeout() {
+			status.State = Draining
+			return false
+		}
+		r.Log.Info("engine migration timed out, killing old engine:", "user", userID, "backend", status.MigratingFrom)
+		if err := r.engines.KillEngine(ctx, status.MigratingFrom, userID); err != nil {
+			r.Log.Error(err, "kill old engine failed")
+		}
+	}
+	status.MigratingFrom = ""
+	status.MigrationStarted = nil
+	return true
+}
+
+func (r *UserReconciler) logDrainResult(userID int64, backend string, result DrainResult) {
+	if result == DrainFailed {
+		r.Log.Info("engine failed while draining, its last changes may be lost:", "user", userID, "backend", backend)
+	}
+}
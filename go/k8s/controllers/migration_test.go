@@ -0,0 +1,140 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// newDrainServer returns a backend that reports result for the drain of an engine until it is killed
+func newDrainServer(t *testing.T, result DrainResult) (*httptest.Server, *[]string) {
+	var calls []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.URL.Path)
+		switch req.URL.Path {
+		case "/kill-engine":
+			result = DrainNotRunning
+			json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: true})
+		case "/drain-engine":
+			json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: string(result)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s, &calls
+}
+
+func TestEngineMigration(t *testing.T) {
+	r := &UserReconciler{Log: logr.Discard(), almondConfig: &config.AlmondConfig{EngineMigrationTimeoutSeconds: 60},
+		engines: testEngineClient()}
+	ctx := context.Background()
+
+	old, calls := newDrainServer(t, DrainDraining)
+	status := &backendv1.UserStatus{Backend: "http://new"}
+	require.False(t, r.startMigration(ctx, 1, old.URL, status))
+	require.Equal(t, old.URL, status.MigratingFrom)
+	require.NotNil(t, status.MigrationStarted)
+
+	// the old engine is still draining
+	require.False(t, r.continueMigration(ctx, 1, status))
+	require.Equal(t, Draining, status.State)
+
+	// the drain timed out, the old engine is killed
+	started := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	status.MigrationStarted = &started
+	require.True(t, r.continueMigration(ctx, 1, status))
+	require.Empty(t, status.MigratingFrom)
+	require.Nil(t, status.MigrationStarted)
+	require.Equal(t, []string{"/drain-engine", "/drain-engine", "/drain-engine", "/kill-engine"}, *calls)
+
+	// the engine saved its state while draining
+	done, calls := newDrainServer(t, DrainDraining)
+	status = &backendv1.UserStatus{Backend: "http://new"}
+	r.startMigration(ctx, 1, done.URL, status)
+	require.Equal(t, done.URL, status.MigratingFrom)
+	*calls = nil
+	for _, result := range []DrainResult{DrainDrained, DrainFailed} {
+		done.Config.Handler = drainResultHandler(calls, result)
+		s := *status
+		require.True(t, r.continueMigration(ctx, 1, &s))
+		require.Empty(t, s.MigratingFrom)
+	}
+	require.Equal(t, []string{"/drain-engine", "/drain-engine"}, *calls)
+
+	// there is nothing to wait for if the engine drained right away or is already gone
+	for result, migrated := range map[DrainResult]bool{DrainDrained: true, DrainNotRunning: false} {
+		gone, calls := newDrainServer(t, result)
+		status = &backendv1.UserStatus{Backend: "http://new"}
+		require.Equal(t, migrated, r.startMigration(ctx, 1, gone.URL, status))
+		require.Empty(t, status.MigratingFrom)
+		require.Equal(t, []string{"/drain-engine"}, *calls)
+	}
+}
+
+func drainResultHandler(calls *[]string, result interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*calls = append(*calls, req.URL.Path)
+		json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: result})
+	})
+}
+
+func TestDrainEngineResult(t *testing.T) {
+	c := testEngineClient()
+	ctx := context.Background()
+	var calls []string
+	s := httptest.NewServer(nil)
+	t.Cleanup(s.Close)
+	for reported, want := range map[interface{}]DrainResult{
+		"drained": DrainDrained,
+		"failed":  DrainFailed,
+		// backends before drain results report whether an engine was found
+		true:  DrainDraining,
+		false: DrainNotRunning,
+	} {
+		s.Config.Handler = drainResultHandler(&calls, reported)
+		result, err := c.DrainEngine(ctx, s.URL, 1)
+		require.NoError(t, err)
+		require.Equal(t, want, result)
+	}
+	s.Config.Handler = drainResultHandler(&calls, "lost")
+	_, err := c.DrainEngine(ctx, s.URL, 1)
+	require.Error(t, err)
+}
+
+func TestEngineMigrationBackendGone(t *testing.T) {
+	r := &UserReconciler{Log: logr.Discard(), almondConfig: &config.AlmondConfig{}, engines: testEngineClient()}
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	// there is nothing to drain if the old backend is unreachable
+	status := &backendv1.UserStatus{Backend: "http://new"}
+	r.startMigration(context.Background(), 1, gone.URL, status)
+	require.Empty(t, status.MigratingFrom)
+	require.Nil(t, status.MigrationStarted)
+	require.Equal(t, kDefaultMigrationTimeout, r.migrationTimeout())
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// userMode returns the mode the engine of a user runs in. A mode in the spec wins, except
+// for developer mode while the developer backend is disabled. Otherwise developers run in
+// developer mode when the developer backend is enabled, and other users in shared mode.
+func (r *UserReconciler) userMode(user *backendv1.User, developer bool) string {
+	if user != nil {
+		switch user.Spec.Mode {
+		case backendv1.UserModeShared, backendv1.UserModeDedicated:
+			return user.Spec.Mode
+		case backendv1.UserModeDeveloper:
+			if r.almondConfig.EnableDeveloperBackend {
+				return user.Spec.Mode
+			}
+			return backendv1.UserModeShared
+		}
+	}
+	if r.almondConfig.EnableDeveloperBackend && developer {
+		return backendv1.UserModeDeveloper
+	}
+	return backendv1.UserModeShared
+}
+
+// removeOldDeployment deletes the deployment and service of a user that moved to shared
+// mode. It waits until the engine was migrated off them to a shared backend.
+func (r *UserReconciler) removeOldDeployment(ctx context.Context, req ctrl.Request, user *backendv1.User) error {
+	if user.Status.Mode != backendv1.UserModeShared || len(user.Status.MigratingFrom) > 0 {
+		return nil
+	}
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, req.NamespacedName, deployment); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(deployment, user) {
+		return nil
+	}
+	r.Log.Info("deleting deployment of user now in shared mode:", "user", user.Spec.ID)
+	return r.deleteDeploymentService(ctx, req, user.Spec.ID)
+}
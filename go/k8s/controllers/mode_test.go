@@ -0,0 +1,108 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+	"almond-cloud/sql"
+)
+
+func TestUserMode(t *testing.T) {
+	org := 1
+	users := fakeUsers{1: {ID: 1}, 2: {ID: 2, DeveloperOrg: &org}}
+	withMode := func(id int64, mode string) *backendv1.User {
+		user := testUser(id, "", "")
+		user.Name = userName(id) + "-" + mode
+		user.Spec.Mode = mode
+		return user
+	}
+	almondConfig := &config.AlmondConfig{}
+	rt := newReconcileTest(t, almondConfig, users)
+	mode := func(id int64, mode string, developer bool) string {
+		return rt.r.userMode(withMode(id, mode), developer)
+	}
+
+	require.Equal(t, "shared", mode(1, "", false))
+	require.Equal(t, "dedicated", mode(1, "dedicated", false))
+	require.Equal(t, "shared", mode(1, "developer", false), "developer backend disabled")
+	require.Equal(t, "shared", mode(2, "", true))
+	require.Equal(t, "shared", rt.r.userMode(nil, true), "deleted user")
+
+	almondConfig.EnableDeveloperBackend = true
+	require.Equal(t, "developer", mode(1, "developer", false))
+	require.Equal(t, "developer", mode(2, "", true))
+	require.Equal(t, "shared", mode(2, "shared", true))
+	require.Equal(t, "developer", rt.r.userMode(nil, true), "deleted developer")
+}
+
+func TestReconcileDedicatedUser(t *testing.T) {
+	const (
+		dedicated = "http://10.1.0.3:8100"
+		shared    = "http://10.0.0.1:8100"
+	)
+	user := testUser(3, "", "")
+	user.Spec.Mode = backendv1.UserModeDedicated
+	user.Spec.Resources = &corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1G")},
+	}
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{3: &sql.User{ID: 3}}, sharedBackends("10.0.0.1"), user)
+	templates := &userTemplates{}
+	templates.dedicatedDeployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "main"}}
+	rt.r.setTemplates(templates)
+	key := types.NamespacedName{Namespace: "default", Name: userName(3)}
+
+	// any user can run on its own deployment, with the resources of its spec
+	rt.reconcile(3)
+	require.Equal(t, backendv1.UserModeDedicated, rt.user(3).Status.Mode)
+	deployment := &appsv1.Deployment{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, deployment))
+	require.Equal(t, "1G", deployment.Spec.Template.Spec.Containers[0].Resources.Requests.Memory().String())
+	deployment.Status.AvailableReplicas = 1
+	require.NoError(t, rt.c.Status().Update(rt.ctx, deployment))
+	rt.reconcile(3)
+	service := &corev1.Service{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, service))
+	service.Spec.ClusterIP = "10.1.0.3"
+	service.Spec.Ports = []corev1.ServicePort{{Port: 8100}}
+	require.NoError(t, rt.c.Update(rt.ctx, service))
+	rt.reconcile(3)
+	require.Equal(t, dedicated, rt.user(3).Status.Backend)
+	require.Equal(t, []string{dedicated + " 3"}, rt.backend.callsTo("run-engine"))
+
+	// moving to shared mode migrates the engine, then removes the deployment
+	user = rt.user(3)
+	user.Spec.Mode = backendv1.UserModeShared
+	require.NoError(t, rt.c.Update(rt.ctx, user))
+	rt.reconcile(3)
+	user = rt.user(3)
+	require.Equal(t, backendv1.UserModeShared, user.Status.Mode)
+	require.Equal(t, shared, user.Status.Backend)
+	require.Equal(t, []string{dedicated + " 3"}, rt.backend.callsTo("drain-engine"))
+	require.NoError(t, rt.c.Get(rt.ctx, key, &appsv1.Deployment{}))
+
+	rt.reconcile(3)
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})))
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &corev1.Service{})))
+}
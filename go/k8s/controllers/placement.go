@@ -0,0 +1,100 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// backendEndpoint is one ready address of the shared-backend Endpoints
+type backendEndpoint struct {
+	// Name identifies the backend across restarts: the pod name for StatefulSet pods,
+	// the IP otherwise.
+	Name string
+	URL  string
+	// Pod is the name of the backend pod, empty if the address does not refer to a pod
+	Pod string
+	// Draining is set when the pod has the drain annotation
+	Draining bool
+}
+
+// sharedBackendEndpoints lists the ready backends of the shared-backend Endpoints.
+func sharedBackendEndpoints(endpoints *corev1.Endpoints) []backendEndpoint {
+	var backends []backendEndpoint
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Ports) == 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			name := addr.IP
+			if addr.TargetRef != nil && len(addr.TargetRef.Name) > 0 {
+				name = addr.TargetRef.Name
+			} else if len(addr.Hostname) > 0 {
+				name = addr.Hostname
+			}
+			b := backendEndpoint{
+				Name: name,
+				URL:  fmt.Sprintf("http://%s:%d", addr.IP, subset.Ports[0].Port),
+			}
+			if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+				b.Pod = addr.TargetRef.Name
+			}
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+// rendezvousBackend picks the backend of a user with rendezvous (highest random weight)
+// hashing. Adding or removing one of N backends only moves the users of that backend,
+// about 1/N of all users, instead of almost every user as with uid % N.
+func rendezvousBackend(uid int64, backends []backendEndpoint) (backendEndpoint, bool) {
+	var (
+		best      backendEndpoint
+		bestScore uint64
+		found     bool
+	)
+	for _, b := range backends {
+		score := rendezvousScore(uid, b.Name)
+		if !found || score > bestScore || (score == bestScore && b.Name < best.Name) {
+			best, bestScore, found = b, score, true
+		}
+	}
+	return best, found
+}
+
+func rendezvousScore(uid int64, name string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(uid))
+	h.Write(buf[:])
+	h.Write([]byte(name))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone is poorly distributed for short keys
+// that differ only in the last bytes, such as pod ordinals.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func testBackends(n int) []backendEndpoint {
+	var backends []backendEndpoint
+	for i := 0; i < n; i++ {
+		backends = append(backends, backendEndpoint{
+			Name: fmt.Sprintf("shared-backend-%d", i),
+			URL:  fmt.Sprintf("http://10.0.0.%d:8100", i),
+		})
+	}
+	return backends
+}
+
+// movedUsers returns the fraction of users whose backend differs between two backend sets.
+func movedUsers(users int, before, after []backendEndpoint) float64 {
+	moved := 0
+	for uid := int64(1); uid <= int64(users); uid++ {
+		b1, _ := rendezvousBackend(uid, before)
+		b2, _ := rendezvousBackend(uid, after)
+		if b1.Name != b2.Name {
+			moved++
+		}
+	}
+	return float64(moved) / float64(users)
+}
+
+func TestRendezvousBackendMovement(t *testing.T) {
+	const users = 20000
+	four := testBackends(4)
+	five := testBackends(5)
+
+	// scale up from 4 to 5: only the users of the new backend move, ideally 1/5
+	up := movedUsers(users, four, five)
+	t.Logf("4 -> 5 backends moved %.1f%% of users", up*100)
+	require.InDelta(t, 1.0/5, up, 0.02)
+
+	// scale down from 5 to 4: only the users of the removed backend move
+	down := movedUsers(users, five, four)
+	require.InDelta(t, 1.0/5, down, 0.02)
+
+	// losing a backend in the middle of the set moves only its users
+	var withoutTwo []backendEndpoint
+	withoutTwo = append(withoutTwo, five[:2]...)
+	withoutTwo = append(withoutTwo, five[3:]...)
+	require.InDelta(t, 1.0/5, movedUsers(users, five, withoutTwo), 0.02)
+
+	// for comparison, uid % N moves almost every user
+	moved := 0
+	for uid := int64(1); uid <= users; uid++ {
+		if uid%4 != uid%5 {
+			moved++
+		}
+	}
+	t.Logf("4 -> 5 backends with uid %% N moved %.1f%% of users", float64(moved)*100/users)
+	require.Greater(t, float64(moved)/users, 0.75)
+}
+
+func TestRendezvousBackendBalance(t *testing.T) {
+	const users = 20000
+	backends := testBackends(5)
+	counts := make(map[string]int)
+	for uid := int64(1); uid <= users; uid++ {
+		b, ok := rendezvousBackend(uid, backends)
+		require.True(t, ok)
+		counts[b.Name]++
+	}
+	for _, b := range backends {
+		require.InDelta(t, users/len(backends), counts[b.Name], users*0.02)
+	}
+
+	// the order of the endpoints does not matter
+	reversed := []backendEndpoint{backends[4], backends[3], backends[2], backends[1], backends[0]}
+	require.Zero(t, movedUsers(1000, backends, reversed))
+
+	_, ok := rendezvousBackend(1, nil)
+	require.False(t, ok)
+}
+
+func TestSharedBackendEndpoints(t *testing.T) {
+	endpoints := &corev1.Endpoints{
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.0.0.1", TargetRef: &corev1.ObjectReference{Name: "shared-backend-0"}},
+				{IP: "10.0.0.2", Hostname: "shared-backend-1"},
+				{IP: "10.0.0.3"},
+			},
+			Ports: []corev1.EndpointPort{{Port: 8100}},
+		}},
+	}
+	require.Equal(t, []backendEndpoint{
+		{Name: "shared-backend-0", URL: "http://10.0.0.1:8100"},
+		{Name: "shared-backend-1", URL: "http://10.0.0.2:8100"},
+		{Name: "10.0.0.3", URL: "http://10.0.0.3:8100"},
+	}, sharedBackendEndpoints(endpoints))
+}
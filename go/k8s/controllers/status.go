@@ -0,0 +1,116 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// engineState validates a state reported by the /engine-status route of a backend
+func engineState(state string) (UserState, error) {
+	switch s := UserState(state); s {
+	case Starting, Running, Idle, Stopping, Stopped, Draining:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown engine state %q", state)
+}
+
+// setError moves the user to the Error state and records err as the last error
+func setError(status *backendv1.UserStatus, err error) {
+	now := metav1.Now()
+	status.State = Error
+	status.LastError = err.Error()
+	status.LastErrorTime = &now
+}
+
+// finalizeStatus completes the status computed by a reconcile before it is written.
+// Counters, the last error and the conditions carry over from the previous status. The
+// last error is cleared once the engine runs again.
+func finalizeStatus(user *backendv1.User, status *backendv1.UserStatus) {
+	prev := &user.Status
+	if len(status.State) == 0 {
+		status.State = Pending
+	}
+	status.ObservedGeneration = user.Generation
+	status.RestartCount = prev.RestartCount
+	if (prev.State == Running || prev.State == Idle) && status.State == Starting {
+		// the backend lost a running engine
+		status.RestartCount++
+	}
+	running := status.State == Running || status.State == Idle
+	if running {
+		status.LastError = ""
+		status.LastErrorTime = nil
+	} else if len(status.LastError) == 0 {
+		status.LastError = prev.LastError
+		status.LastErrorTime = prev.LastErrorTime
+	}
+	status.Conditions = prev.Conditions
+
+	assigned := len(status.Backend) > 0
+	degraded := status.State == Error || status.State == Failed
+	if assigned {
+		setCondition(user, status, backendv1.UserBackendAssigned, true, "Assigned", status.Backend)
+	} else {
+		setCondition(user, status, backendv1.UserBackendAssigned, false, "NoBackend", "waiting for a backend")
+	}
+	if running {
+		setCondition(user, status, backendv1.UserEngineRunning, true, "EngineRunning", "")
+	} else {
+		setCondition(user, status, backendv1.UserEngineRunning, false, stateReason(status.State), "")
+	}
+	if degraded {
+		setCondition(user, status, backendv1.UserDegraded, true, "ReconcileError", status.LastError)
+	} else {
+		setCondition(user, status, backendv1.UserDegraded, false, "AsExpected", "")
+	}
+	if !user.ObjectMeta.DeletionTimestamp.IsZero() && degraded {
+		setCondition(user, status, backendv1.UserCleanupBlocked, true, "CleanupFailed", status.LastError)
+	} else {
+		meta.RemoveStatusCondition(&status.Conditions, backendv1.UserCleanupBlocked)
+	}
+	if assigned && running && !degraded {
+		setCondition(user, status, backendv1.UserReady, true, "Ready", "")
+	} else {
+		setCondition(user, status, backendv1.UserReady, false, stateReason(status.State), "")
+	}
+}
+
+func setCondition(user *backendv1.User, status *backendv1.UserStatus, condType string, value bool, reason, message string) {
+	condStatus := metav1.ConditionFalse
+	if value {
+		condStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               condType,
+		Status:             condStatus,
+		ObservedGeneration: user.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// stateReason turns a state into a CamelCase condition reason, "running" -> "Running"
+func stateReason(state UserState) string {
+	if len(state) == 0 {
+		return "Pending"
+	}
+	return string(state[0]-'a'+'A') + string(state[1:])
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func TestEngineState(t *testing.T) {
+	state, err := engineState("running")
+	require.NoError(t, err)
+	require.Equal(t, Running, state)
+	_, err = engineState("connect: connection refused")
+	require.Error(t, err)
+	_, err = engineState("")
+	require.Error(t, err)
+}
+
+func TestFinalizeStatus(t *testing.T) {
+	user := &backendv1.User{ObjectMeta: metav1.ObjectMeta{Generation: 3}}
+
+	// a user waiting for a backend is pending
+	status := backendv1.UserStatus{}
+	finalizeStatus(user, &status)
+	require.Equal(t, Pending, status.State)
+	require.Equal(t, int64(3), status.ObservedGeneration)
+	require.True(t, meta.IsStatusConditionFalse(status.Conditions, backendv1.UserBackendAssigned))
+	require.Equal(t, "Pending", meta.FindStatusCondition(status.Conditions, backendv1.UserReady).Reason)
+	user.Status = status
+
+	status = backendv1.UserStatus{Backend: "http://b", State: Running}
+	finalizeStatus(user, &status)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, backendv1.UserReady))
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, backendv1.UserEngineRunning))
+	require.True(t, meta.IsStatusConditionFalse(status.Conditions, backendv1.UserDegraded))
+	require.Len(t, status.Conditions, 4)
+	user.Status = status
+
+	// errors keep the backend and are reported apart from the state
+	status = backendv1.UserStatus{Backend: "http://b"}
+	setError(&status, errors.New("Failed runEngine"))
+	finalizeStatus(user, &status)
+	require.Equal(t, Error, status.State)
+	require.Equal(t, "Failed runEngine", status.LastError)
+	require.NotNil(t, status.LastErrorTime)
+	degraded := meta.FindStatusCondition(status.Conditions, backendv1.UserDegraded)
+	require.Equal(t, metav1.ConditionTrue, degraded.Status)
+	require.Equal(t, "Failed runEngine", degraded.Message)
+	require.True(t, meta.IsStatusConditionFalse(status.Conditions, backendv1.UserReady))
+	require.Equal(t, int32(0), status.RestartCount)
+	user.Status = status
+
+	// the last error is kept until the engine runs again
+	status = backendv1.UserStatus{Backend: "http://b", State: Starting}
+	finalizeStatus(user, &status)
+	require.Equal(t, "Failed runEngine", status.LastError)
+	require.NotNil(t, status.LastErrorTime)
+	user.Status = status
+
+	status = backendv1.UserStatus{Backend: "http://b", State: Running}
+	finalizeStatus(user, &status)
+	require.Empty(t, status.LastError)
+	require.Nil(t, status.LastErrorTime)
+	require.True(t, meta.IsStatusConditionTrue(status.Conditions, backendv1.UserReady))
+	user.Status = status
+
+	// a running engine that has to start again is a restart
+	status = backendv1.UserStatus{Backend: "http://b", State: Starting}
+	finalizeStatus(user, &status)
+	require.Equal(t, int32(1), status.RestartCount)
+	require.Equal(t, "Starting", meta.FindStatusCondition(status.Conditions, backendv1.UserEngineRunning).Reason)
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// kEngineStatusResync is how often a running shared user is reconciled when the
+// status poller reports its changes. It only guards against missed events.
+const kEngineStatusResync = 5 * time.Minute
+
+type backendStatuses struct {
+	states  map[int64]UserState
+	fetched time.Time
+}
+
+// engineStatusCache holds the statuses of all engines of each shared backend, as
+// returned by the /engine-statuses route.
+type engineStatusCache struct {
+	mu       sync.Mutex
+	backends map[string]*backendStatuses
+}
+
+func newEngineStatusCache() *engineStatusCache {
+	return &engineStatusCache{backends: make(map[string]*backendStatuses)}
+}
+
+func (c *engineStatusCache) set(url string, states map[int64]UserState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backends[url] = &backendStatuses{states: states, fetched: time.Now()}
+}
+
+// update records the state of one engine reported between polls of its backend
+func (c *engineStatusCache) update(url string, userID int64, state UserState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.backends[url]; ok {
+		b.states[userID] = state
+	}
+}
+
+// get returns the state of an engine from a poll younger than maxAge. Engines missing
+// from a fresh poll are stopped.
+func (c *engineStatusCache) get(url string, userID int64, maxAge time.Duration) (UserState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.backends[url]
+	if !ok || time.Since(b.fetched) > maxAge {
+		return "", false
+	}
+	if state, ok := b.states[userID]; ok {
+		return state, true
+	}
+	return Stopped, true
+}
+
+// cachedEngineStatus returns the status of an engine that is already running from the
+// last bulk poll of its backend. Engines that are starting, or whose backend was not
+// polled recently, are asked directly.
+func (r *UserReconciler) cachedEngineStatus(ctx context.Context, user *backendv1.User, userID int64, backendURL string) (UserState, error) {
+	if user != nil && user.Status.Backend == backendURL && (user.Status.State == Running || user.Status.State == Idle) {
+		if state, ok := r.statuses.get(backendURL, userID, 2*r.engineStatusInterval()); ok {
+			return state, nil
+		}
+	}
+	return r.engines.EngineStatus(ctx, backendURL, userID)
+}
+
+// statusPoller polls every shared backend once per interval for the statuses of all
+// its engines, and enqueues the users whose engine changed state.
+type statusPoller struct {
+	r      *UserReconciler
+	events chan event.GenericEvent
+}
+
+// Start implements manager.Runnable
+func (p *statusPoller) Start(ctx context.Context) error {
+	wait.JitterUntilWithContext(ctx, p.poll, p.r.engineStatusInterval(), 0.2, true)
+	return nil
+}
+
+func (p *statusPoller) poll(ctx context.Context) {
+	r := p.r
+	endpointsList := &corev1.EndpointsList{}
+	if err := r.List(ctx, endpointsList); err != nil {
+		r.Log.Error(err, "failed to list endpoints")
+		return
+	}
+	for i := range endpointsList.Items {
+		endpoints := &endpointsList.Items[i]
+		if !isSharedBackendEndpoints(endpoints) {
+			continue
+		}
+		for _, b := range sharedBackendEndpoints(endpoints) {
+			pollCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			states, err := r.engines.EngineStatuses(pollCtx, b.URL)
+			cancel()
+			if err != nil {
+				r.Log.Error(err, "failed to poll engine statuses", "backend", b.Name)
+				continue
+			}
+			r.statuses.set(b.URL, states)
+		}
+		p.fanOut(ctx, endpoints.Namespace)
+	}
+}
+
+// fanOut enqueues the running users whose polled state differs from their status.
+func (p *statusPoller) fanOut(ctx context.Context, namespace string) {
+	r := p.r
+	users := &backendv1.UserList{}
+	if err := r.List(ctx, users, client.InNamespace(namespace)); err != nil {
+		r.Log.Error(err, "failed to list users")
+		return
+	}
+	maxAge := 2 * r.engineStatusInterval()
+	for i := range users.Items {
+		u := &users.Items[i]
+		if u.Status.State != Running && u.Status.State != Idle {
+			continue
+		}
+		state, ok := r.statuses.get(u.Status.Backend, u.Spec.ID, maxAge)
+		if !ok || state == u.Status.State {
+			continue
+		}
+		select {
+		case p.events <- event.GenericEvent{Object: u}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func TestEngineStatusCache(t *testing.T) {
+	cache := newEngineStatusCache()
+	_, ok := cache.get("http://b", 1, time.Minute)
+	require.False(t, ok)
+
+	cache.set("http://b", map[int64]UserState{1: Running})
+	state, ok := cache.get("http://b", 1, time.Minute)
+	require.True(t, ok)
+	require.Equal(t, Running, state)
+	state, ok = cache.get("http://b", 2, time.Minute)
+	require.True(t, ok)
+	require.Equal(t, Stopped, state)
+
+	_, ok = cache.get("http://b", 1, 0)
+	require.False(t, ok)
+}
+
+// newStatusesServer returns a backend that answers bulk and per-user status requests
+func newStatusesServer(t *testing.T, states map[int64]string, single *int) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/engine-statuses":
+			json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: states})
+		case "/engine-status":
+			*single++
+			userID, _ := strconv.ParseInt(req.URL.Query().Get("userid"), 10, 64)
+			state, ok := states[userID]
+			if !ok {
+				state = "stopped"
+			}
+			json.NewEncoder(w).Encode(&JSONResponse{Result: "ok", Data: state})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestStatusPoller(t *testing.T) {
+	single := 0
+	backend := newStatusesServer(t, map[int64]string{1: "running", 2: "idle"}, &single)
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: kSharedBackend, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: host}},
+			Ports:     []corev1.EndpointPort{{Port: int32(portNum)}},
+		}},
+	}
+	user := func(id int64, state UserState) *backendv1.User {
+		return &backendv1.User{
+			ObjectMeta: metav1.ObjectMeta{Name: userName(id), Namespace: "default"},
+			Spec:       backendv1.UserSpec{ID: id},
+			Status:     backendv1.UserStatus{Backend: backend.URL, State: state},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(
+		endpoints, user(1, Running), user(2, Running), user(3, Running), user(4, Starting)).Build()
+	r := &UserReconciler{Client: c, Log: logr.Discard(), almondConfig: &config.AlmondConfig{}, statuses: newEngineStatusCache(),
+		engines: testEngineClient()}
+	events := make(chan event.GenericEvent, 10)
+	p := &statusPoller{r: r, events: events}
+	ctx := context.Background()
+
+	// user 2 went idle and the engine of user 3 is gone, user 1 is unchanged
+	p.poll(ctx)
+	close(events)
+	var names []string
+	for e := range events {
+		names = append(names, e.Object.GetName())
+	}
+	require.ElementsMatch(t, []string{"user-2", "user-3"}, names)
+	require.Equal(t, 0, single)
+
+	// running users read the polled status, starting users ask the backend
+	state, err := r.cachedEngineStatus(ctx, user(2, Running), 2, backend.URL)
+	require.NoError(t, err)
+	require.Equal(t, Idle, state)
+	require.Equal(t, 0, single)
+	state, err = r.cachedEngineStatus(ctx, user(4, Starting), 4, backend.URL)
+	require.NoError(t, err)
+	require.Equal(t, Stopped, state)
+	require.Equal(t, 1, single)
+}
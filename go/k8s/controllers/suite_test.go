@@ -0,0 +1,189 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// The envtest suite runs the controller in a manager against a real API server with
+// the User CRD, and a fake backend. It needs the control plane binaries, see
+// https://book.kubebuilder.io/reference/envtest.html, and is skipped without them.
+
+const (
+	envtestTimeout = 30 * time.Second
+	envtestTick    = 100 * time.Millisecond
+)
+
+type envtestSuite struct {
+	t       *testing.T
+	ctx     context.Context
+	c       client.Client
+	r       *UserReconciler
+	backend *fakeBackend
+}
+
+func startEnvtest(t *testing.T, almondConfig *config.AlmondConfig, users fakeUsers) *envtestSuite {
+	if len(os.Getenv("KUBEBUILDER_ASSETS")) == 0 {
+		t.Skip("KUBEBUILDER_ASSETS is not set")
+	}
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "..", "k8s", "components", "controller", "crd", "base")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { env.Stop() })
+
+	scheme := newTestScheme(t)
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme, MetricsBindAddress: "0"})
+	require.NoError(t, err)
+	backend := newFakeBackend()
+	r := newUserReconciler(mgr.GetClient(), scheme, logr.Discard(), mgr.GetEventRecorderFor("user-controller"),
+		almondConfig, backend, users)
+	r.setTemplates(&userTemplates{
+		developerDeployment: appsv1.Deployment{
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "backend", Image: "almond-cloud"}},
+			}}},
+		},
+		developerService: corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8100}}}},
+	})
+	require.NoError(t, r.SetupWithManager(mgr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	return &envtestSuite{t: t, ctx: ctx, c: mgr.GetClient(), r: r, backend: backend}
+}
+
+func (s *envtestSuite) create(obj client.Object) {
+	require.NoError(s.t, s.c.Create(s.ctx, obj))
+}
+
+// eventually waits for the User to satisfy cond; a deleted User is passed as nil
+func (s *envtestSuite) eventually(userID int64, cond func(user *backendv1.User) bool, msg string) {
+	require.Eventually(s.t, func() bool {
+		user := &backendv1.User{}
+		err := s.c.Get(s.ctx, types.NamespacedName{Namespace: "default", Name: userName(userID)}, user)
+		if apierrors.IsNotFound(err) {
+			return cond(nil)
+		}
+		return err == nil && cond(user)
+	}, envtestTimeout, envtestTick, msg)
+}
+
+// engineEvent enqueues the User as the engine event server does
+func (s *envtestSuite) engineEvent(userID int64) {
+	user := newUser(userID)
+	require.NoError(s.t, s.c.Get(s.ctx, client.ObjectKeyFromObject(user), user))
+	s.r.statusEvents <- event.GenericEvent{Object: user}
+}
+
+func newUser(userID int64) *backendv1.User {
+	return &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(userID), Namespace: "default"},
+		Spec:       backendv1.UserSpec{ID: userID},
+	}
+}
+
+func inState(backend string, state UserState) func(user *backendv1.User) bool {
+	return func(user *backendv1.User) bool {
+		return user != nil && user.Status.Backend == backend && user.Status.State == state
+	}
+}
+
+func deleted(user *backendv1.User) bool {
+	return user == nil
+}
+
+func TestEnvtestSharedUser(t *testing.T) {
+	s := startEnvtest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}, 2: {ID: 2}})
+	const (
+		backend1 = "http://10.0.0.1:8100"
+		backend2 = "http://10.0.0.2:8100"
+	)
+	s.create(sharedBackends("10.0.0.1"))
+	s.create(newUser(1))
+	s.create(newUser(2))
+	s.eventually(1, inState(backend1, Running), "engine 1 starts")
+	s.eventually(2, inState(backend1, Running), "engine 2 starts")
+
+	// an idle engine is shut down and its User kept Stopped
+	s.backend.setState(backend1, 1, Idle)
+	s.engineEvent(1)
+	s.eventually(1, inState("", Stopped), "idle user stopped")
+	require.Equal(t, Stopped, s.backend.state(backend1, 1))
+
+	// the engine moves when its backend goes away
+	endpoints := sharedBackends("10.0.0.2")
+	existing := &corev1.Endpoints{}
+	require.NoError(t, s.c.Get(s.ctx, client.ObjectKeyFromObject(endpoints), existing))
+	existing.Subsets = endpoints.Subsets
+	require.NoError(t, s.c.Update(s.ctx, existing))
+	s.eventually(2, inState(backend2, Running), "engine 2 moves to the new backend")
+	require.Equal(t, Stopped, s.backend.state(backend1, 2))
+
+	// deleting the User kills its engine
+	require.NoError(t, s.c.Delete(s.ctx, newUser(2)))
+	s.eventually(2, deleted, "user 2 deleted")
+	require.Equal(t, Stopped, s.backend.state(backend2, 2))
+}
+
+func TestEnvtestDeveloperUser(t *testing.T) {
+	org := 1
+	s := startEnvtest(t, &config.AlmondConfig{EnableDeveloperBackend: true}, fakeUsers{3: {ID: 3, DeveloperOrg: &org}})
+	key := types.NamespacedName{Namespace: "default", Name: userName(3)}
+	s.create(newUser(3))
+
+	// there is no deployment controller in envtest, the deployment is made available by hand
+	deployment := &appsv1.Deployment{}
+	require.Eventually(t, func() bool { return s.c.Get(s.ctx, key, deployment) == nil }, envtestTimeout, envtestTick)
+	require.NotNil(t, metav1.GetControllerOf(deployment))
+	deployment.Status.Replicas = 1
+	deployment.Status.AvailableReplicas = 1
+	require.NoError(t, s.c.Status().Update(s.ctx, deployment))
+
+	service := &corev1.Service{}
+	require.Eventually(t, func() bool { return s.c.Get(s.ctx, key, service) == nil }, envtestTimeout, envtestTick)
+	backend := "http://" + service.Spec.ClusterIP + ":8100"
+	s.eventually(3, inState(backend, Running), "developer engine starts")
+
+	require.NoError(t, s.c.Delete(s.ctx, newUser(3)))
+	s.eventually(3, deleted, "developer user deleted")
+	require.Equal(t, Stopped, s.backend.state(backend, 3))
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// handleSuspension stops the engine of a user whose spec is suspended and deletes its
+// deployment and service. It returns true while the user is suspended, in which case the
+// reconcile stops there. The work is done once; a user already in the Suspended state
+// is left alone until the spec resumes it.
+func (r *UserReconciler) handleSuspension(ctx context.Context, req ctrl.Request, user *backendv1.User,
+	status *backendv1.UserStatus, deployment bool) (bool, error) {
+	if !user.Spec.Suspended {
+		if user.Status.State == Suspended {
+			r.event(user, EventResumed, "Resuming suspended user")
+		}
+		return false, nil
+	}
+	if user.Status.State == Suspended {
+		status.State = Suspended
+		return true, nil
+	}
+	// keep the backends until the engine is gone, so a failed attempt is retried
+	status.Backend = user.Status.Backend
+	status.MigratingFrom = user.Status.MigratingFrom
+	var err error
+	if deployment {
+		err = r.deleteDeploymentService(ctx, req, user.Spec.ID)
+	} else {
+		err = r.killEngines(ctx, user, "user is suspended")
+	}
+	if err != nil {
+		return true, fmt.Errorf("suspend failed: %w", err)
+	}
+	status.Backend = ""
+	status.MigratingFrom = ""
+	status.State = Suspended
+	r.event(user, EventSuspended, "Suspended user, engine stopped")
+	return true, nil
+}
+
+// suspensionResult records a failed suspension in the status and retries it
+func suspensionResult(status *backendv1.UserStatus, err error) ctrl.Result {
+	if err == nil {
+		return ctrl.Result{}
+	}
+	setError(status, err)
+	return ctrl.Result{RequeueAfter: 2 * time.Second}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	"almond-cloud/config"
+)
+
+func (rt *reconcileTest) setSuspended(userID int64, suspended bool) {
+	user := rt.user(userID)
+	user.Spec.Suspended = suspended
+	require.NoError(rt.t, rt.c.Update(rt.ctx, user))
+}
+
+func TestReconcileSuspendSharedUser(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}},
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+	rt.reconcile(1)
+	rt.reconcile(1)
+	rt.reconcile(1)
+	require.Equal(t, Running, rt.user(1).Status.State)
+	starts := len(rt.backend.callsTo("run-engine"))
+
+	// a suspended user keeps its User and mode, without an engine
+	rt.setSuspended(1, true)
+	result := rt.reconcile(1)
+	require.Zero(t, result.RequeueAfter)
+	user := rt.user(1)
+	require.Equal(t, Suspended, user.Status.State)
+	require.Empty(t, user.Status.Backend)
+	require.Equal(t, "shared", user.Status.Mode)
+	require.Equal(t, Stopped, rt.backend.state(backend, 1))
+	require.Equal(t, []string{backend + " 1"}, rt.backend.callsTo("kill-engine"))
+
+	rt.reconcile(1)
+	require.Equal(t, Suspended, rt.user(1).Status.State)
+	require.Len(t, rt.backend.callsTo("kill-engine"), 1)
+	require.Len(t, rt.backend.callsTo("run-engine"), starts)
+
+	// resuming starts the engine again
+	rt.setSuspended(1, false)
+	rt.reconcile(1)
+	user = rt.user(1)
+	require.Equal(t, Starting, user.Status.State)
+	require.Equal(t, backend, user.Status.Backend)
+	require.Len(t, rt.backend.callsTo("run-engine"), starts+1)
+}
+
+func TestReconcileSuspendFailure(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	user := testUser(1, backend, Running)
+	user.Spec.Suspended = true
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends("10.0.0.1"), user)
+	rt.backend.setState(backend, 1, Running)
+
+	// the backend is kept until the engine is killed
+	rt.backend.fail("kill-engine", errors.New("backend busy"))
+	result := rt.reconcile(1)
+	require.Greater(t, int64(result.RequeueAfter), int64(0))
+	require.Equal(t, Error, rt.user(1).Status.State)
+	require.Equal(t, backend, rt.user(1).Status.Backend)
+	require.Contains(t, rt.user(1).Status.LastError, "suspend failed")
+
+	rt.backend.fail("kill-engine", nil)
+	rt.reconcile(1)
+	require.Equal(t, Suspended, rt.user(1).Status.State)
+	require.Equal(t, Stopped, rt.backend.state(backend, 1))
+}
+
+func TestReconcileSuspendDeveloperUser(t *testing.T) {
+	org := 1
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true},
+		fakeUsers{2: {ID: 2, DeveloperOrg: &org}}, testUser(2, "", ""))
+	key := types.NamespacedName{Namespace: "default", Name: userName(2)}
+	rt.reconcile(2)
+	require.NoError(t, rt.c.Get(rt.ctx, key, &appsv1.Deployment{}))
+
+	rt.setSuspended(2, true)
+	rt.reconcile(2)
+	require.Equal(t, Suspended, rt.user(2).Status.State)
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})))
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &corev1.Service{})))
+
+	rt.setSuspended(2, false)
+	rt.reconcile(2)
+	require.NoError(t, rt.c.Get(rt.ctx, key, &appsv1.Deployment{}))
+}
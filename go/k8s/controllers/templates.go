@@ -0,0 +1,295 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"time"
+
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+// Template files in the config directory. The dedicated templates are optional, the
+// developer templates are used for dedicated users if they are missing.
+const (
+	kDeveloperDeploymentFile = "developer-deployment.json"
+	kDeveloperServiceFile    = "developer-service.json"
+	kDedicatedDeploymentFile = "dedicated-deployment.json"
+	kDedicatedServiceFile    = "dedicated-service.json"
+)
+
+const (
+	// kTemplateHashAnnotation on a user Deployment or Service is the hash of the object
+	// rendered from the template. A different hash means the template or the spec of the
+	// user changed since the object was last written.
+	kTemplateHashAnnotation = "backend.almond.stanford.edu/template-hash"
+
+	kDefaultRolloutRate    = 10
+	kDefaultTemplateReload = 30 * time.Second
+)
+
+// userTemplates are the templates of the deployments and services of users
+type userTemplates struct {
+	developerDeployment appsv1.Deployment
+	developerService    corev1.Service
+	dedicatedDeployment appsv1.Deployment
+	dedicatedService    corev1.Service
+}
+
+// readTemplates reads the deployment and service templates from configDir
+func readTemplates(configDir string) (*userTemplates, error) {
+	t := &userTemplates{}
+	if err := ReadJSONFile(path.Join(configDir, kDeveloperDeploymentFile), &t.developerDeployment); err != nil {
+		return nil, err
+	}
+	if err := ReadJSONFile(path.Join(configDir, kDeveloperServiceFile), &t.developerService); err != nil {
+		return nil, err
+	}
+	t.dedicatedDeployment = *t.developerDeployment.DeepCopy()
+	t.dedicatedService = *t.developerService.DeepCopy()
+	if err := readOptionalJSONFile(path.Join(configDir, kDedicatedDeploymentFile), &t.dedicatedDeployment); err != nil {
+		return nil, err
+	}
+	if err := readOptionalJSONFile(path.Join(configDir, kDedicatedServiceFile), &t.dedicatedService); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readOptionalJSONFile is ReadJSONFile for a file that may not exist, v is left alone then
+func readOptionalJSONFile(filePath string, v interface{}) error {
+	if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return ReadJSONFile(filePath, v)
+}
+
+// templates returns the deployment and service templates of a mode. They must not be modified.
+func (r *UserReconciler) templates(mode string) (*appsv1.Deployment, *corev1.Service) {
+	r.templatesMu.RLock()
+	t := r.userTemplates
+	r.templatesMu.RUnlock()
+	if t == nil {
+		t = &userTemplates{}
+	}
+	if mode == backendv1.UserModeDedicated {
+		return &t.dedicatedDeployment, &t.dedicatedService
+	}
+	return &t.developerDeployment, &t.developerService
+}
+
+func (r *UserReconciler) setTemplates(t *userTemplates) {
+	r.templatesMu.Lock()
+	defer r.templatesMu.Unlock()
+	r.userTemplates = t
+}
+
+// templateHash returns a short hash of the labels, annotations and spec of an object
+func templateHash(meta *metav1.ObjectMeta, spec interface{}) (string, error) {
+	b, err := json.Marshal(struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		Spec        interface{}       `json:"spec"`
+	}{meta.Labels, meta.Annotations, spec})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func setTemplateHash(meta *metav1.ObjectMeta, spec interface{}) error {
+	hash, err := templateHash(meta, spec)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[kTemplateHashAnnotation] = hash
+	return nil
+}
+
+// desiredDeployment renders the deployment of a user from the template of its mode, with
+// the resources of its spec and the template hash annotation.
+func (r *UserReconciler) desiredDeployment(user *backendv1.User, mode string) (*appsv1.Deployment, error) {
+	template, _ := r.templates(mode)
+	deployment := NewDeployment(template, user.Name, user.Namespace)
+	if user.Spec.Resources != nil && len(deployment.Spec.Template.Spec.Containers) > 0 {
+		user.Spec.Resources.DeepCopyInto(&deployment.Spec.Template.Spec.Containers[0].Resources)
+	}
+	if err := setTemplateHash(&deployment.ObjectMeta, &deployment.Spec); err != nil {
+		return nil, err
+	}
+	if err := ctrl.SetControllerReference(user, deployment, r.Scheme); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// desiredService renders the service of a user from the template of its mode, with the
+// template hash annotation.
+func (r *UserReconciler) desiredService(user *backendv1.User, mode string) (*corev1.Service, error) {
+	_, template := r.templates(mode)
+	service := NewService(template, user.Name, user.Namespace)
+	if err := setTemplateHash(&service.ObjectMeta, &service.Spec); err != nil {
+		return nil, err
+	}
+	if err := ctrl.SetControllerReference(user, service, r.Scheme); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// syncDeployment updates a deployment whose template hash is out of date, which rolls
+// its pod. Rollouts are paced by DEPLOYMENT_ROLLOUT_RATE; a deployment over the rate
+// keeps running as is and is checked again on the next reconcile of its user.
+func (r *UserReconciler) syncDeployment(ctx context.Context, user *backendv1.User, mode string, deployment *appsv1.Deployment) error {
+	desired, err := r.desiredDeployment(user, mode)
+	if err != nil {
+		return err
+	}
+	hash := desired.Annotations[kTemplateHashAnnotation]
+	if deployment.Annotations[kTemplateHashAnnotation] == hash || !r.rollouts.Allow() {
+		return nil
+	}
+	r.Log.Info("deployment template changed, rolling it:", "user", user.Spec.ID)
+	// the selector of a deployment cannot change
+	desired.Spec.Selector = deployment.Spec.Selector
+	deployment.Spec = desired.Spec
+	mergeStringMap(&deployment.Labels, desired.Labels)
+	mergeStringMap(&deployment.Annotations, desired.Annotations)
+	if err := r.Update(ctx, deployment); err != nil {
+		return err
+	}
+	r.event(user, EventDeploymentUpdated, "Updated %s deployment %s to template %s", mode, deployment.Name, hash)
+	return nil
+}
+
+// syncService updates a service whose template hash is out of date. Its cluster IP is kept.
+func (r *UserReconciler) syncService(ctx context.Context, user *backendv1.User, mode string, service *corev1.Service) error {
+	desired, err := r.desiredService(user, mode)
+	if err != nil {
+		return err
+	}
+	hash := desired.Annotations[kTemplateHashAnnotation]
+	if service.Annotations[kTemplateHashAnnotation] == hash {
+		return nil
+	}
+	desired.Spec.ClusterIP = service.Spec.ClusterIP
+	desired.Spec.ClusterIPs = service.Spec.ClusterIPs
+	service.Spec = desired.Spec
+	mergeStringMap(&service.Labels, desired.Labels)
+	mergeStringMap(&service.Annotations, desired.Annotations)
+	if err := r.Update(ctx, service); err != nil {
+		return err
+	}
+	r.event(user, EventServiceUpdated, "Updated %s service %s to template %s", mode, service.Name, hash)
+	return nil
+}
+
+func mergeStringMap(dst *map[string]string, src map[string]string) {
+	if *dst == nil {
+		*dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		(*dst)[k] = v
+	}
+}
+
+// deploymentRolling reports whether a deployment is still rolling out its spec. The
+// engine on the old pod goes away with it, so the user waits like a new deployment.
+func deploymentRolling(deployment *appsv1.Deployment) bool {
+	return deployment.Generation > deployment.Status.ObservedGeneration ||
+		deployment.Status.Replicas > deployment.Status.UpdatedReplicas
+}
+
+func newRolloutLimiter(perMinute int) *rate.Limiter {
+	if perMinute <= 0 {
+		perMinute = kDefaultRolloutRate
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), 1)
+}
+
+func (r *UserReconciler) templateReloadInterval() time.Duration {
+	if r.almondConfig.TemplateReloadSeconds > 0 {
+		return time.Duration(r.almondConfig.TemplateReloadSeconds) * time.Second
+	}
+	return kDefaultTemplateReload
+}
+
+// templateWatcher reads the templates from the config directory again at an interval.
+// The config directory is usually a ConfigMap volume, whose files are replaced rather
+// than written. Changed templates are rolled out by the reconciles of the users with a
+// deployment, which the watcher enqueues.
+type templateWatcher struct {
+	r      *UserReconciler
+	events chan event.GenericEvent
+}
+
+// Start implements manager.Runnable
+func (w *templateWatcher) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, w.reload, w.r.templateReloadInterval())
+	return nil
+}
+
+func (w *templateWatcher) reload(ctx context.Context) {
+	r := w.r
+	templates, err := readTemplates(r.configDir)
+	if err != nil {
+		r.Log.Error(err, "failed to reload templates, keeping the old ones")
+		return
+	}
+	r.templatesMu.RLock()
+	changed := !reflect.DeepEqual(templates, r.userTemplates)
+	r.templatesMu.RUnlock()
+	if !changed {
+		return
+	}
+	r.setTemplates(templates)
+	r.Log.Info("templates changed")
+
+	users := &backendv1.UserList{}
+	if err := r.List(ctx, users); err != nil {
+		r.Log.Error(err, "failed to list users")
+		return
+	}
+	for i := range users.Items {
+		u := &users.Items[i]
+		if len(u.Status.Mode) == 0 || u.Status.Mode == backendv1.UserModeShared {
+			continue
+		}
+		select {
+		case w.events <- event.GenericEvent{Object: u}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
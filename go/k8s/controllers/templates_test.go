@@ -0,0 +1,173 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+)
+
+func writeTemplate(t *testing.T, dir, name, content string) {
+	require.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0o644))
+}
+
+func TestReadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	_, err := readTemplates(dir)
+	require.Error(t, err)
+
+	writeTemplate(t, dir, kDeveloperDeploymentFile, `{"metadata": {"name": "developer"}}`)
+	writeTemplate(t, dir, kDeveloperServiceFile, `{"metadata": {"name": "developer"}}`)
+	r := &UserReconciler{}
+	templates, err := readTemplates(dir)
+	require.NoError(t, err)
+	r.setTemplates(templates)
+	deployment, service := r.templates(backendv1.UserModeDedicated)
+	require.Equal(t, "developer", deployment.Name)
+	require.Equal(t, "developer", service.Name)
+
+	writeTemplate(t, dir, kDedicatedDeploymentFile, `{"metadata": {"name": "dedicated"}}`)
+	templates, err = readTemplates(dir)
+	require.NoError(t, err)
+	r.setTemplates(templates)
+	deployment, service = r.templates(backendv1.UserModeDedicated)
+	require.Equal(t, "dedicated", deployment.Name)
+	require.Equal(t, "developer", service.Name)
+	deployment, _ = r.templates(backendv1.UserModeDeveloper)
+	require.Equal(t, "developer", deployment.Name)
+}
+
+func developerTemplates(image string) *userTemplates {
+	return &userTemplates{
+		developerDeployment: appsv1.Deployment{
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "main", Image: image}},
+			}}},
+		},
+		developerService: corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8100}}}},
+	}
+}
+
+// runDeveloperUser reconciles a developer user until its engine is started
+func (rt *reconcileTest) runDeveloperUser(userID int64, ip string) {
+	key := types.NamespacedName{Namespace: "default", Name: userName(userID)}
+	rt.reconcile(userID)
+	deployment := &appsv1.Deployment{}
+	require.NoError(rt.t, rt.c.Get(rt.ctx, key, deployment))
+	deployment.Status.AvailableReplicas = 1
+	require.NoError(rt.t, rt.c.Status().Update(rt.ctx, deployment))
+	rt.reconcile(userID)
+	service := &corev1.Service{}
+	require.NoError(rt.t, rt.c.Get(rt.ctx, key, service))
+	service.Spec.ClusterIP = ip
+	require.NoError(rt.t, rt.c.Update(rt.ctx, service))
+	rt.reconcile(userID)
+	require.Equal(rt.t, Starting, rt.user(userID).Status.State)
+}
+
+func (rt *reconcileTest) deployment(userID int64) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{}
+	require.NoError(rt.t, rt.c.Get(rt.ctx, types.NamespacedName{Namespace: "default", Name: userName(userID)}, deployment))
+	return deployment
+}
+
+func TestReconcileTemplateDrift(t *testing.T) {
+	org := 1
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true, DeploymentRolloutRate: 1},
+		fakeUsers{1: {ID: 1, DeveloperOrg: &org}, 2: {ID: 2, DeveloperOrg: &org}}, testUser(1, "", ""), testUser(2, "", ""))
+	rt.r.setTemplates(developerTemplates("almond-cloud:v1"))
+	rt.runDeveloperUser(1, "10.1.0.1")
+	rt.runDeveloperUser(2, "10.1.0.2")
+	oldHash := rt.deployment(1).Annotations[kTemplateHashAnnotation]
+	require.NotEmpty(t, oldHash)
+	oldHash2 := rt.deployment(2).Annotations[kTemplateHashAnnotation]
+	rt.reconcile(1)
+	require.Equal(t, oldHash, rt.deployment(1).Annotations[kTemplateHashAnnotation], "no drift")
+
+	// a new template is rolled out at the configured rate
+	rt.r.setTemplates(developerTemplates("almond-cloud:v2"))
+	rt.reconcile(1)
+	rt.reconcile(2)
+	deployment := rt.deployment(1)
+	require.NotEqual(t, oldHash, deployment.Annotations[kTemplateHashAnnotation])
+	require.Equal(t, "almond-cloud:v2", deployment.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, "user-1", deployment.Spec.Selector.MatchLabels["app"])
+	deployment = rt.deployment(2)
+	require.Equal(t, oldHash2, deployment.Annotations[kTemplateHashAnnotation])
+	require.Equal(t, "almond-cloud:v1", deployment.Spec.Template.Spec.Containers[0].Image)
+
+	// the service keeps its cluster IP when its template changes
+	templates := developerTemplates("almond-cloud:v2")
+	templates.developerService.Spec.Ports[0].Name = "almond"
+	rt.r.setTemplates(templates)
+	rt.reconcile(1)
+	service := &corev1.Service{}
+	require.NoError(t, rt.c.Get(rt.ctx, types.NamespacedName{Namespace: "default", Name: userName(1)}, service))
+	require.Equal(t, "almond", service.Spec.Ports[0].Name)
+	require.Equal(t, "10.1.0.1", service.Spec.ClusterIP)
+	require.Equal(t, "http://10.1.0.1:8100", rt.user(1).Status.Backend)
+
+	// the user waits while its deployment rolls
+	deployment = rt.deployment(1)
+	deployment.Status.Replicas = 2
+	deployment.Status.UpdatedReplicas = 1
+	require.NoError(t, rt.c.Status().Update(rt.ctx, deployment))
+	rt.reconcile(1)
+	require.Equal(t, Starting, rt.user(1).Status.State)
+	require.Empty(t, rt.user(1).Status.Backend)
+}
+
+func TestTemplateWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, kDeveloperDeploymentFile, `{"metadata": {"name": "v1"}}`)
+	writeTemplate(t, dir, kDeveloperServiceFile, `{}`)
+	developer := testUser(1, "", Running)
+	developer.Status.Mode = backendv1.UserModeDeveloper
+	shared := testUser(2, "", Running)
+	shared.Status.Mode = backendv1.UserModeShared
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{}, developer, shared)
+	templates, err := readTemplates(dir)
+	require.NoError(t, err)
+	rt.r.setTemplates(templates)
+	rt.r.configDir = dir
+	events := make(chan event.GenericEvent, 10)
+	w := &templateWatcher{r: rt.r, events: events}
+
+	w.reload(rt.ctx)
+	require.Empty(t, events)
+
+	writeTemplate(t, dir, kDeveloperDeploymentFile, `{"metadata": {"name": "v2"}}`)
+	w.reload(rt.ctx)
+	deployment, _ := rt.r.templates(backendv1.UserModeDeveloper)
+	require.Equal(t, "v2", deployment.Name)
+	require.Len(t, events, 1)
+	require.Equal(t, userName(1), (<-events).Object.GetName())
+
+	// a broken template keeps the old ones
+	writeTemplate(t, dir, kDeveloperDeploymentFile, `{`)
+	w.reload(rt.ctx)
+	deployment, _ = rt.r.templates(backendv1.UserModeDeveloper)
+	require.Equal(t, "v2", deployment.Name)
+}
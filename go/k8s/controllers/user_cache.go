@@ -0,0 +1,202 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// kCacheVersionAnnotation is bumped by the frontend when it changes the database row of
+// a user, the cached entries of the user are dropped when the value changes.
+const kCacheVersionAnnotation = "backend.almond.stanford.edu/cache-version"
+
+const (
+	kDefaultUserCacheSize = 10000
+	kDefaultUserCacheTTL  = 10 * time.Minute
+)
+
+var (
+	userCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "almond_user_cache_hits_total",
+		Help: "Number of database lookups answered by the user cache",
+	})
+	userCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "almond_user_cache_misses_total",
+		Help: "Number of database lookups missing or expired in the user cache",
+	})
+	userCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "almond_user_cache_evictions_total",
+		Help: "Number of entries evicted from the user cache because it was full",
+	})
+	userCacheInvalidations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "almond_user_cache_invalidations_total",
+		Help: "Number of users whose cached entries were invalidated",
+	})
+	userCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "almond_user_cache_entries",
+		Help: "Number of entries in the user cache",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(userCacheHits, userCacheMisses, userCacheEvictions,
+		userCacheInvalidations, userCacheEntries)
+}
+
+type userCacheEntry struct {
+	userID     int64
+	prefix     string
+	value      interface{}
+	expiration time.Time
+}
+
+// cachedUser holds the entries of one user and the cache version they were read at
+type cachedUser struct {
+	version string
+	entries map[string]*list.Element
+}
+
+// userCache is a bounded LRU cache of database entries of users, safe for concurrent use.
+// Entries expire after a TTL and all entries of a user can be invalidated at once.
+type userCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	lru        *list.List
+	users      map[int64]*cachedUser
+}
+
+func newUserCache(maxEntries int, ttl time.Duration) *userCache {
+	if maxEntries <= 0 {
+		maxEntries = kDefaultUserCacheSize
+	}
+	if ttl <= 0 {
+		ttl = kDefaultUserCacheTTL
+	}
+	return &userCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		lru:        list.New(),
+		users:      make(map[int64]*cachedUser),
+	}
+}
+
+func (c *userCache) get(prefix string, userID int64) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.users[userID]; ok {
+		if el, ok := u.entries[prefix]; ok {
+			entry := el.Value.(*userCacheEntry)
+			if entry.expiration.After(time.Now()) {
+				c.lru.MoveToFront(el)
+				userCacheHits.Inc()
+				return entry.value, true
+			}
+			c.remove(el)
+		}
+	}
+	userCacheMisses.Inc()
+	return nil, false
+}
+
+// set caches an entry of a user read from the database while the User had the given
+// cache version. Entries read at an older version are dropped.
+func (c *userCache) set(prefix string, userID int64, version string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.users[userID]; ok && u.version != version {
+		c.invalidateLocked(userID)
+	}
+	u := c.user(userID, version)
+	if el, ok := u.entries[prefix]; ok {
+		entry := el.Value.(*userCacheEntry)
+		entry.value = value
+		entry.expiration = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(el)
+		return
+	}
+	entry := &userCacheEntry{userID: userID, prefix: prefix, value: value, expiration: time.Now().Add(c.ttl)}
+	u.entries[prefix] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		userCacheEvictions.Inc()
+	}
+	userCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// invalidate drops all cached entries of a user
+func (c *userCache) invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked(userID)
+}
+
+// syncVersion invalidates a user if its cache version annotation changed since its
+// entries were cached. Users without entries are not recorded.
+func (c *userCache) syncVersion(userID int64, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u, ok := c.users[userID]; ok && u.version != version {
+		c.invalidateLocked(userID)
+	}
+}
+
+func (c *userCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// user returns the entries of a user, creating them at the given version if needed.
+// c.mu must be held.
+func (c *userCache) user(userID int64, version string) *cachedUser {
+	u, ok := c.users[userID]
+	if !ok {
+		u = &cachedUser{version: version, entries: make(map[string]*list.Element)}
+		c.users[userID] = u
+	}
+	return u
+}
+
+// invalidateLocked drops all entries of a user. c.mu must be held.
+func (c *userCache) invalidateLocked(userID int64) {
+	u, ok := c.users[userID]
+	if !ok {
+		return
+	}
+	for _, el := range u.entries {
+		c.lru.Remove(el)
+	}
+	delete(c.users, userID)
+	userCacheInvalidations.Inc()
+	userCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// remove drops one entry, and the user once it has no entries left. c.mu must be held.
+func (c *userCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*userCacheEntry)
+	if u, ok := c.users[entry.userID]; ok {
+		delete(u.entries, entry.prefix)
+		if len(u.entries) == 0 {
+			delete(c.users, entry.userID)
+		}
+	}
+	userCacheEntries.Set(float64(c.lru.Len()))
+}
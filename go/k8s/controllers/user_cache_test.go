@@ -0,0 +1,115 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCacheLRU(t *testing.T) {
+	cache := newUserCache(3, time.Hour)
+	cache.set("user", 1, "", "u1")
+	cache.set("developer-key", 1, "", "k1")
+	cache.set("user", 2, "", "u2")
+
+	// reading user 1 makes user 2 the least recently used
+	v, ok := cache.get("user", 1)
+	require.True(t, ok)
+	require.Equal(t, "u1", v)
+	_, ok = cache.get("developer-key", 1)
+	require.True(t, ok)
+	cache.set("user", 3, "", "u3")
+	require.Equal(t, 3, cache.len())
+	_, ok = cache.get("user", 2)
+	require.False(t, ok)
+	_, ok = cache.get("developer-key", 1)
+	require.True(t, ok)
+
+	cache.set("user", 3, "", "u3'")
+	v, _ = cache.get("user", 3)
+	require.Equal(t, "u3'", v)
+	require.Equal(t, 3, cache.len())
+}
+
+func TestUserCacheTTL(t *testing.T) {
+	cache := newUserCache(10, time.Millisecond)
+	cache.set("user", 1, "", "u1")
+	time.Sleep(5 * time.Millisecond)
+	_, ok := cache.get("user", 1)
+	require.False(t, ok)
+	require.Equal(t, 0, cache.len())
+}
+
+func TestUserCacheInvalidate(t *testing.T) {
+	cache := newUserCache(10, time.Hour)
+	cache.set("user", 1, "", "u1")
+	cache.set("developer-key", 1, "", "k1")
+	cache.set("user", 2, "", "u2")
+	cache.invalidate(1)
+	_, ok := cache.get("user", 1)
+	require.False(t, ok)
+	_, ok = cache.get("developer-key", 1)
+	require.False(t, ok)
+	_, ok = cache.get("user", 2)
+	require.True(t, ok)
+
+	// a bumped cache version drops the entries read at the old version
+	cache.syncVersion(2, "")
+	_, ok = cache.get("user", 2)
+	require.True(t, ok)
+	cache.syncVersion(2, "1")
+	_, ok = cache.get("user", 2)
+	require.False(t, ok)
+	cache.set("user", 2, "1", "u2'")
+	cache.syncVersion(2, "1")
+	_, ok = cache.get("user", 2)
+	require.True(t, ok)
+
+	// an entry read at a newer version drops the older ones
+	cache.set("developer-key", 2, "2", "k2")
+	_, ok = cache.get("user", 2)
+	require.False(t, ok)
+
+	// users without entries are not recorded
+	cache.invalidate(2)
+	for i := int64(10); i < 20; i++ {
+		cache.syncVersion(i, "1")
+	}
+	require.Empty(t, cache.users)
+}
+
+func TestUserCacheConcurrent(t *testing.T) {
+	cache := newUserCache(50, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := int64(0); j < 200; j++ {
+				cache.set("user", j, "", j)
+				cache.get("user", j/2)
+				if j%10 == int64(i) {
+					cache.invalidate(j)
+				}
+				cache.syncVersion(j, "v")
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, cache.len(), 50)
+}
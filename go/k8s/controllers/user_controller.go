@@ -15,30 +15,33 @@
 package controllers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	logging "log"
 
 	"github.com/go-logr/logr"
-	"gorm.io/gorm"
+	"golang.org/x/time/rate"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"almond-cloud/config"
 	"almond-cloud/dbproxy"
@@ -49,22 +52,41 @@ import (
 // UserReconciler reconciles a User object
 type UserReconciler struct {
 	client.Client
-	Scheme                      *runtime.Scheme
-	Log                         logr.Logger
-	almondConfig                *config.AlmondConfig
-	localCache                  map[string]CacheEntry
-	developerDeploymentTemplate appsv1.Deployment
-	developerServiceTemplate    corev1.Service
+	Scheme        *runtime.Scheme
+	Log           logr.Logger
+	Recorder      record.EventRecorder
+	almondConfig  *config.AlmondConfig
+	cache         *userCache
+	loads         *loadTracker
+	drains        *drainTracker
+	starts        *startLimiter
+	warnings      *warningThrottle
+	statuses      *engineStatusCache
+	statusEvents  chan event.GenericEvent
+	engineEvents  bool
+	engines       EngineClient
+	users         UserLookup
+	rollouts      *rate.Limiter
+	configDir     string
+	templatesMu   sync.RWMutex
+	userTemplates *userTemplates
 }
 
 // UserState constants
-type UserState string
+type UserState = backendv1.UserState
 
 const (
-	Starting UserState = "starting"
-	Running  UserState = "running"
-	Idle     UserState = "idle"
-	Stopping UserState = "stopping"
+	Pending   = backendv1.UserPending
+	Starting  = backendv1.UserStarting
+	Running   = backendv1.UserRunning
+	Idle      = backendv1.UserIdle
+	Stopping  = backendv1.UserStopping
+	Stopped   = backendv1.UserStopped
+	Draining  = backendv1.UserDraining
+	Migrating = backendv1.UserMigrating
+	Error     = backendv1.UserError
+	Failed    = backendv1.UserFailed
+	Suspended = backendv1.UserSuspended
 )
 
 // PlatformOptions is part of runEngine request
@@ -79,6 +101,10 @@ type PlatformOptions struct {
 	DBProxyAccessToken string  `json:"dbProxyAccessToken"`
 	HumanName          *string `json:"humanName"`
 	Email              *string `json:"email"`
+	// IdleTimeoutMillis is how long the engine can be inactive before it is idle, 0 for the default of the backend
+	IdleTimeoutMillis int64 `json:"idleTimeoutMillis,omitempty"`
+	// AlwaysOn tells the backend that the controller keeps the engine running while it is idle
+	AlwaysOn bool `json:"alwaysOn,omitempty"`
 }
 
 func platformOptions(user *sql.User, developerKey *string, dbProxyURL string, dbProxyToken string) *PlatformOptions {
@@ -102,33 +128,74 @@ type JSONResponse struct {
 	Data   interface{} `json:"data"`
 }
 
-type CacheEntry struct {
-	Value      interface{}
-	Expiration time.Time
+type dbQueryFunc func(users UserLookup, userID int64) (interface{}, error)
+
+// UserLookup reads the users whose engines are managed from the database
+type UserLookup interface {
+	GetUser(userID int64) (*sql.User, error)
+	GetDeveloperKey(userID int64) (*string, error)
+	// HasAutomations returns whether the user has apps in user_app
+	HasAutomations(userID int64) (bool, error)
+}
+
+// sqlUserLookup reads users from the shared database connection
+type sqlUserLookup struct{}
+
+func (sqlUserLookup) GetUser(userID int64) (*sql.User, error) {
+	return sql.GetUser(sql.GetDB(), userID)
 }
 
-const kDefaultCacheDuration = 2 * time.Hour
+func (sqlUserLookup) GetDeveloperKey(userID int64) (*string, error) {
+	return sql.GetDeveloperKey(sql.GetDB(), userID)
+}
 
-type dbQueryFunc func(db *gorm.DB, userID int64) (interface{}, error)
+func (sqlUserLookup) HasAutomations(userID int64) (bool, error) {
+	return sql.HasUserApps(sql.GetDB(), userID)
+}
 
 // NewUserReconciler initializes UserReconciler and reads template files from configDir.
-func NewUserReconciler(client client.Client, scheme *runtime.Scheme, log logr.Logger, almondConfig *config.AlmondConfig, configDir string) *UserReconciler {
-	r := &UserReconciler{
-		Client:       client,
-		Scheme:       scheme,
-		Log:          log,
-		almondConfig: almondConfig,
-		localCache:   make(map[string]CacheEntry),
-	}
-	if err := ReadJSONFile(path.Join(configDir, "developer-deployment.json"), &r.developerDeploymentTemplate); err != nil {
+func NewUserReconciler(client client.Client, scheme *runtime.Scheme, log logr.Logger, recorder record.EventRecorder,
+	almondConfig *config.AlmondConfig, configDir string) *UserReconciler {
+	engines, err := NewHTTPEngineClient(configDir, almondConfig.EngineAPISigningKey,
+		almondConfig.EngineAPIAllowUnsigned, log)
+	if err != nil {
 		logging.Fatal(err)
 	}
-	if err := ReadJSONFile(path.Join(configDir, "developer-service.json"), &r.developerServiceTemplate); err != nil {
+	r := newUserReconciler(client, scheme, log, recorder, almondConfig, engines, sqlUserLookup{})
+	templates, err := readTemplates(configDir)
+	if err != nil {
 		logging.Fatal(err)
 	}
+	r.setTemplates(templates)
+	r.configDir = configDir
 	return r
 }
 
+// newUserReconciler initializes a UserReconciler talking to backends through engines
+// and reading users through users.
+func newUserReconciler(client client.Client, scheme *runtime.Scheme, log logr.Logger, recorder record.EventRecorder,
+	almondConfig *config.AlmondConfig, engines EngineClient, users UserLookup) *UserReconciler {
+	return &UserReconciler{
+		Client:       client,
+		Scheme:       scheme,
+		Log:          log,
+		Recorder:     recorder,
+		almondConfig: almondConfig,
+		cache: newUserCache(almondConfig.UserCacheSize,
+			time.Duration(almondConfig.UserCacheTTLSeconds)*time.Second),
+		loads:  newLoadTracker(),
+		drains: newDrainTracker(),
+		starts: newStartLimiter(almondConfig.BackendMaxConcurrentStarts,
+			time.Duration(almondConfig.EngineStartTimeoutSeconds)*time.Second),
+		warnings:     newWarningThrottle(),
+		rollouts:     newRolloutLimiter(almondConfig.DeploymentRolloutRate),
+		statuses:     newEngineStatusCache(),
+		statusEvents: make(chan event.GenericEvent),
+		engines:      engines,
+		users:        users,
+	}
+}
+
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 // For more details, check Reconcile and its Result here:
@@ -151,153 +218,285 @@ func (r *UserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		err           error
 		userID        int64
 		developer     bool
+		mode          string
 		user          *backendv1.User
 		stop          bool
 		result        ctrl.Result
 		currentStatus backendv1.UserStatus
+		failedChecked bool
 	)
 
 	defer func() {
+		if user != nil && !failedChecked {
+			keepFailed(user, &currentStatus)
+		}
+		if r.drains.releaseMove(userID) && user != nil {
+			// the user did not leave its draining backend, it moves on a later reconcile
+			currentStatus.Backend = user.Status.Backend
+		}
 		if user != nil {
-			if len(user.Spec.Mode) == 0 {
-				if r.almondConfig.EnableDeveloperBackend && developer {
-					user.Spec.Mode = "developer"
-				} else {
-					user.Spec.Mode = "shared"
-				}
-				if err = r.Update(ctx_outer, user); err != nil {
-					r.Log.Error(err, "failed to update user mode")
-				}
+			if err != nil {
+				r.warning(user, EventReconcileError, err.Error())
+			} else if currentStatus.State == Error {
+				r.warning(user, EventReconcileError, currentStatus.LastError)
+			} else if currentStatus.State == Failed {
+				r.warning(user, EventEngineFailed, currentStatus.LastError)
 			}
+			currentStatus.Mode = mode
+			finalizeStatus(user, &currentStatus)
 			user.Status = currentStatus
 			r.Log.Info("updating status:", "user", user.Spec.ID, "status", user.Status)
 			if err = r.Status().Update(ctx_outer, user); err != nil {
 				r.Log.Error(err, "failed to update user status")
+			} else {
+				r.reportDrainProgress(ctx_outer, req.Namespace, userID, user.Status.Backend, user.Status.MigratingFrom)
+			}
+			if startFinished(user.Status.State) {
+				r.starts.release(userID)
 			}
+		} else if stop {
+			// the user is gone
+			r.reportDrainProgress(ctx_outer, req.Namespace, userID)
+			r.starts.release(userID)
 		}
 		r.Log.Info("--- end ---")
 	}()
 
-	userID, developer, err = r.getUserFromName(req.Name)
+	var found *backendv1.User
+	userID, found, developer, err = r.getUserFromName(ctx, req)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if r.almondConfig.EnableDeveloperBackend && developer {
-		user, currentStatus, stop, result, err = r.handleDeveloper(ctx, req, userID)
+	mode = r.userMode(found, developer)
+	if mode != backendv1.UserModeShared {
+		user, currentStatus, stop, result, err = r.handleDeployment(ctx, req, found, userID, mode)
 	} else {
-		user, currentStatus, stop, result, err = r.handleSharedUser(ctx, req, userID)
+		user, currentStatus, stop, result, err = r.handleSharedUser(ctx, req, found, userID)
 	}
 	if err != nil || stop {
 		return result, err
 	}
 
+	currentStatus.MigratingFrom = user.Status.MigratingFrom
+	currentStatus.MigrationStarted = user.Status.MigrationStarted
+	failedChecked = true
+	if user.Status.State == Failed && currentStatus.State != Running && currentStatus.State != Idle {
+		if !retryRequested(user) {
+			// the failed engine does not run, it can leave a draining backend right away
+			r.drains.moveStarted(userID)
+			currentStatus.State = Failed
+			return ctrl.Result{}, nil
+		}
+		r.event(user, EventEngineRetry, "Starting the engine again after it failed")
+		if err = r.resetFailures(ctx, user, &currentStatus); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	migrated := false
 	if len(user.Status.Backend) > 0 && user.Status.Backend != currentStatus.Backend {
-		// backend url has changed, kill the old backend
+		// backend url has changed, migrate the engine off the old backend
 		r.Log.Info("backends changed:", "user", user.Spec.ID, "old", user.Status.Backend, "new", currentStatus.Backend)
-		if err = r.killEngine(ctx, userID, user.Status.Backend); err != nil {
-			r.Log.Error(err, "kill old engine failed")
+		r.event(user, EventBackendAssigned, "Moving engine from %s to %s", user.Status.Backend, currentStatus.Backend)
+		migrated = r.startMigration(ctx, userID, user.Status.Backend, &currentStatus)
+		r.drains.moveStarted(userID)
+	} else if len(user.Status.Backend) == 0 && len(currentStatus.Backend) > 0 {
+		r.event(user, EventBackendAssigned, "Assigned backend %s", currentStatus.Backend)
+	}
+	if len(currentStatus.MigratingFrom) > 0 {
+		if !r.continueMigration(ctx, userID, &currentStatus) {
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 		}
+		migrated = true
 	}
 
-	if UserState(currentStatus.State) == Running {
-		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	if currentStatus.State == Running {
+		r.recordRunning(&currentStatus)
+		if mode != backendv1.UserModeShared {
+			return ctrl.Result{RequeueAfter: r.engineStatusPoll()}, nil
+		}
+		// the status poller enqueues shared users whose engine changes state
+		return ctrl.Result{RequeueAfter: r.drainRequeue(currentStatus.Backend, wait.Jitter(kEngineStatusResync, 0.2))}, nil
+	}
+
+	if currentStatus.State == Idle {
+		var policy idlePolicy
+		if policy, err = r.idlePolicy(user); err != nil {
+			return ctrl.Result{}, err
+		}
+		if keep, recheck := keepIdleEngine(user, &currentStatus, policy); keep {
+			return ctrl.Result{RequeueAfter: r.drainRequeue(currentStatus.Backend, recheck)}, nil
+		}
+		r.Log.Info("shut down idle engine:", "user", user.Spec.ID)
+		if err = r.shutdownIdleEngine(ctx, req, user, &currentStatus, mode != backendv1.UserModeShared); err != nil {
+			setError(&currentStatus, err)
+			err = nil
+			return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+		}
+		return ctrl.Result{}, nil
 	}
 
-	if UserState(currentStatus.State) == Idle {
-		r.Log.Info("delete idle engine:", "user", user.Spec.ID)
-		if err = r.killEngine(ctx, userID, currentStatus.Backend); err != nil {
-			r.Log.Error(err, "kill idle engine failed")
+	if currentStatus.NextRetryTime != nil {
+		if backoff := time.Until(currentStatus.NextRetryTime.Time); backoff > 0 {
+			currentStatus.State = Error
+			return ctrl.Result{RequeueAfter: backoff}, nil
 		}
-		return ctrl.Result{}, r.Client.Delete(ctx, user)
+	}
+	if !migrated && user.Status.Backend == currentStatus.Backend && currentStatus.State == Stopped &&
+		(user.Status.State == Starting || user.Status.State == Migrating || user.Status.State == Running) {
+		// the engine was started on this backend and is gone
+		if backoff, retry := r.recordFailure(&currentStatus, errors.New("engine stopped unexpectedly")); retry {
+			return ctrl.Result{RequeueAfter: backoff}, nil
+		}
+		return ctrl.Result{}, nil
 	}
 
-	if err = r.runEngine(ctx, user.Spec.ID, currentStatus.Backend); err != nil {
-		currentStatus.State = err.Error()
-		return ctrl.Result{RequeueAfter: 2 * time.Second}, nil
+	if err = r.runEngine(ctx, user, currentStatus.Backend); errors.Is(err, errBackendBusy) {
+		currentStatus.State = Pending
+		err = nil
+		return ctrl.Result{RequeueAfter: wait.Jitter(1*time.Second, 1.0)}, nil
+	} else if err != nil {
+		backoff, retry := r.recordFailure(&currentStatus, err)
+		if retry {
+			return ctrl.Result{RequeueAfter: backoff}, nil
+		}
+		err = nil
+		return ctrl.Result{}, nil
+	}
+	r.event(user, EventEngineStarted, "Started engine on %s", currentStatus.Backend)
+	currentStatus.NextRetryTime = nil
+	currentStatus.State = Starting
+	if migrated {
+		currentStatus.State = Migrating
 	}
-	currentStatus.State = string(Starting)
 	return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
 }
 
-func (r *UserReconciler) getUserFromName(name string) (uid int64, developer bool, err error) {
-	uid, err = strconv.ParseInt(strings.TrimPrefix(name, "user-"), 10, 64)
+// getUserFromName returns the id of the user reconciled, its User, nil if it was deleted,
+// and whether the user is a developer.
+func (r *UserReconciler) getUserFromName(ctx context.Context, req ctrl.Request) (uid int64, user *backendv1.User, developer bool, err error) {
+	uid, err = strconv.ParseInt(strings.TrimPrefix(req.Name, "user-"), 10, 64)
 	if err != nil {
 		return
 	}
-	v, err := r.getDBEntry("user", uid, getUser, true)
+	user = &backendv1.User{}
+	if err = r.Get(ctx, req.NamespacedName, user); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return
+		}
+		user = nil
+	}
+	version := cacheVersion(user)
+	if user != nil {
+		// a User deleted to stop or restart its engine keeps its entries
+		r.cache.syncVersion(uid, version)
+	}
+	v, err := r.getDBEntry("user", uid, version, getUser, true)
 	if err != nil {
 		return
 	}
-	user := v.(*sql.User)
-	if user.DeveloperOrg != nil {
+	if v.(*sql.User).DeveloperOrg != nil {
 		developer = true
 	}
 	return
 }
 
-func (r *UserReconciler) handleDeveloper(ctx context.Context, req ctrl.Request,
-	userID int64) (user *backendv1.User, currentStatus backendv1.UserStatus, stop bool, result ctrl.Result, err error) {
-	user = &backendv1.User{}
-	// for developer users, make sure deployment and service are up before proceeding.
-	if err = r.Client.Get(ctx, req.NamespacedName, user); err != nil {
-		if apierrors.IsNotFound(err) {
-			if err = r.deleteDeploymentService(ctx, req, userID); err != nil {
-				r.Log.Error(err, "fail to delete developer deployment or service")
-			}
+func (r *UserReconciler) handleDeployment(ctx context.Context, req ctrl.Request, found *backendv1.User, userID int64,
+	mode string) (user *backendv1.User, currentStatus backendv1.UserStatus, stop bool, result ctrl.Result, err error) {
+	// for users with their own deployment, make sure deployment and service are up before proceeding.
+	if found == nil {
+		r.warnings.forget(req.NamespacedName)
+		if err = r.deleteDeploymentService(ctx, req, userID); err != nil {
+			r.Log.Error(err, "fail to delete user deployment or service")
 		}
+		err = nil
 		stop = true
-		user = nil
 		return
 	}
+	user = found
+	carryOverFailures(user, &currentStatus)
 	if !user.ObjectMeta.DeletionTimestamp.IsZero() {
 		// user is marked for deletion
-		currentStatus.State = string(Stopping)
-		if err = r.deleteDeploymentService(ctx, req, userID); err != nil {
-			r.Log.Error(err, "fail to delete developer deployment or service marked for deletion")
-		}
 		stop = true
+		if r.finalizeUser(ctx, req, user, &currentStatus, true) {
+			user = nil
+			return
+		}
+		result = ctrl.Result{RequeueAfter: 2 * time.Second}
+		return
+	}
+	if err = r.ensureFinalizer(ctx, user); err != nil {
+		return
+	}
+	if stop, err = r.handleSuspension(ctx, req, user, &currentStatus, true); stop {
+		result = suspensionResult(&currentStatus, err)
+		err = nil
+		return
+	}
+	if stop, err = r.handleIdleShutdown(ctx, user, &currentStatus); stop {
 		return
 	}
+	// the deployment and service are owned by the user, changes to their status
+	// trigger a reconcile so there is no need to poll while they come up.
 	deployment := &appsv1.Deployment{}
 	if err = r.Client.Get(ctx, req.NamespacedName, deployment); err != nil {
 		if apierrors.IsNotFound(err) {
-			if err = r.createDeployment(ctx, req.Name, req.Namespace); err != nil {
+			if err = r.createDeployment(ctx, user, mode); err != nil {
 				return
 			}
+			r.event(user, EventDeploymentCreated, "Created %s deployment %s", mode, req.Name)
 			stop = true
-			result = ctrl.Result{RequeueAfter: 2 * time.Second}
-			// setting err to nil so ControllerManager will respect the RequeueAfter time
-			err = nil
 			return
 		}
 		return
 	}
-	if deployment.Status.AvailableReplicas <= 0 {
-		currentStatus.State = string(Starting)
+	if err = r.adopt(ctx, user, deployment); err != nil {
+		return
+	}
+	if err = r.syncDeployment(ctx, user, mode, deployment); err != nil {
+		return
+	}
+	if deployment.Status.AvailableReplicas <= 0 || deploymentRolling(deployment) {
+		currentStatus.State = Starting
 		stop = true
-		result = ctrl.Result{RequeueAfter: 2 * time.Second}
+		var crash error
+		if crash, err = r.crashLoopError(ctx, deployment); err != nil || crash == nil {
+			return
+		}
+		if user.Status.State == Failed {
+			if !retryRequested(user) {
+				return
+			}
+			r.event(user, EventEngineRetry, "Starting the engine again after it failed")
+			if err = r.resetFailures(ctx, user, &currentStatus); err != nil {
+				return
+			}
+		}
+		result = r.recordCrashLoop(&currentStatus, crash)
 		return
 	}
 	service := &corev1.Service{}
 	if err = r.Client.Get(ctx, req.NamespacedName, service); err != nil {
 		if apierrors.IsNotFound(err) {
-			if err = r.createService(ctx, req.Name, req.Namespace); err != nil {
+			if err = r.createService(ctx, user, mode); err != nil {
 				return
 			}
-			currentStatus.State = string(Starting)
+			r.event(user, EventServiceCreated, "Created %s service %s", mode, req.Name)
+			currentStatus.State = Starting
 			stop = true
-			result = ctrl.Result{RequeueAfter: 2 * time.Second}
-			err = nil
 			return
 		}
 		return
 	}
+	if err = r.adopt(ctx, user, service); err != nil {
+		return
+	}
+	if err = r.syncService(ctx, user, mode, service); err != nil {
+		return
+	}
 	if len(service.Spec.ClusterIP) == 0 {
-		currentStatus.State = string(Starting)
+		currentStatus.State = Starting
 		stop = true
-		result = ctrl.Result{RequeueAfter: 2 * time.Second}
-		err = nil
 		return
 	}
 	if len(service.Spec.Ports) == 0 {
@@ -306,9 +505,9 @@ func (r *UserReconciler) handleDeveloper(ctx context.Context, req ctrl.Request,
 	}
 	currentStatus.Backend = fmt.Sprintf("http://%s:%d", service.Spec.ClusterIP, service.Spec.Ports[0].Port)
 
-	engineStatus, err := r.engineStatus(ctx, userID, currentStatus.Backend)
+	engineStatus, err := r.engines.EngineStatus(ctx, currentStatus.Backend, userID)
 	if err != nil {
-		currentStatus.State = err.Error()
+		setError(&currentStatus, err)
 		if isDialError(err) {
 			stop = true
 			err = nil
@@ -317,34 +516,62 @@ func (r *UserReconciler) handleDeveloper(ctx context.Context, req ctrl.Request,
 		}
 		return
 	}
-	currentStatus.State = string(engineStatus)
+	currentStatus.State = engineStatus
 	return
 }
 
-func (r *UserReconciler) handleSharedUser(ctx context.Context, req ctrl.Request,
+func (r *UserReconciler) handleSharedUser(ctx context.Context, req ctrl.Request, found *backendv1.User,
 	userID int64) (user *backendv1.User, currentStatus backendv1.UserStatus, stop bool, result ctrl.Result, err error) {
 
-	var userErr error
-	backendUser := &backendv1.User{}
 	// A non-nil User is required to update the user state (see the defer func in Reconcile). Thus, we get the
-	// backendUser at the start.  If any error occurs such as an non-existing backend, it will be propagated to User CR.
-	// The handling of userErr is deferred later because it depends the engine status and backend url.
-	if userErr = r.Client.Get(ctx, req.NamespacedName, backendUser); userErr == nil {
-		user = backendUser
+	// User at the start.  If any error occurs such as an non-existing backend, it will be propagated to User CR.
+	if found == nil {
+		r.warnings.forget(req.NamespacedName)
+		stop = true
+		err = r.killOrphanEngine(ctx, req.Namespace, userID)
+		return
+	}
+	user = found
+	carryOverFailures(user, &currentStatus)
+	if !user.ObjectMeta.DeletionTimestamp.IsZero() {
+		// object is marked for deletion
+		stop = true
+		if r.finalizeUser(ctx, req, user, &currentStatus, false) {
+			user = nil
+			return
+		}
+		result = ctrl.Result{RequeueAfter: 2 * time.Second}
+		return
+	}
+	if err = r.ensureFinalizer(ctx, user); err != nil {
+		return
+	}
+	if stop, err = r.handleSuspension(ctx, req, user, &currentStatus, false); stop {
+		result = suspensionResult(&currentStatus, err)
+		err = nil
+		return
+	}
+	if stop, err = r.handleIdleShutdown(ctx, user, &currentStatus); stop {
+		return
+	}
+	if err = r.removeOldDeployment(ctx, req, user); err != nil {
+		return
 	}
 
-	currentStatus.Backend, err = r.getSharedBackendURL(ctx, req.Namespace, userID)
+	currentStatus.Backend, err = r.getSharedBackendURL(ctx, req.Namespace, userID, user)
 	if err != nil {
-		currentStatus.State = err.Error()
+		// keep the engine where it is, the placement is retried
+		currentStatus.Backend = user.Status.Backend
+		setError(&currentStatus, err)
 		result = ctrl.Result{RequeueAfter: 2 * time.Second}
 		stop = true
 		err = nil
 		return
 	}
 
-	engineStatus, err := r.engineStatus(ctx, userID, currentStatus.Backend)
+	engineStatus, err := r.cachedEngineStatus(ctx, user, userID, currentStatus.Backend)
 	if err != nil {
-		currentStatus.State = err.Error()
+		setError(&currentStatus, err)
 		if isDialError(err) {
 			stop = true
 			err = nil
@@ -353,147 +580,120 @@ func (r *UserReconciler) handleSharedUser(ctx context.Context, req ctrl.Request,
 		}
 		return
 	}
-	currentStatus.State = string(engineStatus)
-
-	if userErr != nil {
-		err = userErr
-		if apierrors.IsNotFound(userErr) {
-			// User is already deleted, kill engine if it's still running.
-			if engineStatus == Running || engineStatus == Idle {
-				r.Log.Info("kill engine for already deleted user:", "user", userID)
-				if err := r.killEngine(ctx, userID, currentStatus.Backend); err != nil {
-					r.Log.Error(err, "failed to kill engine", "user", userID)
-				}
-			}
-			err = nil
-			stop = true
-		}
-		return
-	}
+	currentStatus.State = engineStatus
+	return
+}
 
-	if !user.ObjectMeta.DeletionTimestamp.IsZero() {
-		// object is marked for deletion
-		if engineStatus == Running || engineStatus == Idle {
-			r.Log.Info("kill engine for user marked for deletion:", "user", userID)
-			if err = r.killEngine(ctx, userID, currentStatus.Backend); err != nil {
-				r.Log.Error(err, "fail to kill engine marked for deletion")
-			}
+// killOrphanEngine kills the engine of a User deleted without the finalizer. Placement
+// depends on backend load at the time the engine started, so the backend of the engine
+// is unknown and every ready backend is asked.
+func (r *UserReconciler) killOrphanEngine(ctx context.Context, namespace string, userID int64) error {
+	endpoints := &corev1.Endpoints{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: kSharedBackend}, endpoints); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	var lastErr error
+	for _, b := range sharedBackendEndpoints(endpoints) {
+		state, err := r.engines.EngineStatus(ctx, b.URL, userID)
+		if err == nil && state != Running && state != Idle {
+			continue
+		}
+		if err == nil {
+			r.Log.Info("kill engine for already deleted user:", "user", userID, "backend", b.URL)
+			err = r.engines.KillEngine(ctx, b.URL, userID)
+		}
+		if err != nil && !isDialError(err) {
+			r.Log.Error(err, "failed to kill engine", "user", userID, "backend", b.URL)
+			lastErr = err
 		}
-		stop = true
-		return
 	}
-	return
+	return lastErr
 }
 
-func (r *UserReconciler) getSharedBackendURL(ctx context.Context, namespace string, uid int64) (urlStr string, err error) {
+func (r *UserReconciler) getSharedBackendURL(ctx context.Context, namespace string, uid int64, user *backendv1.User) (urlStr string, err error) {
 	endpoints := &corev1.Endpoints{}
 	// fetch backend endpoints.
-	if err = r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "shared-backend"}, endpoints); err != nil {
+	if err = r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: kSharedBackend}, endpoints); err != nil {
 		return
 	}
-	// StatefulSet endpoints are always ordered by name.
-	var backendURLs []string
-	for _, subset := range endpoints.Subsets {
-		for _, addr := range subset.Addresses {
-			u := fmt.Sprintf("http://%s:%d", addr.IP, subset.Ports[0].Port)
-			backendURLs = append(backendURLs, u)
-		}
-	}
-	if len(backendURLs) == 0 {
-		err = fmt.Errorf("backend endpoints not found")
-	} else {
-		urlStr = backendURLs[uid%int64(len(backendURLs))]
-	}
+	backends := sharedBackendEndpoints(endpoints)
+	r.markDrainingBackends(ctx, namespace, backends)
+	urlStr, err = r.pickSharedBackend(ctx, uid, user.Status.Backend, backends)
 	return
 }
 
-func (r *UserReconciler) createDeployment(ctx context.Context, name, namespace string) error {
-	deployment := NewDeployment(&r.developerDeploymentTemplate, name, namespace)
-	if err := r.Client.Create(ctx, deployment); err != nil {
+func (r *UserReconciler) createDeployment(ctx context.Context, user *backendv1.User, mode string) error {
+	deployment, err := r.desiredDeployment(user, mode)
+	if err != nil {
 		return err
 	}
-	return nil
+	return r.Client.Create(ctx, deployment)
 }
 
-func (r *UserReconciler) createService(ctx context.Context, name, namespace string) error {
-	service := NewService(&r.developerServiceTemplate, name, namespace)
-	if err := r.Client.Create(ctx, service); err != nil {
+func (r *UserReconciler) createService(ctx context.Context, user *backendv1.User, mode string) error {
+	service, err := r.desiredService(user, mode)
+	if err != nil {
 		return err
 	}
-	return nil
+	return r.Client.Create(ctx, service)
 }
 
-func (r *UserReconciler) getDBEntry(keyPrefix string, userID int64, fn dbQueryFunc, useCache bool) (interface{}, error) {
-	cacheKey := fmt.Sprintf("%s-%d", keyPrefix, userID)
-	cacheEntry, ok := r.localCache[cacheKey]
-	if useCache && ok && cacheEntry.Expiration.After(time.Now()) {
-		return cacheEntry.Value, nil
+// adopt sets the user as the controller of a deployment or service created before
+// resources had owner references.
+func (r *UserReconciler) adopt(ctx context.Context, user *backendv1.User, obj client.Object) error {
+	if metav1.GetControllerOf(obj) != nil {
+		return nil
 	}
-	db := sql.GetDB()
-	v, err := fn(db, userID)
-	if err != nil {
-		return nil, err
+	if err := ctrl.SetControllerReference(user, obj, r.Scheme); err != nil {
+		return err
 	}
-	r.localCache[cacheKey] = CacheEntry{v, time.Now().Add(kDefaultCacheDuration)}
-	return v, nil
-}
-
-func getUser(db *gorm.DB, userID int64) (interface{}, error) {
-	return sql.GetUser(db, userID)
+	return r.Client.Update(ctx, obj)
 }
 
-func getDeveloperKey(db *gorm.DB, userID int64) (interface{}, error) {
-	return sql.GetDeveloperKey(db, userID)
+// cacheVersion returns the cache version annotation the frontend bumps when it changes
+// the database row of a user, empty for a deleted User.
+func cacheVersion(user *backendv1.User) string {
+	if user == nil {
+		return ""
+	}
+	return user.Annotations[kCacheVersionAnnotation]
 }
 
-func (r *UserReconciler) httpWithContext(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
-	r.Log.Info(fmt.Sprintf("HTTP %v url:%v", method, url))
-	req, err := http.NewRequestWithContext(ctx, method, url, body)
+func (r *UserReconciler) getDBEntry(keyPrefix string, userID int64, version string, fn dbQueryFunc, useCache bool) (interface{}, error) {
+	if useCache {
+		if v, ok := r.cache.get(keyPrefix, userID); ok {
+			return v, nil
+		}
+	}
+	v, err := fn(r.users, userID)
 	if err != nil {
 		return nil, err
 	}
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
-	}
-	resp, err := http.DefaultClient.Do(req)
-	return resp, err
+	r.cache.set(keyPrefix, userID, version, v)
+	return v, nil
 }
 
-func (r *UserReconciler) engineStatus(ctx context.Context, userID int64, userURL string) (UserState, error) {
-	resp, err := r.httpWithContext(ctx, "GET", fmt.Sprintf("%s/engine-status?userid=%d", userURL, userID), nil)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Failed to get engine status: %+v", resp)
-	}
-	jsonResponse := &JSONResponse{Data: ""}
-	if err := json.NewDecoder(resp.Body).Decode(jsonResponse); err != nil {
-		return "", err
-	}
-	r.Log.Info("engine status:", "user", userID, "resp", jsonResponse)
-	return UserState(jsonResponse.Data.(string)), nil
+func getUser(users UserLookup, userID int64) (interface{}, error) {
+	return users.GetUser(userID)
 }
 
-func (r *UserReconciler) killEngine(ctx context.Context, userID int64, backendURL string) error {
-	resp, err := r.httpWithContext(ctx, "GET", fmt.Sprintf("%s/kill-engine?userid=%d", backendURL, userID), nil)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed killEngine http status: %+v", resp)
-	}
-	return nil
+func getDeveloperKey(users UserLookup, userID int64) (interface{}, error) {
+	return users.GetDeveloperKey(userID)
+}
+
+func hasAutomations(users UserLookup, userID int64) (interface{}, error) {
+	return users.HasAutomations(userID)
 }
 
-func (r *UserReconciler) runEngine(ctx context.Context, userID int64, userURL string) error {
-	v, err := r.getDBEntry("user", userID, getUser, false)
+func (r *UserReconciler) runEngine(ctx context.Context, user *backendv1.User, userURL string) error {
+	userID := user.Spec.ID
+	version := cacheVersion(user)
+	v, err := r.getDBEntry("user", userID, version, getUser, false)
 	if err != nil {
 		return err
 	}
 	u := v.(*sql.User)
-	v, err = r.getDBEntry("developer-key", userID, getDeveloperKey, false)
+	v, err = r.getDBEntry("developer-key", userID, version, getDeveloperKey, false)
 	if err != nil {
 		return err
 	}
@@ -504,21 +704,21 @@ func (r *UserReconciler) runEngine(ctx context.Context, userID int64, userURL st
 		return err
 	}
 
-	options := platformOptions(u, developerKey, config.GetAlmondConfig().DatabaseProxyURL, token)
-
-	b, err := json.Marshal(options)
+	policy, err := r.idlePolicy(user)
 	if err != nil {
 		return err
 	}
-	resp, err := r.httpWithContext(ctx, "POST", fmt.Sprintf("%s/run-engine", userURL), bytes.NewReader(b))
-	if err != nil {
-		return err
+	options := platformOptions(u, developerKey, r.almondConfig.DatabaseProxyURL, token)
+	options.IdleTimeoutMillis = policy.timeout.Milliseconds()
+	options.AlwaysOn = policy.alwaysOn
+	if !r.starts.tryAcquire(userURL, userID, time.Now()) {
+		return errBackendBusy
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed runEngine http status: %+v", resp)
+	// the slot is held until the engine reports running, see Reconcile
+	if err := r.engines.RunEngine(ctx, userURL, options); err != nil {
+		r.starts.release(userID)
+		return err
 	}
-
 	return nil
 }
 
@@ -561,7 +761,7 @@ func (r *UserReconciler) deleteService(ctx context.Context, req ctrl.Request, us
 	}
 	if len(service.Spec.ClusterIP) > 0 && len(service.Spec.Ports) > 0 {
 		backend := fmt.Sprintf("http://%s:%d", service.Spec.ClusterIP, service.Spec.Ports[0].Port)
-		if err := r.killEngine(ctx, userID, backend); err != nil {
+		if err := r.engines.KillEngine(ctx, backend, userID); err != nil {
 			r.Log.Error(err, "kill engine failed")
 		}
 	}
@@ -573,7 +773,25 @@ func (r *UserReconciler) deleteService(ctx context.Context, req ctrl.Request, us
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *UserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(&statusPoller{r: r, events: r.statusEvents}); err != nil {
+		return err
+	}
+	if len(r.configDir) > 0 {
+		if err := mgr.Add(&templateWatcher{r: r, events: r.statusEvents}); err != nil {
+			return err
+		}
+	}
 	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.controllerOptions()).
 		For(&backendv1.User{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Watches(&source.Kind{Type: &corev1.Endpoints{}},
+			handler.EnqueueRequestsFromMapFunc(r.usersForEndpoints),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isSharedBackendEndpoints))).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(r.usersForDrainingPod),
+			builder.WithPredicates(drainAnnotationChanged)).
+		Watches(&source.Channel{Source: r.statusEvents}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
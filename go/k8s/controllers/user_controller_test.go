@@ -0,0 +1,457 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"almond-cloud/config"
+	backendv1 "almond-cloud/k8s/api/v1"
+	"almond-cloud/sql"
+)
+
+// reconcileTest runs the reconciler against a fake client and a fake backend
+type reconcileTest struct {
+	t       *testing.T
+	ctx     context.Context
+	c       client.Client
+	r       *UserReconciler
+	backend *fakeBackend
+}
+
+func newReconcileTest(t *testing.T, almondConfig *config.AlmondConfig, users UserLookup, objs ...client.Object) *reconcileTest {
+	scheme := newTestScheme(t)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	backend := newFakeBackend()
+	r := newUserReconciler(c, scheme, logr.Discard(), record.NewFakeRecorder(100), almondConfig, backend, users)
+	return &reconcileTest{t: t, ctx: context.Background(), c: c, r: r, backend: backend}
+}
+
+func (rt *reconcileTest) reconcile(userID int64) ctrl.Result {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: userName(userID)}}
+	result, err := rt.r.Reconcile(rt.ctx, req)
+	require.NoError(rt.t, err)
+	return result
+}
+
+// user returns the User, or nil once it is deleted
+func (rt *reconcileTest) user(userID int64) *backendv1.User {
+	user := &backendv1.User{}
+	err := rt.c.Get(rt.ctx, types.NamespacedName{Namespace: "default", Name: userName(userID)}, user)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	require.NoError(rt.t, err)
+	return user
+}
+
+// expireBackoff moves the next retry of a failed engine to now
+func (rt *reconcileTest) expireBackoff(userID int64) {
+	user := rt.user(userID)
+	require.NotNil(rt.t, user.Status.NextRetryTime)
+	past := metav1.NewTime(time.Now().Add(-time.Second))
+	user.Status.NextRetryTime = &past
+	require.NoError(rt.t, rt.c.Status().Update(rt.ctx, user))
+}
+
+func testUser(userID int64, backend string, state UserState) *backendv1.User {
+	return &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(userID), Namespace: "default"},
+		Spec:       backendv1.UserSpec{ID: userID},
+		Status:     backendv1.UserStatus{Backend: backend, State: state},
+	}
+}
+
+func sharedBackends(ips ...string) *corev1.Endpoints {
+	var addresses []corev1.EndpointAddress
+	for _, ip := range ips {
+		addresses = append(addresses, corev1.EndpointAddress{IP: ip})
+	}
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: kSharedBackend, Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: addresses,
+			Ports:     []corev1.EndpointPort{{Port: 8100}},
+		}},
+	}
+}
+
+func TestReconcileSharedUser(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}},
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+
+	// the engine is started on the only backend
+	rt.reconcile(1)
+	user := rt.user(1)
+	require.Equal(t, backend, user.Status.Backend)
+	require.Equal(t, Starting, user.Status.State)
+	require.Equal(t, "shared", user.Status.Mode)
+	require.True(t, controllerutil.ContainsFinalizer(user, kUserFinalizer))
+	require.Equal(t, []string{backend + " 1"}, rt.backend.callsTo("run-engine"))
+
+	rt.reconcile(1)
+	result := rt.reconcile(1)
+	require.Equal(t, Running, rt.user(1).Status.State)
+	require.Greater(t, int64(result.RequeueAfter), int64(0))
+
+	// an idle engine is killed and its User kept Stopped
+	rt.backend.setState(backend, 1, Idle)
+	rt.reconcile(1)
+	require.Equal(t, Stopped, rt.backend.state(backend, 1))
+	user = rt.user(1)
+	require.True(t, user.DeletionTimestamp.IsZero())
+	require.Equal(t, Stopped, user.Status.State)
+}
+
+func TestReconcileBackendChange(t *testing.T) {
+	const (
+		oldBackend = "http://10.0.0.1:8100"
+		newBackend = "http://10.0.0.2:8100"
+	)
+	user := testUser(1, oldBackend, Running)
+	user.Finalizers = []string{kUserFinalizer}
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends("10.0.0.2"), user)
+	rt.backend.setState(oldBackend, 1, Running)
+
+	// the engine is drained off the old backend before it starts on the new one
+	rt.reconcile(1)
+	require.Equal(t, []string{oldBackend + " 1"}, rt.backend.callsTo("drain-engine"))
+	require.Equal(t, []string{newBackend + " 1"}, rt.backend.callsTo("run-engine"))
+	user = rt.user(1)
+	require.Equal(t, newBackend, user.Status.Backend)
+	require.Equal(t, Migrating, user.Status.State)
+	require.Empty(t, user.Status.MigratingFrom)
+}
+
+func TestReconcileOrphanEngine(t *testing.T) {
+	backends := []string{"http://10.0.0.1:8100", "http://10.0.0.2:8100", "http://10.0.0.3:8100"}
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}},
+		sharedBackends("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	// the User was deleted without the finalizer, its engine runs wherever it was placed
+	for _, b := range backends {
+		rt.backend.setState(b, 1, Running)
+		rt.reconcile(1)
+		require.Equal(t, Stopped, rt.backend.state(b, 1), b)
+	}
+	require.Len(t, rt.backend.callsTo("kill-engine"), len(backends))
+
+	// backends that are down are skipped
+	rt.backend.setDown(backends[0], true)
+	rt.backend.setState(backends[1], 1, Idle)
+	rt.reconcile(1)
+	require.Equal(t, Stopped, rt.backend.state(backends[1], 1))
+}
+
+func TestReconcilePlacementFailure(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	user := testUser(1, backend, Running)
+	user.Finalizers = []string{kUserFinalizer}
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends(), user)
+
+	// no backend is ready, the user keeps its backend until placement succeeds
+	result := rt.reconcile(1)
+	require.Greater(t, int64(result.RequeueAfter), int64(0))
+	user = rt.user(1)
+	require.Equal(t, Error, user.Status.State)
+	require.Equal(t, backend, user.Status.Backend)
+	require.Empty(t, rt.backend.callsTo("run-engine"))
+}
+
+func TestReconcileBackendFailures(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}},
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+
+	rt.backend.setDown(backend, true)
+	result := rt.reconcile(1)
+	require.Greater(t, int64(result.RequeueAfter), int64(0))
+	user := rt.user(1)
+	require.Equal(t, Error, user.Status.State)
+	require.Contains(t, user.Status.LastError, "dial tcp")
+
+	rt.backend.setDown(backend, false)
+	rt.backend.fail("run-engine", errors.New("out of memory"))
+	rt.reconcile(1)
+	require.Equal(t, Error, rt.user(1).Status.State)
+	require.Contains(t, rt.user(1).Status.LastError, "out of memory")
+
+	// the engine is started again once the backoff is over
+	rt.backend.fail("run-engine", nil)
+	rt.reconcile(1)
+	require.Equal(t, Error, rt.user(1).Status.State)
+	require.Empty(t, rt.backend.callsTo("run-engine")[1:])
+	rt.expireBackoff(1)
+	rt.reconcile(1)
+	require.Equal(t, Starting, rt.user(1).Status.State)
+	require.Nil(t, rt.user(1).Status.NextRetryTime)
+}
+
+func TestReconcileCrashLoop(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{EngineMaxFailures: 3}, fakeUsers{1: {ID: 1}},
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+
+	// the engine crashes after every start, with growing delays between starts
+	var delays []time.Duration
+	for i := 0; i < 3; i++ {
+		rt.reconcile(1)
+		require.Equal(t, Starting, rt.user(1).Status.State)
+		rt.backend.setState(backend, 1, Stopped)
+		rt.backend.KillEngine(rt.ctx, backend, 1)
+		result := rt.reconcile(1)
+		user := rt.user(1)
+		require.Equal(t, int32(i+1), user.Status.ConsecutiveFailures)
+		if i < 2 {
+			require.Equal(t, Error, user.Status.State)
+			delays = append(delays, result.RequeueAfter)
+			rt.expireBackoff(1)
+		} else {
+			require.Equal(t, Failed, user.Status.State)
+			require.Zero(t, result.RequeueAfter)
+		}
+	}
+	require.Equal(t, []time.Duration{kEngineRetryBaseDelay, 2 * kEngineRetryBaseDelay}, delays)
+	require.Contains(t, rt.user(1).Status.LastError, "giving up")
+	require.Len(t, rt.backend.callsTo("run-engine"), 3)
+
+	// a failed user stays failed
+	rt.reconcile(1)
+	require.Equal(t, Failed, rt.user(1).Status.State)
+	require.Len(t, rt.backend.callsTo("run-engine"), 3)
+
+	// until the retry annotation is set
+	user := rt.user(1)
+	user.Annotations = map[string]string{kRetryAnnotation: "true"}
+	require.NoError(t, rt.c.Update(rt.ctx, user))
+	rt.reconcile(1)
+	user = rt.user(1)
+	require.Equal(t, Starting, user.Status.State)
+	require.Zero(t, user.Status.ConsecutiveFailures)
+	require.NotContains(t, user.Annotations, kRetryAnnotation)
+}
+
+func TestReconcileFailedTransientError(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	failed := testUser(1, backend, Failed)
+	failed.Status.ConsecutiveFailures = 5
+	failed.Status.LastError = "engine failed 5 times, giving up"
+	rt := newReconcileTest(t, &config.AlmondConfig{}, fakeUsers{1: {ID: 1}}, sharedBackends("10.0.0.1"), failed)
+
+	// the backend cannot be reached, the user is still failed
+	rt.backend.setDown(backend, true)
+	rt.reconcile(1)
+	user := rt.user(1)
+	require.Equal(t, Failed, user.Status.State)
+	require.Equal(t, int32(5), user.Status.ConsecutiveFailures)
+	require.Equal(t, "engine failed 5 times, giving up", user.Status.LastError)
+
+	rt.backend.setDown(backend, false)
+	rt.reconcile(1)
+	require.Equal(t, Failed, rt.user(1).Status.State)
+	require.Empty(t, rt.backend.callsTo("run-engine"))
+}
+
+func TestReconcileDeploymentCrashLoop(t *testing.T) {
+	org := 1
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true, EngineMaxFailures: 2},
+		fakeUsers{2: {ID: 2, DeveloperOrg: &org}}, testUser(2, "", ""))
+	key := types.NamespacedName{Namespace: "default", Name: userName(2)}
+
+	// the pod of the deployment keeps crashing, so the deployment never becomes available
+	rt.reconcile(2)
+	deployment := &appsv1.Deployment{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, deployment))
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "user-2-abc", Namespace: "default", Labels: deployment.Spec.Selector.MatchLabels},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:                 "main",
+			RestartCount:         3,
+			State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+		}}},
+	}
+	require.NoError(t, rt.c.Create(rt.ctx, pod))
+
+	result := rt.reconcile(2)
+	user := rt.user(2)
+	require.Equal(t, Error, user.Status.State)
+	require.Equal(t, int32(1), user.Status.ConsecutiveFailures)
+	require.Contains(t, user.Status.LastError, "exit code 1")
+	require.Equal(t, kEngineRetryBaseDelay, result.RequeueAfter)
+
+	// the crash loop counts once per retry delay
+	rt.reconcile(2)
+	require.Equal(t, int32(1), rt.user(2).Status.ConsecutiveFailures)
+	rt.expireBackoff(2)
+	rt.reconcile(2)
+	user = rt.user(2)
+	require.Equal(t, Failed, user.Status.State)
+	require.Equal(t, int32(2), user.Status.ConsecutiveFailures)
+	require.Contains(t, user.Status.LastError, "giving up")
+
+	// the user stays failed while the deployment is not available
+	rt.reconcile(2)
+	user = rt.user(2)
+	require.Equal(t, Failed, user.Status.State)
+	require.Equal(t, int32(2), user.Status.ConsecutiveFailures)
+
+	// until the retry annotation is set
+	user.Annotations = map[string]string{kRetryAnnotation: "true"}
+	require.NoError(t, rt.c.Update(rt.ctx, user))
+	rt.reconcile(2)
+	user = rt.user(2)
+	require.Equal(t, Error, user.Status.State)
+	require.Equal(t, int32(1), user.Status.ConsecutiveFailures)
+	require.NotContains(t, user.Annotations, kRetryAnnotation)
+}
+
+func TestReconcileBackendBusy(t *testing.T) {
+	const backend = "http://10.0.0.1:8100"
+	rt := newReconcileTest(t, &config.AlmondConfig{BackendMaxConcurrentStarts: 1}, fakeUsers{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}},
+		sharedBackends("10.0.0.1"), testUser(1, "", ""), testUser(2, "", ""), testUser(3, "", ""))
+
+	// the engine of user 1 is starting on the backend and holds its only start slot
+	rt.reconcile(1)
+	require.Equal(t, Starting, rt.user(1).Status.State)
+	for i := 0; i < 2; i++ {
+		result := rt.reconcile(2)
+		require.Greater(t, int64(result.RequeueAfter), int64(0))
+		require.Equal(t, Pending, rt.user(2).Status.State)
+		require.Empty(t, rt.user(2).Status.LastError)
+	}
+	require.Equal(t, []string{backend + " 1"}, rt.backend.callsTo("run-engine"))
+
+	// the slot is given back once the engine runs
+	for rt.user(1).Status.State != Running {
+		rt.reconcile(1)
+	}
+	rt.reconcile(2)
+	require.Equal(t, Starting, rt.user(2).Status.State)
+	require.Contains(t, rt.backend.callsTo("run-engine"), backend+" 2")
+	for rt.user(2).Status.State != Running {
+		rt.reconcile(2)
+	}
+	require.Empty(t, rt.r.starts.starting)
+
+	// and when the start fails
+	rt.backend.fail("run-engine", errors.New("out of memory"))
+	rt.reconcile(3)
+	require.Equal(t, Error, rt.user(3).Status.State)
+	require.Empty(t, rt.r.starts.starting)
+}
+
+func TestReconcileDeveloperUser(t *testing.T) {
+	org := 1
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true},
+		fakeUsers{2: {ID: 2, DeveloperOrg: &org}}, testUser(2, "", ""))
+	key := types.NamespacedName{Namespace: "default", Name: userName(2)}
+
+	// the deployment comes first, then the service once the deployment is available
+	rt.reconcile(2)
+	require.Equal(t, "developer", rt.user(2).Status.Mode)
+	deployment := &appsv1.Deployment{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, deployment))
+	deployment.Status.AvailableReplicas = 1
+	require.NoError(t, rt.c.Status().Update(rt.ctx, deployment))
+
+	rt.reconcile(2)
+	require.Equal(t, Starting, rt.user(2).Status.State)
+	service := &corev1.Service{}
+	require.NoError(t, rt.c.Get(rt.ctx, key, service))
+	service.Spec.ClusterIP = "10.1.0.2"
+	service.Spec.Ports = []corev1.ServicePort{{Port: 8100}}
+	require.NoError(t, rt.c.Update(rt.ctx, service))
+
+	const backend = "http://10.1.0.2:8100"
+	rt.reconcile(2)
+	require.Equal(t, backend, rt.user(2).Status.Backend)
+	require.Equal(t, []string{backend + " 2"}, rt.backend.callsTo("run-engine"))
+
+	// deleting the User kills the engine and deletes its resources
+	require.NoError(t, rt.c.Delete(rt.ctx, rt.user(2)))
+	rt.reconcile(2)
+	require.Nil(t, rt.user(2))
+	require.Equal(t, Stopped, rt.backend.state(backend, 2))
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})))
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &corev1.Service{})))
+}
+
+func TestDeveloperResourcesOwnedByUser(t *testing.T) {
+	scheme := newTestScheme(t)
+	user := &backendv1.User{
+		ObjectMeta: metav1.ObjectMeta{Name: userName(1), Namespace: "default", UID: types.UID("uid-1")},
+		Spec:       backendv1.UserSpec{ID: 1},
+	}
+	legacy := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: userName(1), Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(user, legacy).Build()
+	r := &UserReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+	ctx := context.Background()
+	key := client.ObjectKeyFromObject(user)
+
+	require.NoError(t, r.createDeployment(ctx, user, backendv1.UserModeDeveloper))
+	deployment := &appsv1.Deployment{}
+	require.NoError(t, c.Get(ctx, key, deployment))
+	owner := metav1.GetControllerOf(deployment)
+	require.NotNil(t, owner)
+	require.Equal(t, "User", owner.Kind)
+	require.Equal(t, user.UID, owner.UID)
+
+	// resources created before owner references are adopted
+	service := &corev1.Service{}
+	require.NoError(t, c.Get(ctx, key, service))
+	require.Nil(t, metav1.GetControllerOf(service))
+	require.NoError(t, r.adopt(ctx, user, service))
+	require.NoError(t, c.Get(ctx, key, service))
+	require.Equal(t, user.UID, metav1.GetControllerOf(service).UID)
+}
+
+func TestReconcileCacheVersion(t *testing.T) {
+	users := fakeUsers{1: {ID: 1}}
+	rt := newReconcileTest(t, &config.AlmondConfig{EnableDeveloperBackend: true}, users,
+		sharedBackends("10.0.0.1"), testUser(1, "", ""))
+	key := types.NamespacedName{Namespace: "default", Name: userName(1)}
+
+	rt.reconcile(1)
+	require.Equal(t, "shared", rt.user(1).Status.Mode)
+
+	// the user joins a developer org, which is noticed once the frontend bumps the version
+	org := 1
+	users[1] = &sql.User{ID: 1, DeveloperOrg: &org}
+	rt.reconcile(1)
+	require.True(t, apierrors.IsNotFound(rt.c.Get(rt.ctx, key, &appsv1.Deployment{})), "cached user")
+
+	user := rt.user(1)
+	user.Annotations = map[string]string{kCacheVersionAnnotation: "1"}
+	require.NoError(t, rt.c.Update(rt.ctx, user))
+	rt.reconcile(1)
+	require.NoError(t, rt.c.Get(rt.ctx, key, &appsv1.Deployment{}))
+}
@@ -15,6 +15,7 @@
 package manager
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -47,7 +48,9 @@ var (
 	probeAddr            = flagSet.String("health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	enableLeaderElection = flagSet.Bool("leader-elect", false, "Enable leader election for controller manager. "+
 		"Enabling this will ensure there is only one active controller manager.")
-	configDir = flagSet.String("config-dir", "/etc/almond-cloud/manager-config", "Config dir for controller manager.")
+	configDir        = flagSet.String("config-dir", "/etc/almond-cloud/manager-config", "Config dir for controller manager.")
+	engineEventsAddr = flagSet.String("engine-events-bind-address", "", "The address backends report engine events to, disabled if empty.")
+	podName          = flagSet.String("pod-name", "", "The pod of the manager, in the watched namespace, labeled for the engine-events Service while it is the leader.")
 )
 
 func Usage() {
@@ -91,15 +94,27 @@ func Run(args []string) {
 		os.Exit(1)
 	}
 
-	if err = controllers.NewUserReconciler(
+	userReconciler := controllers.NewUserReconciler(
 		mgr.GetClient(),
 		mgr.GetScheme(),
 		ctrl.Log.WithName("controllers").WithName("User"),
+		mgr.GetEventRecorderFor("user-controller"),
 		almondConfig,
-		*configDir).SetupWithManager(mgr); err != nil {
+		*configDir)
+	if err = userReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "User")
 		os.Exit(1)
 	}
+	if len(*engineEventsAddr) > 0 {
+		if err = userReconciler.UnlabelEngineEventsPod(context.Background(), *namespace, *podName); err != nil {
+			setupLog.Error(err, "unable to unlabel engine events pod")
+			os.Exit(1)
+		}
+		if err = mgr.Add(userReconciler.EngineEventServer(*engineEventsAddr, *namespace, *podName)); err != nil {
+			setupLog.Error(err, "unable to set up engine events server")
+			os.Exit(1)
+		}
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
@@ -0,0 +1,204 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ConflictReason explains the outcome of a pushed change
+type ConflictReason string
+
+const (
+	// ReasonApplied means the change was newer than the server version and was applied as is.
+	ReasonApplied ConflictReason = "applied"
+	// ReasonInvalid means the change has no unique id.
+	ReasonInvalid ConflictReason = "invalid"
+	// ReasonStale means the server version is newer and won.
+	ReasonStale ConflictReason = "stale"
+	// ReasonServerWins means the server version won the conflict.
+	ReasonServerWins ConflictReason = "server-wins"
+	// ReasonClientWins means the change won the conflict and was restamped.
+	ReasonClientWins ConflictReason = "client-wins"
+	// ReasonMerged means the change was merged into the server version.
+	ReasonMerged ConflictReason = "merged"
+)
+
+// Conflict resolver names accepted by NewConflictResolver
+const (
+	LastWriterWins = "last-writer-wins"
+	JSONMerge      = "json-merge"
+	ServerWins     = "server-wins"
+	ClientWins     = "client-wins"
+)
+
+// SyncResult is the outcome of one pushed change. Server is the version stored on
+// the server after a conflict, so clients can update without a second fetch.
+// LastModified is the server timestamp an applied change was stored with.
+type SyncResult struct {
+	Done         bool           `json:"done"`
+	Reason       ConflictReason `json:"reason"`
+	Server       SyncRecord     `json:"server,omitempty"`
+	LastModified Timestamp      `json:"lastModified,omitempty"`
+}
+
+// DoneFlags returns the done flag of each result
+func DoneFlags(results []SyncResult) []bool {
+	done := make([]bool, 0, len(results))
+	for _, r := range results {
+		done = append(done, r.Done)
+	}
+	return done
+}
+
+// ConflictResolver resolves a pushed change that conflicts with the server version: the
+// change is not newer, or the server version changed since the client last synced.
+// It returns the record to store, or nil to keep the server version unchanged. Later
+// changes of the batch are compared to a record returned with ReasonApplied by its own
+// timestamp, to any other record by a fresh server timestamp. Stored records are
+// always restamped.
+type ConflictResolver interface {
+	Resolve(client, server SyncRecord) (SyncRecord, ConflictReason, error)
+}
+
+// JSONRecord is a SyncRecord with a JSON-encoded value that can be merged field by field
+type JSONRecord interface {
+	SyncRecord
+	GetJSON() *string
+	SetJSON(*string)
+}
+
+var conflictResolvers = make(map[string]ConflictResolver)
+
+// NewConflictResolver returns a resolver by name
+func NewConflictResolver(name string) (ConflictResolver, error) {
+	switch name {
+	case LastWriterWins:
+		return lastWriterWins{}, nil
+	case JSONMerge:
+		return jsonMerge{}, nil
+	case ServerWins:
+		return serverWins{}, nil
+	case ClientWins:
+		return clientWins{}, nil
+	default:
+		return nil, fmt.Errorf("unknown conflict resolver %s", name)
+	}
+}
+
+// SetConflictResolver sets the conflict resolver of a sync table
+func SetConflictResolver(tableName string, r ConflictResolver) {
+	conflictResolvers[tableName] = r
+}
+
+// GetConflictResolver returns the conflict resolver of a sync table. Tables default to last-writer-wins.
+func GetConflictResolver(tableName string) ConflictResolver {
+	if r, ok := conflictResolvers[tableName]; ok {
+		return r
+	}
+	return lastWriterWins{}
+}
+
+// lastWriterWins keeps the version with the newer timestamp
+type lastWriterWins struct{}
+
+func (lastWriterWins) Resolve(client, server SyncRecord) (SyncRecord, ConflictReason, error) {
+	if clientNewer(client, server) {
+		return client, ReasonApplied, nil
+	}
+	return nil, ReasonStale, nil
+}
+
+// serverWins keeps the server version, even if the change is newer
+type serverWins struct{}
+
+func (serverWins) Resolve(client, server SyncRecord) (SyncRecord, ConflictReason, error) {
+	return nil, ReasonServerWins, nil
+}
+
+// clientWins stores the change, even if the server version is newer
+type clientWins struct{}
+
+func (clientWins) Resolve(client, server SyncRecord) (SyncRecord, ConflictReason, error) {
+	return client, ReasonClientWins, nil
+}
+
+// jsonMerge merges both versions field by field. Top-level fields present in only one
+// version are kept, fields present in both take the value of the newer version. The
+// merged record is a copy of the server version. Deletes and values that are not JSON
+// objects fall back to last-writer-wins.
+type jsonMerge struct{}
+
+func (jsonMerge) Resolve(client, server SyncRecord) (SyncRecord, ConflictReason, error) {
+	c, ok1 := client.(JSONRecord)
+	s, ok2 := server.(JSONRecord)
+	if !ok1 || !ok2 || !client.HasDiscriminator() || !server.HasDiscriminator() {
+		return lastWriterWins{}.Resolve(client, server)
+	}
+	clientFields, ok1 := decodeJSONObject(*c.GetJSON())
+	serverFields, ok2 := decodeJSONObject(*s.GetJSON())
+	if !ok1 || !ok2 {
+		return lastWriterWins{}.Resolve(client, server)
+	}
+	newer := clientNewer(client, server)
+	merged := make(map[string]interface{}, len(serverFields))
+	for k, v := range serverFields {
+		merged[k] = v
+	}
+	for k, v := range clientFields {
+		if _, ok := merged[k]; !ok || newer {
+			merged[k] = v
+		}
+	}
+	if reflect.DeepEqual(merged, serverFields) {
+		return nil, ReasonStale, nil
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, "", err
+	}
+	value := string(b)
+	m := copyJSONRecord(s)
+	m.SetJSON(&value)
+	return m, ReasonMerged, nil
+}
+
+// clientNewer reports whether a pushed change is newer than the server version. Pushed
+// changes are normalized to HLC already, server versions can carry legacy millis.
+func clientNewer(client, server SyncRecord) bool {
+	return client.GetLastModified() > NormalizeTimestamp(server.GetLastModified())
+}
+
+// decodeJSONObject decodes a JSON object and keeps numbers as json.Number, so
+// integers are written back unchanged.
+func decodeJSONObject(value string) (map[string]interface{}, bool) {
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader([]byte(value)))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil || fields == nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// copyJSONRecord returns a shallow copy of a record
+func copyJSONRecord(r JSONRecord) JSONRecord {
+	v := reflect.ValueOf(r).Elem()
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	return c.Interface().(JSONRecord)
+}
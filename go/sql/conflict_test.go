@@ -0,0 +1,123 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newDeviceRecord(uniqueID string, state string, lastModified int64) *UserDeviceSyncRecord {
+	r := &UserDeviceSyncRecord{
+		UserDeviceJournal: UserDeviceJournal{
+			Key:          Key{UniqueID: uniqueID, UserID: 1},
+			LastModified: Timestamp(lastModified),
+		},
+	}
+	if len(state) > 0 {
+		r.State = &state
+	}
+	return r
+}
+
+func TestConflictResolvers(t *testing.T) {
+	client := newDeviceRecord("u1", `{"a":1,"b":2}`, 100)
+	server := newDeviceRecord("u1", `{"a":3,"c":4}`, 200)
+
+	for name, want := range map[string]ConflictReason{
+		LastWriterWins: ReasonStale,
+		ServerWins:     ReasonServerWins,
+	} {
+		r, err := NewConflictResolver(name)
+		require.NoError(t, err)
+		winner, reason, err := r.Resolve(client, server)
+		require.NoError(t, err)
+		require.Nil(t, winner)
+		require.Equal(t, want, reason)
+	}
+
+	// a newer change wins under last-writer-wins only, pushed changes carry HLC timestamps
+	newer := newDeviceRecord("u1", `{"a":5}`, HLCFromMillis(300))
+	r, err := NewConflictResolver(LastWriterWins)
+	require.NoError(t, err)
+	winner, reason, err := r.Resolve(newer, server)
+	require.NoError(t, err)
+	require.Equal(t, newer, winner)
+	require.Equal(t, ReasonApplied, reason)
+	r, err = NewConflictResolver(ServerWins)
+	require.NoError(t, err)
+	winner, reason, err = r.Resolve(newer, server)
+	require.NoError(t, err)
+	require.Nil(t, winner)
+	require.Equal(t, ReasonServerWins, reason)
+
+	r, err = NewConflictResolver(ClientWins)
+	require.NoError(t, err)
+	winner, reason, err = r.Resolve(client, server)
+	require.NoError(t, err)
+	require.Equal(t, client, winner)
+	require.Equal(t, ReasonClientWins, reason)
+
+	_, err = NewConflictResolver("unknown")
+	require.Error(t, err)
+}
+
+func TestJSONMergeResolver(t *testing.T) {
+	r, err := NewConflictResolver(JSONMerge)
+	require.NoError(t, err)
+
+	client := newDeviceRecord("u1", `{"a":1,"b":2}`, 100)
+	server := newDeviceRecord("u1", `{"a":3,"c":4}`, 200)
+	winner, reason, err := r.Resolve(client, server)
+	require.NoError(t, err)
+	require.Equal(t, ReasonMerged, reason)
+	require.JSONEq(t, `{"a":3,"b":2,"c":4}`, *winner.(JSONRecord).GetJSON())
+	// the merge works on a copy
+	require.Equal(t, `{"a":3,"c":4}`, *server.State)
+	require.NotSame(t, server, winner)
+
+	// fields present in both take the newer value, integers are kept as is
+	client = newDeviceRecord("u1", `{"a":1,"n":9007199254740993}`, HLCFromMillis(300))
+	winner, reason, err = r.Resolve(client, server)
+	require.NoError(t, err)
+	require.Equal(t, ReasonMerged, reason)
+	require.JSONEq(t, `{"a":1,"c":4,"n":9007199254740993}`, *winner.(JSONRecord).GetJSON())
+	require.Contains(t, *winner.(JSONRecord).GetJSON(), `9007199254740993`)
+
+	// nothing new from the client
+	client = newDeviceRecord("u1", `{"a":1}`, 100)
+	server = newDeviceRecord("u1", `{"a":3}`, 200)
+	winner, reason, err = r.Resolve(client, server)
+	require.NoError(t, err)
+	require.Nil(t, winner)
+	require.Equal(t, ReasonStale, reason)
+
+	// deletes and non-object values fall back to last-writer-wins
+	deleted := newDeviceRecord("u1", "", HLCFromMillis(300))
+	winner, reason, err = r.Resolve(deleted, server)
+	require.NoError(t, err)
+	require.Equal(t, deleted, winner)
+	require.Equal(t, ReasonApplied, reason)
+	for _, c := range []*UserDeviceSyncRecord{
+		newDeviceRecord("u1", "", 100),
+		newDeviceRecord("u1", `[1,2]`, 100),
+		newDeviceRecord("u1", `not json`, 100),
+	} {
+		winner, reason, err = r.Resolve(c, server)
+		require.NoError(t, err)
+		require.Nil(t, winner)
+		require.Equal(t, ReasonStale, reason)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A hybrid logical clock (HLC) timestamp packs the physical time in millis in the
+// upper bits and a logical counter in the lower hlcLogicalBits bits. Timestamps
+// order by physical time first and break ties with the counter, so they can be
+// compared as plain int64 values. With hlcLogicalBits logical bits, timestamps stay
+// below 2^53 until the year 2109, so JavaScript clients read them as exact numbers.
+const (
+	hlcLogicalBits = 11
+	// hlcMinTimestamp separates legacy millis values from HLC timestamps. Any
+	// value below it is a wall clock millis value written before HLC was introduced.
+	hlcMinTimestamp int64 = 1 << 47
+	// DefaultMaxClockDrift is how far ahead of the local wall clock an observed timestamp
+	// may be by default.
+	DefaultMaxClockDrift = 5 * time.Minute
+)
+
+// HLCFromMillis converts a physical time in millis to an HLC timestamp with a zero logical counter.
+func HLCFromMillis(millis int64) int64 {
+	return millis << hlcLogicalBits
+}
+
+// HLCToMillis returns the physical time in millis of an HLC timestamp.
+func HLCToMillis(ts int64) int64 {
+	return ts >> hlcLogicalBits
+}
+
+// NormalizeTimestamp converts a legacy millis value to an HLC timestamp. HLC timestamps
+// are returned unchanged.
+func NormalizeTimestamp(ts int64) int64 {
+	if ts >= 0 && ts < hlcMinTimestamp {
+		return HLCFromMillis(ts)
+	}
+	return ts
+}
+
+// Timestamp is an HLC timestamp exchanged with clients. It is encoded in JSON as a
+// number, like the legacy millis values it replaces, and decodes from a number or a
+// decimal string.
+type Timestamp int64
+
+// UnmarshalJSON decodes t from a JSON string or number
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+	*t = Timestamp(ts)
+	return nil
+}
+
+// HybridClock generates monotonically increasing HLC timestamps. The clock advances
+// past any timestamp it observes, so a write stamped by the server always orders
+// after the writes it has seen, even if the local wall clock is behind.
+type HybridClock struct {
+	mu       sync.Mutex
+	last     int64
+	maxDrift time.Duration
+	millis   func() int64
+}
+
+// NewHybridClock returns a HybridClock driven by the local wall clock.
+func NewHybridClock() *HybridClock {
+	return &HybridClock{
+		maxDrift: DefaultMaxClockDrift,
+		millis:   func() int64 { return time.Now().UnixNano() / 1e6 },
+	}
+}
+
+// SetMaxDrift sets how far ahead of the wall clock an observed timestamp may be.
+func (c *HybridClock) SetMaxDrift(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxDrift = d
+}
+
+// Now returns a new timestamp greater than any timestamp returned or observed before.
+func (c *HybridClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := HLCFromMillis(c.millis())
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Observe merges a timestamp received from a client or read from the database and
+// returns it normalized. A timestamp more than the max drift ahead of the wall clock is
+// clamped to that bound first, so a device with a fast clock can still sync but cannot
+// push the clock arbitrarily far.
+func (c *HybridClock) Observe(ts int64) int64 {
+	ts = NormalizeTimestamp(ts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if bound := HLCFromMillis(c.millis() + c.maxDrift.Milliseconds()); ts > bound {
+		ts = bound
+	}
+	if ts > c.last {
+		c.last = ts
+	}
+	return ts
+}
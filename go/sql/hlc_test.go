@@ -0,0 +1,90 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTimestamp(t *testing.T) {
+	millis := int64(1625000000000)
+	ts := NormalizeTimestamp(millis)
+	require.Equal(t, HLCFromMillis(millis), ts)
+	require.Equal(t, ts, NormalizeTimestamp(ts))
+	require.Equal(t, millis, HLCToMillis(ts))
+	require.Less(t, NormalizeTimestamp(millis), NormalizeTimestamp(millis+1))
+}
+
+func TestHybridClock(t *testing.T) {
+	const base = int64(1625000000000)
+	wall := base
+	c := &HybridClock{maxDrift: DefaultMaxClockDrift, millis: func() int64 { return wall }}
+
+	t1 := c.Now()
+	require.Equal(t, HLCFromMillis(base), t1)
+	// wall clock does not move, logical counter does
+	t2 := c.Now()
+	require.Equal(t, t1+1, t2)
+
+	// a timestamp from a client ahead of us
+	remote := HLCFromMillis(base+5000) + 3
+	require.Equal(t, remote, c.Observe(remote))
+	t3 := c.Now()
+	require.Greater(t, t3, remote)
+	require.Equal(t, base+5000, HLCToMillis(t3))
+
+	// legacy millis values are normalized
+	require.Equal(t, HLCFromMillis(base+6000), c.Observe(base+6000))
+	require.Greater(t, c.Now(), HLCFromMillis(base+6000))
+
+	// wall clock catches up
+	wall = base + 7000
+	require.Equal(t, HLCFromMillis(base+7000), c.Now())
+
+	// timestamps too far ahead are clamped to the max drift
+	bound := HLCFromMillis(base + 7000 + DefaultMaxClockDrift.Milliseconds())
+	require.Equal(t, bound, c.Observe(bound+1))
+	require.Equal(t, bound, c.Observe(1<<62))
+	require.Equal(t, bound+1, c.Now())
+
+	// the max drift is configurable
+	c.SetMaxDrift(time.Second)
+	wall = base + 8000
+	require.Equal(t, HLCFromMillis(base+9000), c.Observe(HLCFromMillis(base+20000)))
+}
+
+func TestTimestampJSON(t *testing.T) {
+	ts := HLCFromMillis(1625000000000) + 1
+	data, err := json.Marshal(&UserDeviceJournal{LastModified: Timestamp(ts)})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"lastModified":3328000000000001`)
+	require.Less(t, ts, int64(1)<<53)
+
+	var j UserDeviceJournal
+	require.NoError(t, json.Unmarshal(data, &j))
+	require.Equal(t, ts, int64(j.LastModified))
+
+	require.NoError(t, json.Unmarshal([]byte(`{"lastModified":"3328000000000001"}`), &j))
+	require.Equal(t, ts, int64(j.LastModified))
+
+	// legacy clients send millis
+	require.NoError(t, json.Unmarshal([]byte(`{"lastModified":1625000000000}`), &j))
+	require.Equal(t, int64(1625000000000), int64(j.LastModified))
+
+	require.Error(t, json.Unmarshal([]byte(`{"lastModified":"soon"}`), &j))
+}
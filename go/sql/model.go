@@ -113,3 +113,15 @@ func ToSyncRecordSlice(rows interface{}) ([]SyncRecord, error) {
 	}
 	return srs, nil
 }
+
+// ToTypedSlice returns a pointer to a slice of the concrete type of rows, so gorm can insert them in a batch.
+// All rows must have the same concrete type.
+func ToTypedSlice(rows []Row) interface{} {
+	s := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(rows[0])), 0, len(rows))
+	for _, row := range rows {
+		s = reflect.Append(s, reflect.ValueOf(row))
+	}
+	p := reflect.New(s.Type())
+	p.Elem().Set(s)
+	return p.Interface()
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SyncDevice records the last timestamp of a sync table acknowledged by one device of a user
+type SyncDevice struct {
+	UserID       int64     `json:"userId"       gorm:"primaryKey;column:userId"`
+	DeviceID     string    `json:"deviceId"     gorm:"primaryKey;column:deviceId"`
+	SyncTable    string    `json:"syncTable"    gorm:"primaryKey;column:syncTable"`
+	LastModified Timestamp `json:"lastModified" gorm:"column:lastModified"`
+	LastSeen     time.Time `json:"lastSeen"     gorm:"column:lastSeen"`
+}
+
+// TableName overrides table name to `sync_device`
+func (*SyncDevice) TableName() string {
+	return "sync_device"
+}
+
+// DeviceSyncStatus is a device cursor with its lag behind the latest change of the table
+type DeviceSyncStatus struct {
+	SyncDevice
+	LagMillis int64 `json:"lagMillis"`
+}
+
+// AckDevice persists the timestamp a device has synced the table of sm up to. The cursor
+// never moves backwards, so a delayed or retried request cannot undo a later ack.
+func (t *SyncTable) AckDevice(sm SyncRow, userID int64, deviceID string, lastModified int64) error {
+	if len(deviceID) == 0 || userID == 0 {
+		return errors.New("invalid device")
+	}
+	device := &SyncDevice{
+		UserID:       userID,
+		DeviceID:     deviceID,
+		SyncTable:    sm.TableName(),
+		LastModified: Timestamp(NormalizeTimestamp(lastModified)),
+		LastSeen:     time.Now().UTC(),
+	}
+	return t.db.Clauses(clause.OnConflict{DoUpdates: clause.Assignments(map[string]interface{}{
+		"lastModified": gorm.Expr("GREATEST(lastModified, VALUES(lastModified))"),
+		"lastSeen":     gorm.Expr("VALUES(lastSeen)"),
+	})}).Create(device).Error
+}
+
+// GetDevices returns the devices that synced the table of sm with their lag.
+func (t *SyncTable) GetDevices(sm SyncRow, userID int64) ([]DeviceSyncStatus, error) {
+	var devices []SyncDevice
+	if err := t.db.Where("userId = ? AND syncTable = ?", userID, sm.TableName()).
+		Order("deviceId").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	sm.SetKey(Key{UserID: userID})
+	latest, err := t.getLastModified(t.db, sm.NewSyncRecord(0))
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]DeviceSyncStatus, 0, len(devices))
+	for _, d := range devices {
+		lag := HLCToMillis(NormalizeTimestamp(latest)) - HLCToMillis(int64(d.LastModified))
+		if lag < 0 {
+			lag = 0
+		}
+		statuses = append(statuses, DeviceSyncStatus{SyncDevice: d, LagMillis: lag})
+	}
+	return statuses, nil
+}
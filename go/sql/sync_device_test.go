@@ -0,0 +1,63 @@
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sql
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *SyncTableSuite) TestSyncTableAckDevice() {
+	// acks arrive out of order, the cursor only moves forward
+	for _, millis := range []int64{2000, 1000} {
+		s.mock.ExpectBegin()
+		s.mock.ExpectExec(regexp.QuoteMeta(
+			"INSERT INTO `sync_device` (`userId`,`deviceId`,`syncTable`,`lastModified`,`lastSeen`) VALUES (?,?,?,?,?) "+
+				"ON DUPLICATE KEY UPDATE `lastModified`=GREATEST(lastModified, VALUES(lastModified)),"+
+				"`lastSeen`=VALUES(lastSeen)")).
+			WithArgs(1, "phone", "user_device", HLCFromMillis(millis), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		s.mock.ExpectCommit()
+		require.NoError(s.T(), s.syncTable.AckDevice(&UserDevice{}, 1, "phone", millis))
+	}
+	require.Error(s.T(), s.syncTable.AckDevice(&UserDevice{}, 1, "", 1000))
+}
+
+func (s *SyncTableSuite) TestSyncTableGetDevices() {
+	now := time.Now()
+	const base = int64(1625000000000)
+	latest := HLCFromMillis(base + 5000)
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT `sync_device`.`userId`,`sync_device`.`deviceId`,`sync_device`.`syncTable`,"+
+			"`sync_device`.`lastModified`,`sync_device`.`lastSeen` FROM `sync_device` "+
+			"WHERE userId = ? AND syncTable = ? ORDER BY deviceId")).
+		WithArgs(1, "user_device").
+		WillReturnRows(sqlmock.NewRows([]string{"userId", "deviceId", "syncTable", "lastModified", "lastSeen"}).
+			AddRow(1, "laptop", "user_device", latest, now).
+			AddRow(1, "phone", "user_device", HLCFromMillis(base+2000), now))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select max(lastModified) as max_last_modified from user_device_journal where userId = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(latest))
+	devices, err := s.syncTable.GetDevices(&UserDevice{}, 1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), devices, 2)
+	require.Equal(s.T(), "laptop", devices[0].DeviceID)
+	require.Equal(s.T(), int64(0), devices[0].LagMillis)
+	require.Equal(s.T(), "phone", devices[1].DeviceID)
+	require.Equal(s.T(), int64(3000), devices[1].LagMillis)
+}
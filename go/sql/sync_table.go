@@ -22,14 +22,24 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// syncInsertBatchSize bounds the rows or keys of one batched statement to stay below the placeholder limit of MySQL
+const syncInsertBatchSize = 500
+
 // SyncTable
 type SyncTable struct {
-	db *gorm.DB
+	db    *gorm.DB
+	clock *HybridClock
 }
 
 // NewSyncTable
 func NewSyncTable(db *gorm.DB) *SyncTable {
-	return &SyncTable{db}
+	return &SyncTable{db: db, clock: NewHybridClock()}
+}
+
+// SetMaxClockDrift sets how far ahead of the server clock a client timestamp may be.
+// Timestamps further ahead are clamped.
+func (t *SyncTable) SetMaxClockDrift(d time.Duration) {
+	t.clock.SetMaxDrift(d)
 }
 
 // GetAll
@@ -67,27 +77,68 @@ func (t *SyncTable) GetChangesAfter(sm SyncRow, lastModified int64, userID int64
 }
 
 func (t *SyncTable) getChangesAfter(tx *gorm.DB, sm SyncRow, lastModified int64, userID int64) ([]SyncRecord, error) {
+	where, args := afterCursor(lastModified, userID)
+	return t.findRecords(tx, sm, where+";", args...)
+}
+
+// afterCursor returns the condition selecting the journal entries of a user after a
+// cursor. A legacy millis cursor is normalized, so it is not before every HLC timestamp.
+// Journal entries written before HLC still hold millis and are compared as millis.
+func afterCursor(lastModified int64, userID int64) (string, []interface{}) {
+	ts := NormalizeTimestamp(lastModified)
+	return "(tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ?",
+		[]interface{}{ts, hlcMinTimestamp, HLCToMillis(ts), userID}
+}
+
+// getChangesAfterBounded returns at most limit changes after lastModified in timestamp order,
+// and whether more changes remain. A page never ends in the middle of changes sharing a
+// timestamp, so the timestamp of its last change is a safe continuation point.
+func (t *SyncTable) getChangesAfterBounded(tx *gorm.DB, sm SyncRow, lastModified int64, userID int64, limit int) ([]SyncRecord, bool, error) {
+	where, args := afterCursor(lastModified, userID)
+	srs, err := t.findRecords(tx, sm, where+" order by tj.lastModified, tj.uniqueId limit ?;", append(args, limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(srs) <= limit {
+		return srs, false, nil
+	}
+	boundary := srs[limit-1].GetLastModified()
+	page := srs[:limit]
+	if srs[limit].GetLastModified() == boundary {
+		for len(page) > 0 && page[len(page)-1].GetLastModified() == boundary {
+			page = page[:len(page)-1]
+		}
+	}
+	if len(page) == 0 {
+		// every change in the page shares one timestamp, return all of them
+		page, err = t.findRecords(tx, sm, "tj.lastModified = ? and tj.userId = ? "+
+			"order by tj.uniqueId;", boundary, userID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return page, true, nil
+}
+
+// findRecords joins the journal with the table and returns the records matching where.
+func (t *SyncTable) findRecords(tx *gorm.DB, sm SyncRow, where string, args ...interface{}) ([]SyncRecord, error) {
 	rows := sm.NewSyncRecords()
 	journalTable := sm.NewSyncRecord(0).JournalRow().TableName()
 	fields := strings.Join(mapPrefix("t.", sm.Fields()), ",")
 	if err := tx.Raw("select tj.uniqueId,tj.userId,tj.lastModified,"+fields+
 		" from "+journalTable+" as tj left outer join "+
 		sm.TableName()+" as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
-		"where tj.lastModified > ? and tj.userId = ?;", lastModified, userID).Find(rows).Error; err != nil {
-		return nil, err
-	}
-	srs, err := ToSyncRecordSlice(rows)
-	if err != nil {
+		"where "+where, args...).Find(rows).Error; err != nil {
 		return nil, err
 	}
-	return srs, nil
+	return ToSyncRecordSlice(rows)
 }
 
 // HandleChanges
-func (t *SyncTable) HandleChanges(changes []SyncRecord, userID int64) ([]bool, error) {
-	var results []bool
+func (t *SyncTable) HandleChanges(changes []SyncRecord, userID int64) ([]SyncResult, error) {
+	var results []SyncResult
 	if err := t.db.Transaction(func(tx *gorm.DB) error {
-		res, err := t.handleChanges(tx, changes, userID)
+		res, err := t.handleChanges(tx, changes, userID, 0)
 		if err != nil {
 			// return any error will rollback
 			return err
@@ -101,33 +152,296 @@ func (t *SyncTable) HandleChanges(changes []SyncRecord, userID int64) ([]bool, e
 	return results, nil
 }
 
-func (t *SyncTable) handleChanges(tx *gorm.DB, changes []SyncRecord, userID int64) ([]bool, error) {
-	var results []bool
-	for _, sr := range changes {
-		var res bool
-		var err error
+// handleChanges applies a batch of pushed changes. The journal timestamps of the whole
+// batch are loaded with one query and accepted writes go out as batched statements.
+// Changes are still resolved one by one in order, so a change sees the outcome of the
+// changes before it in the same batch.
+//
+// base is the latest server timestamp the client has synced, or 0 if unknown. A change
+// conflicts with the server version if it is not newer, or if the server version was
+// written after base and the client has not seen it. Conflicts go to the resolver of
+// the table. Client timestamps only decide conflicts, accepted writes are stored with
+// server timestamps (see stampWrites).
+func (t *SyncTable) handleChanges(tx *gorm.DB, changes []SyncRecord, userID int64, base int64) ([]SyncResult, error) {
+	results := make([]SyncResult, len(changes))
+	var valid []int
+	var uniqueIDs []string
+	for i, sr := range changes {
 		key := sr.JournalRow().GetKey()
 		key.UserID = userID
 		sr.JournalRow().SetKey(key)
 		if len(key.UniqueID) == 0 {
-			results = append(results, false)
+			results[i] = SyncResult{Reason: ReasonInvalid}
 			continue
 		}
-		if sr.HasDiscriminator() {
-			if res, err = t.insertIfRecent(tx, sr); err != nil {
-				return nil, err
-			}
-		} else {
-			if res, err = t.deleteIfRecent(tx, sr); err != nil {
-				return nil, err
+		sr.SetLastModified(t.clock.Observe(sr.GetLastModified()))
+		valid = append(valid, i)
+		uniqueIDs = append(uniqueIDs, key.UniqueID)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+	sm := changes[valid[0]].Row()
+	journal, err := t.getJournalLastModified(tx, sm, userID, uniqueIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := func(sr SyncRecord, lastModified int64, unseen bool) bool {
+		return lastModified >= sr.GetLastModified() || (unseen && base > 0 && lastModified > base)
+	}
+	var conflictIDs []string
+	for _, i := range valid {
+		sr := changes[i]
+		if lastModified, ok := journal[sr.JournalRow().GetKey().UniqueID]; ok && conflicts(sr, lastModified, true) {
+			conflictIDs = append(conflictIDs, sr.JournalRow().GetKey().UniqueID)
+		}
+	}
+	servers := make(map[string]SyncRecord)
+	if err := forEachChunk(conflictIDs, func(ids []string) error {
+		srs, err := t.findRecords(tx, sm, "tj.userId = ? and tj.uniqueId in ?;", userID, ids)
+		if err != nil {
+			return err
+		}
+		for _, sr := range srs {
+			servers[sr.JournalRow().GetKey().UniqueID] = sr
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	resolver := GetConflictResolver(sm.TableName())
+	writes := newSyncWrites()
+	for _, i := range valid {
+		sr := changes[i]
+		uniqueID := sr.JournalRow().GetKey().UniqueID
+		// a change earlier in the batch is the server version now, the client has seen it
+		server, inBatch := writes.get(uniqueID)
+		lastModified, ok := journal[uniqueID]
+		if !ok || !conflicts(sr, lastModified, !inBatch) {
+			writes.add(sr)
+			journal[uniqueID] = sr.GetLastModified()
+			results[i] = SyncResult{Done: true, Reason: ReasonApplied}
+			continue
+		}
+		if !inBatch {
+			if server, ok = servers[uniqueID]; !ok {
+				return nil, errors.New("journal entry disappeared during sync")
 			}
 		}
-		results = append(results, res)
+		winner, reason, err := resolver.Resolve(sr, server)
+		if err != nil {
+			return nil, err
+		}
+		if winner == nil {
+			results[i] = SyncResult{Reason: reason, Server: server}
+			continue
+		}
+		if reason == ReasonApplied {
+			writes.add(winner)
+			journal[uniqueID] = winner.GetLastModified()
+			results[i] = SyncResult{Done: true, Reason: reason}
+			continue
+		}
+		// the winner must order after the server version it replaces
+		winner.SetLastModified(t.clock.Now())
+		writes.add(winner)
+		journal[uniqueID] = winner.GetLastModified()
+		results[i] = SyncResult{Done: reason == ReasonClientWins, Reason: reason, Server: winner}
+	}
+	if err := t.stampWrites(tx, sm, userID, writes); err != nil {
+		return nil, err
+	}
+	if err := t.applyWrites(tx, sm, userID, writes); err != nil {
+		return nil, err
+	}
+	for i, sr := range changes {
+		if results[i].Done {
+			stored, _ := writes.get(sr.JournalRow().GetKey().UniqueID)
+			results[i].LastModified = Timestamp(stored.GetLastModified())
+		}
 	}
 	return results, nil
 }
 
+// lockLastModified returns the newest normalized journal timestamp of a user and locks
+// the journal entries of the user until the transaction ends, so concurrent writers of
+// the same user stamp their writes one after the other.
+func (t *SyncTable) lockLastModified(tx *gorm.DB, sm SyncRow, userID int64) (int64, error) {
+	rows := []struct{ MaxLastModified int64 }{}
+	journalTable := sm.NewSyncRecord(0).JournalRow().TableName()
+	if err := tx.Raw("select max(lastModified) as max_last_modified from "+journalTable+
+		" where userId = ? for update", userID).Find(&rows).Error; err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return NormalizeTimestamp(rows[0].MaxLastModified), nil
+}
+
+// nextStamp returns a server timestamp after newest and advances newest to it.
+func (t *SyncTable) nextStamp(newest *int64) int64 {
+	// a journal entry written before client timestamps were bounded can be ahead
+	// of the clamped clock, the write must still order after it
+	t.clock.Observe(*newest)
+	ts := t.clock.Now()
+	if ts <= *newest {
+		ts = *newest + 1
+	}
+	*newest = ts
+	return ts
+}
+
+// stampWrites restamps the accepted writes with server timestamps after the newest
+// journal entry of the user. Clients sync with the newest timestamp they have seen as
+// cursor, so a write stored with an older client timestamp would never reach a device
+// that already synced past it.
+func (t *SyncTable) stampWrites(tx *gorm.DB, sm SyncRow, userID int64, w *syncWrites) error {
+	if len(w.order) == 0 {
+		return nil
+	}
+	newest, err := t.lockLastModified(tx, sm, userID)
+	if err != nil {
+		return err
+	}
+	for _, uniqueID := range w.order {
+		w.byID[uniqueID].SetLastModified(t.nextStamp(&newest))
+	}
+	return nil
+}
+
+// getJournalLastModified returns the normalized journal timestamps of uniqueIDs.
+func (t *SyncTable) getJournalLastModified(tx *gorm.DB, sm SyncRow, userID int64, uniqueIDs []string) (map[string]int64, error) {
+	journal := make(map[string]int64, len(uniqueIDs))
+	journalTable := sm.NewSyncRecord(0).JournalRow().TableName()
+	if err := forEachChunk(uniqueIDs, func(ids []string) error {
+		rows := []struct {
+			UniqueID     string `gorm:"column:uniqueId"`
+			LastModified int64  `gorm:"column:lastModified"`
+		}{}
+		if err := tx.Raw("select uniqueId,lastModified from "+journalTable+
+			" where userId = ? and uniqueId in ?", userID, ids).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			journal[row.UniqueID] = NormalizeTimestamp(row.LastModified)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// syncWrites collects the accepted writes of a batch. A later write to the same key
+// replaces the earlier one.
+type syncWrites struct {
+	byID  map[string]SyncRecord
+	order []string
+}
+
+func newSyncWrites() *syncWrites {
+	return &syncWrites{byID: make(map[string]SyncRecord)}
+}
+
+func (w *syncWrites) add(sr SyncRecord) {
+	uniqueID := sr.JournalRow().GetKey().UniqueID
+	if _, ok := w.byID[uniqueID]; !ok {
+		w.order = append(w.order, uniqueID)
+	}
+	w.byID[uniqueID] = sr
+}
+
+func (w *syncWrites) get(uniqueID string) (SyncRecord, bool) {
+	sr, ok := w.byID[uniqueID]
+	return sr, ok
+}
+
+// applyWrites deletes, upserts and journals the accepted writes with one statement each.
+func (t *SyncTable) applyWrites(tx *gorm.DB, sm SyncRow, userID int64, w *syncWrites) error {
+	var deleteIDs []string
+	var rows, journalRows []Row
+	for _, uniqueID := range w.order {
+		sr := w.byID[uniqueID]
+		if sr.HasDiscriminator() {
+			rows = append(rows, sr.Row())
+		} else {
+			deleteIDs = append(deleteIDs, uniqueID)
+		}
+		journalRows = append(journalRows, sr.JournalRow())
+	}
+	if err := forEachChunk(deleteIDs, func(ids []string) error {
+		return tx.Exec("delete from "+sm.TableName()+
+			" where userId = ? and uniqueId in ?", userID, ids).Error
+	}); err != nil {
+		return err
+	}
+	if err := upsertRows(tx, rows); err != nil {
+		return err
+	}
+	return upsertRows(tx, journalRows)
+}
+
+// upsertRows inserts or updates rows with one statement per syncInsertBatchSize rows.
+// gorm's CreateInBatches is not used because it opens a savepoint for every call.
+func upsertRows(tx *gorm.DB, rows []Row) error {
+	for start := 0; start < len(rows); start += syncInsertBatchSize {
+		end := start + syncInsertBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(ToTypedSlice(rows[start:end])).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachChunk calls f with consecutive chunks of at most syncInsertBatchSize ids.
+func forEachChunk(ids []string, f func([]string) error) error {
+	for start := 0; start < len(ids); start += syncInsertBatchSize {
+		end := start + syncInsertBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := f(ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *SyncTable) insertIfRecent(tx *gorm.DB, sr SyncRecord) (bool, error) {
+	recent, err := t.isRecent(tx, sr)
+	if err != nil || !recent {
+		return false, err
+	}
+	if err := t.stamp(tx, sr); err != nil {
+		return false, err
+	}
+	if _, err := t.insert(tx, sr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isRecent normalizes and bounds the client timestamp of sr and reports whether it is
+// strictly newer than the journal entry of the same key.
+func (t *SyncTable) isRecent(tx *gorm.DB, sr SyncRecord) (bool, error) {
+	ts := t.clock.Observe(sr.GetLastModified())
+	sr.SetLastModified(ts)
+	lastModified, found, err := t.journalLastModified(tx, sr)
+	if err != nil {
+		return false, err
+	}
+	return !found || lastModified < ts, nil
+}
+
+// journalLastModified returns the normalized journal timestamp of the key of sr.
+func (t *SyncTable) journalLastModified(tx *gorm.DB, sr SyncRecord) (int64, bool, error) {
 	row := struct {
 		LastModified int64 `gorm:"column:lastModified"`
 	}{}
@@ -135,15 +449,23 @@ func (t *SyncTable) insertIfRecent(tx *gorm.DB, sr SyncRecord) (bool, error) {
 	result := tx.Model(sr.JournalRow()).Where(
 		"uniqueId = ? AND userId = ?", k.UniqueID, k.UserID).First(&row)
 	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-		return false, result.Error
+		return 0, false, result.Error
 	}
-	if result.RowsAffected > 0 && row.LastModified >= sr.GetLastModified() {
-		return false, nil
+	if result.RowsAffected == 0 {
+		return 0, false, nil
 	}
-	if _, err := t.insert(tx, sr); err != nil {
-		return false, err
+	return NormalizeTimestamp(row.LastModified), true, nil
+}
+
+// stamp sets the last modified time of sr to a server-side HLC timestamp
+// that orders after every journal entry of the user.
+func (t *SyncTable) stamp(tx *gorm.DB, sr SyncRecord) error {
+	newest, err := t.lockLastModified(tx, sr.Row(), sr.JournalRow().GetKey().UserID)
+	if err != nil {
+		return err
 	}
-	return true, nil
+	sr.SetLastModified(t.nextStamp(&newest))
+	return nil
 }
 
 func (t *SyncTable) insert(tx *gorm.DB, sr SyncRecord) (int64, error) {
@@ -157,17 +479,12 @@ func (t *SyncTable) insert(tx *gorm.DB, sr SyncRecord) (int64, error) {
 }
 
 func (t *SyncTable) deleteIfRecent(tx *gorm.DB, sr SyncRecord) (bool, error) {
-	row := struct {
-		LastModified int64 `gorm:"column:lastModified"`
-	}{}
-	k := sr.JournalRow().GetKey()
-	result := tx.Model(sr.JournalRow()).Where(
-		"uniqueId = ? AND userId = ?", k.UniqueID, k.UserID).First(&row)
-	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
-		return false, result.Error
+	recent, err := t.isRecent(tx, sr)
+	if err != nil || !recent {
+		return false, err
 	}
-	if result.RowsAffected > 0 && row.LastModified >= sr.GetLastModified() {
-		return false, nil
+	if err := t.stamp(tx, sr); err != nil {
+		return false, err
 	}
 	if _, err := t.delete(tx, sr); err != nil {
 		return false, err
@@ -186,14 +503,14 @@ func (t *SyncTable) delete(tx *gorm.DB, sr SyncRecord) (int64, error) {
 }
 
 // SyncAt
-func (t *SyncTable) SyncAt(sr SyncRecord, pushedChanges []SyncRecord) (int64, []SyncRecord, []bool, error) {
+func (t *SyncTable) SyncAt(sr SyncRecord, pushedChanges []SyncRecord) (int64, []SyncRecord, []SyncResult, error) {
 	var ourChange []SyncRecord
 	var lastModified int64
-	var done []bool
+	var done []SyncResult
 	userID := sr.Row().GetKey().UserID
 	if err := t.db.Transaction(func(tx *gorm.DB) error {
 		var err error
-		ourChange, err = syncTable.getChangesAfter(tx, sr.Row(), sr.GetLastModified(), userID)
+		ourChange, err = t.getChangesAfter(tx, sr.Row(), sr.GetLastModified(), userID)
 		if err != nil {
 			return err
 		}
@@ -201,7 +518,7 @@ func (t *SyncTable) SyncAt(sr SyncRecord, pushedChanges []SyncRecord) (int64, []
 		if err != nil {
 			return err
 		}
-		done, err = t.handleChanges(tx, pushedChanges, userID)
+		done, err = t.handleChanges(tx, pushedChanges, userID, NormalizeTimestamp(sr.GetLastModified()))
 		if err != nil {
 			return err
 		}
@@ -213,6 +530,49 @@ func (t *SyncTable) SyncAt(sr SyncRecord, pushedChanges []SyncRecord) (int64, []
 	return lastModified, ourChange, done, nil
 }
 
+// SyncBatch is the result of one round trip of the bounded sync protocol
+type SyncBatch struct {
+	// LastModified is the continuation timestamp if More is set, the latest
+	// timestamp of the table otherwise.
+	LastModified int64
+	OurChanges   []SyncRecord
+	Results      []SyncResult
+	More         bool
+}
+
+// SyncAtBounded is SyncAt returning at most limit changes after the last modified time of sr.
+// Clients call it again with LastModified until More is false, pushing their own changes in
+// chunks along the way. Each round trip runs in its own transaction and starts where the
+// previous one ended, so no change is skipped.
+func (t *SyncTable) SyncAtBounded(sr SyncRecord, pushedChanges []SyncRecord, limit int) (*SyncBatch, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	batch := &SyncBatch{}
+	userID := sr.Row().GetKey().UserID
+	if err := t.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		batch.OurChanges, batch.More, err = t.getChangesAfterBounded(tx, sr.Row(), sr.GetLastModified(), userID, limit)
+		if err != nil {
+			return err
+		}
+		if batch.More {
+			batch.LastModified = batch.OurChanges[len(batch.OurChanges)-1].GetLastModified()
+		} else if batch.LastModified, err = t.getLastModified(tx, sr); err != nil {
+			return err
+		}
+		batch.Results, err = t.handleChanges(tx, pushedChanges, userID, NormalizeTimestamp(sr.GetLastModified()))
+		if err != nil {
+			return err
+		}
+		// return nil commits the transaction
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
 func (t *SyncTable) getLastModified(tx *gorm.DB, sr SyncRecord) (int64, error) {
 	rows := []struct{ MaxLastModified int64 }{}
 	tableName := sr.JournalRow().TableName()
@@ -235,6 +595,11 @@ func (t *SyncTable) ReplaceAll(rows []SyncRecord, userID int64) error {
 	}
 	sr := rows[0]
 	if err := t.db.Transaction(func(tx *gorm.DB) error {
+		// the replaced rows must still order after every cursor handed out before
+		newest, err := t.lockLastModified(tx, sr.Row(), userID)
+		if err != nil {
+			return err
+		}
 		if err := tx.Exec("delete from "+sr.Row().TableName()+
 			" where userId = ?", userID).Error; err != nil {
 			return err
@@ -253,6 +618,8 @@ func (t *SyncTable) ReplaceAll(rows []SyncRecord, userID int64) error {
 			if len(key.UniqueID) == 0 {
 				continue
 			}
+			t.clock.Observe(row.GetLastModified())
+			row.SetLastModified(t.nextStamp(&newest))
 			if _, err := t.insert(tx, row); err != nil {
 				return err
 			}
@@ -286,8 +653,10 @@ func (t *SyncTable) InsertOne(row SyncRow) (int64, error) {
 	var lastModified int64
 	var err error
 	if err = t.db.Transaction(func(tx *gorm.DB) error {
-		nowMillis := time.Now().UnixNano() / 1e6
-		sr := row.NewSyncRecord(nowMillis)
+		sr := row.NewSyncRecord(0)
+		if err = t.stamp(tx, sr); err != nil {
+			return err
+		}
 		if lastModified, err = t.insert(tx, sr); err != nil {
 			return err
 		}
@@ -319,8 +688,10 @@ func (t *SyncTable) DeleteOne(row SyncRow) (int64, error) {
 	var lastModified int64
 	var err error
 	if err = t.db.Transaction(func(tx *gorm.DB) error {
-		nowMillis := time.Now().UnixNano() / 1e6
-		sr := row.NewSyncRecord(nowMillis)
+		sr := row.NewSyncRecord(0)
+		if err = t.stamp(tx, sr); err != nil {
+			return err
+		}
 		if lastModified, err = t.delete(tx, sr); err != nil {
 			return err
 		}
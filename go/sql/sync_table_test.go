@@ -16,7 +16,9 @@ package sql
 import (
 	"database/sql"
 	"database/sql/driver"
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +28,7 @@ import (
 	"github.com/stretchr/testify/suite"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 type AnyInt64 struct{}
@@ -35,6 +38,14 @@ func (a AnyInt64) Match(v driver.Value) bool {
 	return ok
 }
 
+// After matches an int64 greater than a timestamp
+type After int64
+
+func (a After) Match(v driver.Value) bool {
+	ts, ok := v.(int64)
+	return ok && ts > int64(a)
+}
+
 type SyncTableSuite struct {
 	suite.Suite
 	DB        *gorm.DB
@@ -102,6 +113,20 @@ func (s *SyncTableSuite) AfterTest(_, _ string) {
 	require.NoError(s.T(), s.mock.ExpectationsWereMet())
 }
 
+// cursorArgs returns the arguments of the condition selecting the changes after a cursor
+func cursorArgs(lastModified int64, rest ...driver.Value) []driver.Value {
+	ts := NormalizeTimestamp(lastModified)
+	return append([]driver.Value{ts, hlcMinTimestamp, HLCToMillis(ts)}, rest...)
+}
+
+// expectLockLastModified expects the newest journal timestamp of a user to be read for stamping
+func (s *SyncTableSuite) expectLockLastModified(userID int64, newest int64) {
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select max(lastModified) as max_last_modified from user_device_journal where userId = ? for update")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(newest))
+}
+
 func TestSyncTable(t *testing.T) {
 	suite.Run(t, new(SyncTableSuite))
 }
@@ -157,11 +182,12 @@ func (s *SyncTableSuite) TestSyncTableGetChangesAfter() {
 	row := &UserDevice{}
 	want := s.record2
 	key := s.record2.UserDeviceJournal.Key
+	// the legacy millis cursor is normalized, legacy journal entries compare as millis
 	s.mock.ExpectQuery(regexp.QuoteMeta(
 		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
 			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
-			"where tj.lastModified > ? and tj.userId = ?")).
-		WithArgs(100, s.row1.Key.UserID).
+			"where (tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ?")).
+		WithArgs(HLCFromMillis(100), hlcMinTimestamp, 100, s.row1.Key.UserID).
 		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
 			AddRow(key.UniqueID, key.UserID, want.GetLastModified(), want.State))
 	rows, err := s.syncTable.GetChangesAfter(row, 100, s.row1.UserID)
@@ -179,58 +205,277 @@ func (s *SyncTableSuite) TestSyncTableHandleChanges() {
 	})
 	require.NoError(s.T(), err)
 
+	j1 := s.record1.UserDeviceJournal
+	j2 := s.record2.UserDeviceJournal
+	j3 := s.record3.UserDeviceJournal
 	s.mock.ExpectBegin()
-	// record1: not recent
-	journal := s.record1.UserDeviceJournal
 	s.mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT `user_device_journal`.`lastModified` FROM `user_device_journal` "+
-			"WHERE uniqueId = ? AND userId = ? "+
-			"ORDER BY `user_device_journal`.`uniqueId` LIMIT 1")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
-		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
-			AddRow(101))
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?,?,?)")).
+		WithArgs(j1.UserID, j1.UniqueID, j2.UniqueID, j3.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}).
+			AddRow(j1.UniqueID, 101).AddRow(j2.UniqueID, 101).AddRow(j3.UniqueID, 101))
+	// record1: not recent, fetch the server version
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where tj.userId = ? and tj.uniqueId in (?)")).
+		WithArgs(j1.UserID, j1.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
+			AddRow(j1.UniqueID, j1.UserID, 101, s.record1.State))
+	s.expectLockLastModified(j1.UserID, 101)
+	// record3: delete
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"delete from user_device where userId = ? and uniqueId in (?)")).
+		WithArgs(j3.UserID, j3.UniqueID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 	// record2: insert
-	journal = s.record2.UserDeviceJournal
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
+		WithArgs(j2.UniqueID, j2.UserID, s.record2.State).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?),(?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
+		WithArgs(j2.UniqueID, j2.UserID, After(NormalizeTimestamp(101)),
+			j3.UniqueID, j3.UserID, After(NormalizeTimestamp(101))).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	s.mock.ExpectCommit()
+	results, err := s.syncTable.HandleChanges(changes, j1.UserID)
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), deep.Equal([]bool{false, true, true}, DoneFlags(results)))
+	require.Equal(s.T(), ReasonStale, results[0].Reason)
+	require.Equal(s.T(), int64(101), results[0].Server.GetLastModified())
+	require.Equal(s.T(), ReasonApplied, results[1].Reason)
+	require.Nil(s.T(), results[1].Server)
+	// accepted writes are restamped by the server
+	require.Greater(s.T(), int64(results[1].LastModified), NormalizeTimestamp(102))
+	require.Greater(s.T(), int64(results[2].LastModified), int64(results[1].LastModified))
+}
+
+func (s *SyncTableSuite) TestSyncTableHandleChangesBehindCursor() {
+	userID := int64(1)
+	// device B syncs up to a server timestamp
+	cursor := HLCFromMillis(time.Now().UnixNano()/1e6) + 5
+	s.mock.ExpectBegin()
 	s.mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT `user_device_journal`.`lastModified` FROM `user_device_journal` "+
-			"WHERE uniqueId = ? AND userId = ? "+
-			"ORDER BY `user_device_journal`.`uniqueId` LIMIT 1")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
-		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
-			AddRow(101))
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where (tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ?")).
+		WithArgs(cursorArgs(0, userID)...).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
+			AddRow("u1", userID, cursor, "state1"))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select max(lastModified) as max_last_modified from user_device_journal where userId = ?")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(cursor))
+	s.mock.ExpectCommit()
+	deviceB := (&UserDevice{Key: Key{UserID: userID}}).NewSyncRecord(0)
+	lastModified, _, _, err := s.syncTable.SyncAt(deviceB, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), cursor, lastModified)
+
+	// device A has a slow clock and pushes a write stamped below the cursor of device B
+	state := "state8"
+	slow := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	changes, err := ToSyncRecordSlice(&[]*UserDeviceSyncRecord{
+		{State: &state, UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: "u8"}, LastModified: Timestamp(slow)}},
+	})
+	require.NoError(s.T(), err)
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?)")).
+		WithArgs(userID, "u8").
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}))
+	s.expectLockLastModified(userID, cursor)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, s.record2.State).
+		WithArgs("u8", userID, state).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, journal.LastModified).
+		WithArgs("u8", userID, After(cursor)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	// record3: delete
-	journal = s.record3.UserDeviceJournal
+	s.mock.ExpectCommit()
+	results, err := s.syncTable.HandleChanges(changes, userID)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ReasonApplied, results[0].Reason)
+	// the write is stored after the cursor, so the next sync of device B returns it
+	require.Greater(s.T(), int64(results[0].LastModified), cursor)
+}
+
+func (s *SyncTableSuite) TestSyncTableHandleChangesSameKey() {
+	s1 := "state1"
+	s2 := "state2"
+	changes, err := ToSyncRecordSlice(&[]*UserDeviceSyncRecord{
+		{State: &s1, UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: "u5"}, LastModified: 300}},
+		{State: &s2, UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: "u5"}, LastModified: 200}},
+		{UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: ""}, LastModified: 200}},
+	})
+	require.NoError(s.T(), err)
+
+	s.mock.ExpectBegin()
 	s.mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT `user_device_journal`.`lastModified` FROM `user_device_journal` "+
-			"WHERE uniqueId = ? AND userId = ? "+
-			"ORDER BY `user_device_journal`.`uniqueId` LIMIT 1")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
-		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
-			AddRow(101))
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?,?)")).
+		WithArgs(1, "u5", "u5").
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}))
+	s.expectLockLastModified(1, 0)
 	s.mock.ExpectExec(regexp.QuoteMeta(
-		"DELETE FROM `user_device` "+
-			"WHERE (`user_device`.`uniqueId`,`user_device`.`userId`) IN ((?,?))")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
+		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
+		WithArgs("u5", 1, s1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
+		WithArgs("u5", 1, AnyInt64{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectCommit()
+	results, err := s.syncTable.HandleChanges(changes, 1)
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), deep.Equal([]bool{true, false, false}, DoneFlags(results)))
+	// the second change lost against the first one in the same batch
+	require.Equal(s.T(), ReasonStale, results[1].Reason)
+	require.Equal(s.T(), s1, *results[1].Server.(*UserDeviceSyncRecord).State)
+	require.Equal(s.T(), ReasonInvalid, results[2].Reason)
+}
+
+func (s *SyncTableSuite) TestSyncTableHandleChangesClockDrift() {
+	s1 := "state1"
+	future := HLCFromMillis(time.Now().Add(time.Hour).UnixNano() / 1e6)
+	changes, err := ToSyncRecordSlice(&[]*UserDeviceSyncRecord{
+		{State: &s1, UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: "u6"}, LastModified: Timestamp(future)}},
+	})
+	require.NoError(s.T(), err)
+
+	// the change is clamped to the max drift and applied
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?)")).
+		WithArgs(1, "u6").
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}))
+	s.expectLockLastModified(1, 0)
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
+		WithArgs("u6", 1, s1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
+		WithArgs("u6", 1, AnyInt64{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectCommit()
+	results, err := s.syncTable.HandleChanges(changes, 1)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), ReasonApplied, results[0].Reason)
+	require.Less(s.T(), changes[0].GetLastModified(), future)
+}
+
+func (s *SyncTableSuite) TestSyncTableHandleChangesMerge() {
+	SetConflictResolver("user_device", jsonMerge{})
+	defer SetConflictResolver("user_device", lastWriterWins{})
+
+	client := `{"a":1,"b":2}`
+	change := &UserDeviceSyncRecord{
+		State: &client,
+		UserDeviceJournal: UserDeviceJournal{
+			Key:          Key{UniqueID: "u4", UserID: 1},
+			LastModified: 100,
+		},
+	}
+	changes, err := ToSyncRecordSlice(&[]*UserDeviceSyncRecord{change})
+	require.NoError(s.T(), err)
+
+	journal := change.UserDeviceJournal
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}).
+			AddRow(journal.Key.UniqueID, 200))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where tj.userId = ? and tj.uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
+			AddRow(journal.UniqueID, journal.UserID, 200, `{"a":3,"c":4}`))
+	s.expectLockLastModified(journal.Key.UserID, 200)
+	merged := `{"a":3,"b":2,"c":4}`
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
+			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
+		WithArgs(journal.Key.UniqueID, journal.Key.UserID, merged).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, journal.LastModified).
+		WithArgs(journal.Key.UniqueID, journal.Key.UserID, AnyInt64{}).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
 	results, err := s.syncTable.HandleChanges(changes, journal.Key.UserID)
 	require.NoError(s.T(), err)
-	require.Nil(s.T(), deep.Equal([]bool{false, true, true}, results))
+	require.Len(s.T(), results, 1)
+	require.False(s.T(), results[0].Done)
+	require.Equal(s.T(), ReasonMerged, results[0].Reason)
+	require.Equal(s.T(), merged, *results[0].Server.(*UserDeviceSyncRecord).State)
+	require.Greater(s.T(), results[0].Server.GetLastModified(), NormalizeTimestamp(200))
+}
+
+func (s *SyncTableSuite) TestSyncTableSyncAtServerWins() {
+	SetConflictResolver("user_device", serverWins{})
+	defer SetConflictResolver("user_device", lastWriterWins{})
+
+	client := `{"a":1}`
+	change := &UserDeviceSyncRecord{
+		State: &client,
+		UserDeviceJournal: UserDeviceJournal{
+			Key:          Key{UniqueID: "u7", UserID: 1},
+			LastModified: 300,
+		},
+	}
+	changes, err := ToSyncRecordSlice(&[]*UserDeviceSyncRecord{change})
+	require.NoError(s.T(), err)
+	// the client synced up to 100 and has not seen the server version written at 200
+	cursor := (&UserDevice{Key: Key{UserID: 1}}).NewSyncRecord(100)
+
+	journal := change.UserDeviceJournal
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where (tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ?")).
+		WithArgs(cursorArgs(100, journal.Key.UserID)...).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
+			AddRow(journal.UniqueID, journal.UserID, 200, `{"a":2}`))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select max(lastModified) as max_last_modified from user_device_journal where userId = ?")).
+		WithArgs(journal.Key.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(200))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}).
+			AddRow(journal.Key.UniqueID, 200))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where tj.userId = ? and tj.uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
+			AddRow(journal.UniqueID, journal.UserID, 200, `{"a":2}`))
+	s.mock.ExpectCommit()
+
+	_, _, results, err := s.syncTable.SyncAt(cursor, changes)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), results, 1)
+	// the change is newer, but the server version wins the concurrent write
+	require.False(s.T(), results[0].Done)
+	require.Equal(s.T(), ReasonServerWins, results[0].Reason)
+	require.Equal(s.T(), `{"a":2}`, *results[0].Server.(*UserDeviceSyncRecord).State)
 }
 
 func (s *SyncTableSuite) TestSyncTableSyncAt() {
@@ -247,8 +492,8 @@ func (s *SyncTableSuite) TestSyncTableSyncAt() {
 	s.mock.ExpectQuery(regexp.QuoteMeta(
 		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
 			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
-			"where tj.lastModified > ? and tj.userId = ?")).
-		WithArgs(syncChange.UserDeviceJournal.LastModified, syncChange.UserDeviceJournal.UserID).
+			"where (tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ?")).
+		WithArgs(cursorArgs(int64(syncChange.UserDeviceJournal.LastModified), syncChange.UserDeviceJournal.UserID)...).
 		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "userId", "lastModified", "state"}).
 			AddRow(journal.UniqueID, journal.UserID, journal.LastModified, ourChange.State))
 	// getLastModified
@@ -260,21 +505,19 @@ func (s *SyncTableSuite) TestSyncTableSyncAt() {
 	// handleChanges record3: delete
 	journal = s.record3.UserDeviceJournal
 	s.mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT `user_device_journal`.`lastModified` FROM `user_device_journal` "+
-			"WHERE uniqueId = ? AND userId = ? "+
-			"ORDER BY `user_device_journal`.`uniqueId` LIMIT 1")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
-		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
-			AddRow(101))
+		"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
+		WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}).
+			AddRow(journal.Key.UniqueID, 101))
+	s.expectLockLastModified(journal.Key.UserID, ourChange.GetLastModified())
 	s.mock.ExpectExec(regexp.QuoteMeta(
-		"DELETE FROM `user_device` "+
-			"WHERE (`user_device`.`uniqueId`,`user_device`.`userId`) IN ((?,?))")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID).
+		"delete from user_device where userId = ? and uniqueId in (?)")).
+		WithArgs(journal.Key.UserID, journal.Key.UniqueID).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, journal.LastModified).
+		WithArgs(journal.Key.UniqueID, journal.Key.UserID, After(NormalizeTimestamp(ourChange.GetLastModified()))).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
 
@@ -282,7 +525,73 @@ func (s *SyncTableSuite) TestSyncTableSyncAt() {
 	require.NoError(s.T(), err)
 	require.Equal(s.T(), ourChange.GetLastModified(), lastModified)
 	require.Nil(s.T(), deep.Equal([]SyncRecord{ourChange}, gotOurChanges))
-	require.Nil(s.T(), deep.Equal([]bool{true}, results))
+	require.Nil(s.T(), deep.Equal([]bool{true}, DoneFlags(results)))
+}
+
+func (s *SyncTableSuite) TestSyncTableSyncAtBounded() {
+	syncChange := s.record1
+	userID := syncChange.UserDeviceJournal.UserID
+	query := "select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj " +
+		"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId " +
+		"where (tj.lastModified > ? or (tj.lastModified < ? and tj.lastModified > ?)) and tj.userId = ? order by tj.lastModified, tj.uniqueId limit ?"
+	columns := []string{"uniqueId", "userId", "lastModified", "state"}
+
+	// the page is cut before changes sharing the boundary timestamp
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(cursorArgs(int64(syncChange.UserDeviceJournal.LastModified), userID, 3)...).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("u1", userID, 200, "state1").
+			AddRow("u2", userID, 300, "state2").
+			AddRow("u3", userID, 300, nil))
+	s.mock.ExpectCommit()
+	batch, err := s.syncTable.SyncAtBounded(syncChange, nil, 2)
+	require.NoError(s.T(), err)
+	require.True(s.T(), batch.More)
+	require.Equal(s.T(), int64(200), batch.LastModified)
+	require.Len(s.T(), batch.OurChanges, 1)
+
+	// a page of changes sharing one timestamp is returned whole
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(cursorArgs(200, userID, 2)...).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("u2", userID, 300, "state2").
+			AddRow("u3", userID, 300, nil))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select tj.uniqueId,tj.userId,tj.lastModified,t.state from user_device_journal as tj "+
+			"left outer join user_device as t on tj.uniqueId = t.uniqueId and tj.userId = t.userId "+
+			"where tj.lastModified = ? and tj.userId = ? order by tj.uniqueId")).
+		WithArgs(300, userID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("u2", userID, 300, "state2").
+			AddRow("u3", userID, 300, nil))
+	s.mock.ExpectCommit()
+	syncChange = &UserDeviceSyncRecord{UserDeviceJournal: UserDeviceJournal{
+		Key: Key{UserID: userID}, LastModified: 200}}
+	batch, err = s.syncTable.SyncAtBounded(syncChange, nil, 1)
+	require.NoError(s.T(), err)
+	require.True(s.T(), batch.More)
+	require.Equal(s.T(), int64(300), batch.LastModified)
+	require.Len(s.T(), batch.OurChanges, 2)
+
+	// last page returns the latest timestamp
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(cursorArgs(300, userID, 3)...).
+		WillReturnRows(sqlmock.NewRows(columns))
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		"select max(lastModified) as max_last_modified from user_device_journal where userId = ?")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).
+			AddRow(300))
+	s.mock.ExpectCommit()
+	syncChange.SetLastModified(300)
+	batch, err = s.syncTable.SyncAtBounded(syncChange, nil, 2)
+	require.NoError(s.T(), err)
+	require.False(s.T(), batch.More)
+	require.Equal(s.T(), int64(300), batch.LastModified)
+	require.Empty(s.T(), batch.OurChanges)
 }
 
 func (s *SyncTableSuite) TestSyncTableReplaceAll() {
@@ -295,6 +604,7 @@ func (s *SyncTableSuite) TestSyncTableReplaceAll() {
 
 	s.mock.ExpectBegin()
 	journal := s.record1.UserDeviceJournal
+	s.expectLockLastModified(journal.Key.UserID, 500)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"delete from user_device where userId = ?")).
 		WithArgs(journal.Key.UserID).
@@ -312,7 +622,7 @@ func (s *SyncTableSuite) TestSyncTableReplaceAll() {
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, journal.LastModified).
+		WithArgs(journal.Key.UniqueID, journal.Key.UserID, After(NormalizeTimestamp(500))).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	// record2: insert
 	journal = s.record2.UserDeviceJournal
@@ -324,7 +634,7 @@ func (s *SyncTableSuite) TestSyncTableReplaceAll() {
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(journal.Key.UniqueID, journal.Key.UserID, journal.LastModified).
+		WithArgs(journal.Key.UniqueID, journal.Key.UserID, After(NormalizeTimestamp(500))).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	// record3: skip
 	s.mock.ExpectCommit()
@@ -343,6 +653,7 @@ func (s *SyncTableSuite) TestSyncTableInsertIfRecent() {
 		WithArgs(row.Key.UniqueID, row.Key.UserID).
 		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
 			AddRow(101))
+	s.expectLockLastModified(row.Key.UserID, 150)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
@@ -351,7 +662,7 @@ func (s *SyncTableSuite) TestSyncTableInsertIfRecent() {
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device_journal` (`uniqueId`,`userId`,`lastModified`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `lastModified`=VALUES(`lastModified`)")).
-		WithArgs(row.Key.UniqueID, row.Key.UserID, 200).
+		WithArgs(row.Key.UniqueID, row.Key.UserID, After(NormalizeTimestamp(150))).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	s.mock.ExpectCommit()
 	done, err := s.syncTable.InsertIfRecent(row, 200)
@@ -376,6 +687,7 @@ func (s *SyncTableSuite) TestSyncTableInsertOne() {
 	row := s.row1
 	now := time.Now().UnixNano() / 1e6
 	s.mock.ExpectBegin()
+	s.expectLockLastModified(row.Key.UserID, now)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"INSERT INTO `user_device` (`uniqueId`,`userId`,`state`) VALUES (?,?,?) "+
 			"ON DUPLICATE KEY UPDATE `state`=VALUES(`state`)")).
@@ -389,7 +701,7 @@ func (s *SyncTableSuite) TestSyncTableInsertOne() {
 	s.mock.ExpectCommit()
 	lastModified, err := s.syncTable.InsertOne(row)
 	require.NoError(s.T(), err)
-	require.GreaterOrEqual(s.T(), lastModified, now)
+	require.Greater(s.T(), lastModified, HLCFromMillis(now))
 }
 
 func (s *SyncTableSuite) TestSyncTableDeleteIfRecent() {
@@ -403,6 +715,7 @@ func (s *SyncTableSuite) TestSyncTableDeleteIfRecent() {
 		WithArgs(row.Key.UniqueID, row.Key.UserID).
 		WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).
 			AddRow(101))
+	s.expectLockLastModified(row.Key.UserID, 101)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"DELETE FROM `user_device` "+
 			"WHERE (`user_device`.`uniqueId`,`user_device`.`userId`) IN ((?,?))")).
@@ -436,6 +749,7 @@ func (s *SyncTableSuite) TestSyncTableDeleteOne() {
 	row := &UserDevice{Key: s.row1.Key}
 	now := time.Now().UnixNano() / 1e6
 	s.mock.ExpectBegin()
+	s.expectLockLastModified(row.Key.UserID, now)
 	s.mock.ExpectExec(regexp.QuoteMeta(
 		"DELETE FROM `user_device` "+
 			"WHERE (`user_device`.`uniqueId`,`user_device`.`userId`) IN ((?,?))")).
@@ -449,5 +763,160 @@ func (s *SyncTableSuite) TestSyncTableDeleteOne() {
 	s.mock.ExpectCommit()
 	lastModified, err := s.syncTable.DeleteOne(row)
 	require.NoError(s.T(), err)
-	require.GreaterOrEqual(s.T(), lastModified, now)
+	require.Greater(s.T(), lastModified, HLCFromMillis(now))
+}
+
+func (s *SyncTableSuite) TestSyncTableHandleChangesChunks() {
+	n := syncInsertBatchSize + 1
+	records := make([]*UserDeviceSyncRecord, n)
+	for i := range records {
+		records[i] = &UserDeviceSyncRecord{
+			UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: fmt.Sprintf("u%d", i)}, LastModified: 200},
+		}
+	}
+	changes, err := ToSyncRecordSlice(&records)
+	require.NoError(s.T(), err)
+
+	s.mock.ExpectBegin()
+	for _, size := range []int{syncInsertBatchSize, 1} {
+		s.mock.ExpectQuery(regexp.QuoteMeta(
+			"select uniqueId,lastModified from user_device_journal where userId = ? and uniqueId in (?" +
+				strings.Repeat(",?", size-1) + ")")).
+			WillReturnRows(sqlmock.NewRows([]string{"uniqueId", "lastModified"}))
+	}
+	s.expectLockLastModified(1, 0)
+	for _, size := range []int{syncInsertBatchSize, 1} {
+		s.mock.ExpectExec(regexp.QuoteMeta(
+			"delete from user_device where userId = ? and uniqueId in (?" + strings.Repeat(",?", size-1) + ")")).
+			WillReturnResult(sqlmock.NewResult(0, int64(size)))
+	}
+	for _, size := range []int{syncInsertBatchSize, 1} {
+		s.mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_device_journal`")).
+			WillReturnResult(sqlmock.NewResult(0, int64(size)))
+	}
+	s.mock.ExpectCommit()
+	results, err := s.syncTable.HandleChanges(changes, 1)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), results, n)
+}
+
+// newBenchmarkSyncTable returns a SyncTable on sqlmock and a counter of the statements
+// sent to it, excluding begin and commit.
+func newBenchmarkSyncTable(b *testing.B) (*SyncTable, sqlmock.Sqlmock, *int) {
+	queries := 0
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherFunc(
+		func(expectedSQL, actualSQL string) error {
+			queries++
+			return sqlmock.QueryMatcherRegexp.Match(expectedSQL, actualSQL)
+		})))
+	require.NoError(b, err)
+	gdb, err := gorm.Open(mysql.New(
+		mysql.Config{Conn: db, SkipInitializeWithVersion: true}),
+		&gorm.Config{Logger: logger.Discard, QueryFields: true})
+	require.NoError(b, err)
+	return NewSyncTable(gdb), mock, &queries
+}
+
+// newBenchmarkRecords returns n pushed changes, every other one a delete
+func newBenchmarkRecords(b *testing.B, n int) ([]*UserDeviceSyncRecord, []SyncRecord) {
+	state := "state"
+	records := make([]*UserDeviceSyncRecord, n)
+	for i := range records {
+		records[i] = &UserDeviceSyncRecord{
+			UserDeviceJournal: UserDeviceJournal{Key: Key{UniqueID: fmt.Sprintf("u%d", i), UserID: 1}, LastModified: 200},
+		}
+		if i%2 == 0 {
+			records[i].State = &state
+		}
+	}
+	changes, err := ToSyncRecordSlice(&records)
+	require.NoError(b, err)
+	return records, changes
+}
+
+func BenchmarkSyncTableHandleChanges(b *testing.B) {
+	for _, n := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			syncTable, mock, queries := newBenchmarkSyncTable(b)
+			records, changes := newBenchmarkRecords(b, n)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				journal := sqlmock.NewRows([]string{"uniqueId", "lastModified"})
+				for _, r := range records {
+					journal.AddRow(r.UniqueID, 100)
+				}
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta("select uniqueId,lastModified from user_device_journal")).
+					WillReturnRows(journal)
+				mock.ExpectQuery(regexp.QuoteMeta("select max(lastModified)")).
+					WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(100))
+				mock.ExpectExec(regexp.QuoteMeta("delete from user_device")).
+					WillReturnResult(sqlmock.NewResult(0, int64(n/2)))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_device`")).
+					WillReturnResult(sqlmock.NewResult(0, int64(n-n/2)))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_device_journal`")).
+					WillReturnResult(sqlmock.NewResult(0, int64(n)))
+				mock.ExpectCommit()
+				b.StartTimer()
+
+				results, err := syncTable.HandleChanges(changes, 1)
+				require.NoError(b, err)
+				require.Len(b, results, n)
+			}
+			b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// BenchmarkSyncTablePerRecord applies the same changes one record at a time, as
+// HandleChanges did before changes were batched.
+func BenchmarkSyncTablePerRecord(b *testing.B) {
+	for _, n := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			syncTable, mock, queries := newBenchmarkSyncTable(b)
+			_, changes := newBenchmarkRecords(b, n)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				mock.ExpectBegin()
+				for _, sr := range changes {
+					mock.ExpectQuery(regexp.QuoteMeta("SELECT `user_device_journal`.`lastModified`")).
+						WillReturnRows(sqlmock.NewRows([]string{"lastModified"}).AddRow(100))
+					mock.ExpectQuery(regexp.QuoteMeta("select max(lastModified)")).
+						WillReturnRows(sqlmock.NewRows([]string{"max_last_modified"}).AddRow(100))
+					if sr.HasDiscriminator() {
+						mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_device`")).
+							WillReturnResult(sqlmock.NewResult(0, 1))
+					} else {
+						mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `user_device`")).
+							WillReturnResult(sqlmock.NewResult(0, 1))
+					}
+					mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `user_device_journal`")).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+				b.StartTimer()
+
+				err := syncTable.db.Transaction(func(tx *gorm.DB) error {
+					for _, sr := range changes {
+						var err error
+						if sr.HasDiscriminator() {
+							_, err = syncTable.insertIfRecent(tx, sr)
+						} else {
+							_, err = syncTable.deleteIfRecent(tx, sr)
+						}
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(*queries)/float64(b.N), "queries/op")
+		})
+	}
 }
@@ -13,6 +13,8 @@
 // limitations under the License.
 package sql
 
+import "gorm.io/gorm"
+
 // UserApp table
 type UserApp struct {
 	Key
@@ -51,3 +53,10 @@ func (e *UserApp) GetKey() Key {
 func (e *UserApp) Fields() []string {
 	return []string{"code", "state", "name", "description"}
 }
+
+// HasUserApps returns whether a user has apps, the automations its engine runs in the background
+func HasUserApps(db *gorm.DB, uid int64) (bool, error) {
+	var count int64
+	err := db.Model(&UserApp{}).Where("userId = ?", uid).Count(&count).Error
+	return count > 0, err
+}
@@ -44,7 +44,7 @@ func (e *UserDevice) NewSyncRecord(lastModified int64) SyncRecord {
 	return &UserDeviceSyncRecord{
 		UserDeviceJournal: UserDeviceJournal{
 			Key:          e.Key,
-			LastModified: lastModified,
+			LastModified: Timestamp(lastModified),
 		},
 		State: e.State,
 	}
@@ -68,7 +68,7 @@ func (e *UserDevice) Fields() []string {
 // UserDeviceJournal table
 type UserDeviceJournal struct {
 	Key
-	LastModified int64 `json:"lastModified" gorm:"column:lastModified"`
+	LastModified Timestamp `json:"lastModified" gorm:"column:lastModified"`
 }
 
 // TableName overrides table name to `user_device`
@@ -122,15 +122,25 @@ func (r *UserDeviceSyncRecord) JournalRow() Row {
 
 // GetLastModified
 func (r *UserDeviceSyncRecord) GetLastModified() int64 {
-	return r.UserDeviceJournal.LastModified
+	return int64(r.UserDeviceJournal.LastModified)
 }
 
 // SetLastModified
 func (r *UserDeviceSyncRecord) SetLastModified(t int64) {
-	r.UserDeviceJournal.LastModified = t
+	r.UserDeviceJournal.LastModified = Timestamp(t)
 }
 
 // HasDiscriminator
 func (r *UserDeviceSyncRecord) HasDiscriminator() bool {
 	return r.State != nil && len(*r.State) > 0
 }
+
+// GetJSON returns the JSON-encoded state
+func (r *UserDeviceSyncRecord) GetJSON() *string {
+	return r.State
+}
+
+// SetJSON sets the JSON-encoded state
+func (r *UserDeviceSyncRecord) SetJSON(v *string) {
+	r.State = v
+}
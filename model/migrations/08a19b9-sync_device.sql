@@ -0,0 +1,8 @@
+create table `sync_device` (
+  `userId` int(11) not NULL,
+  `deviceId` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `syncTable` varchar(64) COLLATE utf8mb4_bin NOT NULL,
+  `lastModified` BIGINT NOT NULL,
+  `lastSeen` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`userId`, `deviceId`, `syncTable`)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
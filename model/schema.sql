@@ -1030,6 +1030,23 @@ create table `user_device_journal` (
 )ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `sync_device`
+--
+
+DROP TABLE IF EXISTS `sync_device`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+create table `sync_device` (
+  `userId` int(11) not NULL,
+  `deviceId` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `syncTable` varchar(64) COLLATE utf8mb4_bin NOT NULL,
+  `lastModified` BIGINT NOT NULL,
+  `lastSeen` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`userId`, `deviceId`, `syncTable`)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `user_channel`
 --
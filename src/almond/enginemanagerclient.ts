@@ -72,6 +72,7 @@ interface EngineManagerInterface extends events.EventEmitter {
     killUser(userId : number) : Promise<void>;
     deleteUser(userId : number) : Promise<void>;
     clearCache(userId : number) : Promise<void>;
+    invalidateUser(userId : number) : Promise<void>;
     restartUser(userId : number) : Promise<void>;
     restartUserWithoutCache(userId : number) : Promise<void>;
     isK8s() : boolean;
@@ -301,6 +302,11 @@ class EngineManagerClientImpl extends events.EventEmitter {
         return ctrl.clearCache(userId);
     }
 
+    async invalidateUser(userId : number) {
+        // the engine manager reads the user row from the database when it
+        // starts an engine, there is nothing to invalidate
+    }
+
     async restartUser(userId : number) {
         this._cachedEngines.delete(userId);
         const shardId = userToShardId(userId);
@@ -31,6 +31,7 @@ import type Engine from './engine';
 import type { WebSocketApi, WebhookApi } from './platform';
 import * as Tp from 'thingpedia';
 import sleep from '../util/sleep';
+import { checkSigningConfig, signRequest } from '../util/engine_api_auth';
 
 type EngineProxy = rpc.Proxy<Engine> & {
     websocket : rpc.Proxy<WebSocketApi>;
@@ -45,7 +46,7 @@ interface CachedEngine {
 async function backendState(backendUrl : string, userId : number) : Promise<string> {
     const url = `${backendUrl}/engine-status?userid=${userId}`;
     try {
-        const resp = await Tp.Helpers.Http.get(url);
+        const resp = await Tp.Helpers.Http.get(url, { extraHeaders: signRequest('GET', url) });
         return JSON.parse(resp)["data"];
     } catch(e : any) {
         if (e.code !== 'ECONNREFUSED' && e.code !== 'EHOSTUNREACH')
@@ -76,6 +77,7 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
 
     constructor(namespace : string) {
         super();
+        checkSigningConfig();
         const kc = new k8s.KubeConfig();
         kc.loadFromDefault();
         this.userApi = new UserK8sApi(kc.makeApiClient(k8s.CustomObjectsApi), namespace);
@@ -98,6 +100,9 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
         if (user === null) {
             if (!await this.userApi.createUser(userId))
                 throw new Error(`failed to create user ${userId}`);
+        } else if (UserK8sApi.isAsleep(user)) {
+            if (!await this.userApi.wakeUser(userId))
+                throw new Error(`failed to wake up user ${userId}`);
         }
         if (user === null || !user.status || !user.status.backend)
             user = await this.userApi.waitForUser(userId, 60000);
@@ -106,7 +111,7 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
 
         const parsedUrl = new URL(user.status.backend);
         const u = `ws://${parsedUrl.host}/engine`;
-        const ws = new WebSocket(u);
+        const ws = new WebSocket(u, { headers: signRequest('GET', u) });
         const socket = WebSocket.createWebSocketStream(ws);
         const jsonSocket = new JsonWebSocketAdapter(socket);
         let deleted = false;
@@ -223,7 +228,11 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
     }
 
     async startUser(userId : number) {
-        await this.userApi.createUser(userId);
+        const user = await this.userApi.getUser(userId);
+        if (user !== null && UserK8sApi.isAsleep(user))
+            await this.userApi.wakeUser(userId);
+        else
+            await this.userApi.createUser(userId);
     }
 
     async killUser(userId : number) {
@@ -231,11 +240,21 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
     }
 
     async deleteUser(userId : number) {
-        await this.userApi.deleteUser(userId);
+        await this.userApi.deleteUser(userId, true);
     }
 
     async clearCache(userId : number) {
-        // not needed for k8s
+        await this.userApi.invalidateUser(userId);
+    }
+
+    /**
+     * Tell the controller that the user row changed, so it drops its cached
+     * copy before it starts the engine again. This must be called after the
+     * transaction that wrote the row commits. Logins only touch lastlog_time,
+     * which the controller does not read, and do not call this.
+     */
+    async invalidateUser(userId : number) {
+        await this.userApi.invalidateUser(userId);
     }
 
     async restartUser(userId : number) {
@@ -244,6 +263,7 @@ export default class EngineManagerClientK8s extends events.EventEmitter {
     }
 
     async restartUserWithoutCache(userId : number) {
+        await this.clearCache(userId);
         await this.restartUser(userId);
     }
 }
@@ -177,6 +177,9 @@ export interface PlatformOptions {
     phone : string|null;
     email : string;
     emailVerified : boolean;
+    // set by the controller from the idle policy of the user
+    idleTimeoutMillis ?: number;
+    alwaysOn ?: boolean;
 }
 
 export class Platform extends Tp.BasePlatform {
@@ -243,6 +246,13 @@ export class Platform extends Tp.BasePlatform {
             await this._prefs.init();
     }
 
+    // Wait until the state of the engine is stored in the database, so another
+    // backend can start it. Call after the engine is closed.
+    async checkpoint() {
+        if (this._prefs instanceof SQLPreferences)
+            await this._prefs.checkpoint();
+    }
+
     get type() {
         return 'cloud';
     }
@@ -28,6 +28,10 @@ export default class SQLPreferences extends Tp.Preferences {
     private _baseUrl : string;
     private _auth : string;
     private _data : Record<string, unknown>;
+    // writes that have not reached the database yet
+    private _pending : Set<Promise<void>>;
+    // keys whose last write failed
+    private _failed : Set<string>;
 
     constructor(baseUrl : string, accessToken : string) {
         super();
@@ -35,6 +39,8 @@ export default class SQLPreferences extends Tp.Preferences {
         this._baseUrl = baseUrl;
         this._auth = `Bearer ${accessToken}`;
         this._data = {};
+        this._pending = new Set;
+        this._failed = new Set;
     }
 
     async init() {
@@ -53,7 +59,14 @@ export default class SQLPreferences extends Tp.Preferences {
         return `${this._baseUrl}/localtable/user_preference/${encodeURIComponent(uniqueId)}`;
     }
 
-    private async _flush(key : string) {
+    private _flush(key : string) {
+        const promise : Promise<void> = this._write(key).finally(() => {
+            this._pending.delete(promise);
+        });
+        this._pending.add(promise);
+    }
+
+    private async _write(key : string) {
         try {
             if (this._data[key] === undefined) {
                 await Tp.Helpers.Http.request(this._getObjectUrl(key), 'DELETE', '', { auth: this._auth });
@@ -64,11 +77,34 @@ export default class SQLPreferences extends Tp.Preferences {
                     auth: this._auth,
                 });
             }
+            this._failed.delete(key);
         } catch(e) {
             console.error(`Failed to flush preference update to database: ${e.message}`);
+            this._failed.add(key);
         }
     }
 
+    private async _settle() {
+        while (this._pending.size > 0)
+            await Promise.all(this._pending);
+    }
+
+    /**
+     * Wait until every preference written so far is stored in the database.
+     *
+     * Writes happen in the background, so this is the barrier to cross before
+     * the preferences are read again from another process. Keys that failed to
+     * be written are written once more, and the call rejects if they fail again.
+     */
+    async checkpoint() {
+        await this._settle();
+        for (const key of Array.from(this._failed))
+            this._flush(key);
+        await this._settle();
+        if (this._failed.size > 0)
+            throw new Error(`Failed to write preferences ${Array.from(this._failed).join(', ')} to database`);
+    }
+
     get(key : string) : unknown {
         return this._data[key];
     }
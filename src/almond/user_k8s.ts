@@ -19,9 +19,23 @@
 import * as k8s from '@kubernetes/client-node';
 import sleep from '../util/sleep';
 
+type Condition = {
+    type : string,
+    status : 'True'|'False'|'Unknown',
+    reason : string,
+    message : string,
+}
+
 type User = {
-    spec : {id : number, mode : string}
-    status : {backend : string, state : string}
+    spec : {id : number, mode : string, suspended ?: boolean}
+    status : {
+        backend : string,
+        state : string,
+        lastError ?: string,
+        restartCount ?: number,
+        idleShutdownTime ?: string,
+        conditions ?: Condition[],
+    }
 }
 
 type UserList = {
@@ -35,6 +49,11 @@ type UserList = {
 export default class UserK8sApi {
     static readonly Running = "running";
     static readonly Stopped = "stopped";
+    static readonly Error = "error";
+    static readonly Failed = "failed";
+    static readonly CacheVersionAnnotation = "backend.almond.stanford.edu/cache-version";
+    static readonly PurgeCacheAnnotation = "backend.almond.stanford.edu/purge-cache";
+    static readonly WakeAnnotation = "backend.almond.stanford.edu/wake";
 
     private api : k8s.CustomObjectsApi;
     private namespace : string;
@@ -61,16 +80,36 @@ export default class UserK8sApi {
        return null;
     }
 
-    // poll every half second until user is ready or timedout. Error is thrown if timedout.
+    static isReady(user : User) : boolean {
+        if (!user.status || !user.status.backend)
+            return false;
+        const ready = (user.status.conditions || []).find((c) => c.type === 'Ready');
+        if (ready)
+            return ready.status === 'True';
+        return user.status.state === UserK8sApi.Running;
+    }
+
+    // poll every half second until user is ready or timedout. Error is thrown if timedout,
+    // with the last error of the user if any, or right away if the engine of the user failed
+    // or the user is suspended.
     async waitForUser(id : number, millis : number) : Promise<User> {
         const waitms = 500;
         const deadline = Date.now() + millis;
+        let lastError : string|undefined;
         while (Date.now() < deadline) {
             const user = await this.getUser(id);
-            if (user && user.status && user.status.backend && user.status.state === UserK8sApi.Running)
+            if (user && UserK8sApi.isReady(user))
                 return user;
+            if (user && user.status && user.status.state === UserK8sApi.Failed)
+                throw new Error(`user ${id} engine failed: ${user.status.lastError}`);
+            if (user && user.spec.suspended)
+                throw new Error(`user ${id} is suspended`);
+            if (user && user.status && user.status.state === UserK8sApi.Error)
+                lastError = user.status.lastError;
             await sleep(waitms);
         }
+        if (lastError)
+            throw new Error(`wait for user ${id} timedout: ${lastError}`);
         throw new Error(`wait for user ${id} timedout`);
     }
 
@@ -99,9 +138,70 @@ export default class UserK8sApi {
        return false;
     }
 
-    async deleteUser(id : number) : Promise<boolean> {
+    /**
+     * Tell the controller that the database row of a user changed.
+     *
+     * This bumps the cache-version annotation of the User, which makes the
+     * controller drop its cached copy of the user and reconcile it.
+     */
+    async invalidateUser(id : number) : Promise<boolean> {
+        try {
+            await this._annotate(id, { [UserK8sApi.CacheVersionAnnotation]: String(Date.now()) });
+            return true;
+        } catch(e) {
+            // no User means no cached copy either
+            if (e.statusCode === 404)
+                return true;
+            console.error(`invalidate user failed: ${JSON.stringify(e)}`);
+        }
+       return false;
+    }
+
+    static isAsleep(user : User) : boolean {
+        return !!user.status && !!user.status.idleShutdownTime;
+    }
+
+    /**
+     * Ask the controller to start again the engine of a user that was shut down
+     * for being idle.
+     */
+    async wakeUser(id : number) : Promise<boolean> {
+        try {
+            console.info(`waking up user ${id}`);
+            await this._annotate(id, { [UserK8sApi.WakeAnnotation]: String(Date.now()) });
+            return true;
+        } catch(e) {
+            console.error(`wake up user failed: ${JSON.stringify(e)}`);
+        }
+       return false;
+    }
+
+    private async _annotate(id : number, annotations : Record<string, string>) {
+        const body = { metadata: { annotations } };
+        await this.api.patchNamespacedCustomObject(
+            "backend.almond.stanford.edu",
+            "v1",
+            this.namespace,
+            "users",
+            `user-${id}`,
+            body,
+            undefined, // dryRun
+            undefined, // fieldManager
+            undefined, // force
+            { headers: { 'Content-Type': 'application/merge-patch+json' } });
+    }
+
+    /**
+     * Delete the User of a user, which stops its engine.
+     *
+     * With purgeCache, the controller also drops its cached copy of the user,
+     * otherwise the copy is kept for when the engine starts again.
+     */
+    async deleteUser(id : number, purgeCache = false) : Promise<boolean> {
         try {
             console.info(`deleting user ${id}`);
+            if (purgeCache)
+                await this._annotate(id, { [UserK8sApi.PurgeCacheAnnotation]: "true" });
             await this.api.deleteNamespacedCustomObject(
                 "backend.almond.stanford.edu",
                 "v1",
@@ -23,12 +23,15 @@ import expressWS from 'express-ws';
 import WebSocket from "ws";
 
 import * as http from 'http';
+import * as os from 'os';
 import * as rpc from 'transparent-rpc';
 import * as argparse from 'argparse';
+import * as Tp from 'thingpedia';
 
 import PlatformModule, { PlatformOptions } from './platform';
 import JsonWebSocketAdapter from '../util/json_websocket';
 import * as i18n from '../util/i18n';
+import { checkSigningConfig, keepRawBody, requireFreshSignature, requireSignature, signRequest, verifyUpgrade } from '../util/engine_api_auth';
 import Engine from './engine';
 
 interface EngineState {
@@ -36,44 +39,91 @@ interface EngineState {
     running : boolean;
     sockets : Set<rpc.Socket>;
     stopped : boolean;
+    draining : boolean;
     engine ?: Engine;
+    // dbproxy access token of the user, also used to report engine events
+    accessToken : string|null;
+    // last status reported to the controller
+    reportedStatus : string;
+    // the controller keeps the engine running while it is idle, so idleness is not reported
+    alwaysOn : boolean;
 }
 
+// the interval to check engines for status changes to report to the controller
+const STATUS_CHECK_INTERVAL = 2000;
+
+// how long the result of a finished drain is kept for the controller to check
+const DRAIN_RESULT_TTL = 10 * 60 * 1000;
+
+// the checkpoint of an engine drained off this worker, must match DrainResult in
+// go/k8s/controllers/engine_api.go
+type DrainResult = 'draining'|'drained'|'failed'|'not-running';
+
 class Worker {
     private app : express.Application;
     private server : http.Server;
     private engines : Map<number, EngineState>; 
+    private drainResults : Map<number, DrainResult>;
     private stopped : boolean;
+    private maxEngines : number;
+    private controllerUrl : string|null;
 
-    constructor(port : number) {
+    constructor(port : number, maxEngines : number, controllerUrl : string|null) {
         this.engines = new Map<number, EngineState>();
+        this.drainResults = new Map<number, DrainResult>();
         this.stopped = false;
+        this.maxEngines = maxEngines;
+        this.controllerUrl = controllerUrl;
         this.app = express();
         this.server = http.createServer(this.app);
         expressWS(this.app, this.server);
-        this.app.use(express.json());
-        this.app.use(express.urlencoded({ extended: true }));
+        this.app.use(express.json({ verify: keepRawBody }));
+        this.app.use(express.urlencoded({ extended: true, verify: keepRawBody }));
         this.app.set('port', port);
 
-        this.app.post('/run-engine', (req, res, next) => {
+        this.app.post('/run-engine', requireFreshSignature, (req, res, next) => {
             Promise.resolve().then(async () => {
                 res.json({"result": "ok", "data": this.runEngine(req.body)});
             }).catch(next);
         });
 
-        this.app.get('/kill-engine', (req, res, next) => {
+        this.app.get('/kill-engine', requireFreshSignature, (req, res, next) => {
             Promise.resolve().then(async () => {
                 res.json({"result": "ok", "data": this.killEngine(Number(req.query.userid))});
             }).catch(next);
         });
 
-        this.app.get('/engine-status', (req, res, next) => {
+        this.app.get('/drain-engine', requireFreshSignature, (req, res, next) => {
+            Promise.resolve().then(async () => {
+                res.json({"result": "ok", "data": this.drainEngine(Number(req.query.userid))});
+            }).catch(next);
+        });
+
+        this.app.get('/engine-status', requireSignature, (req, res, next) => {
             Promise.resolve().then(async () => {
                 res.json({"result": "ok", "data": this.engineStatus(Number(req.query.userid))});
             }).catch(next);
         });
 
+        this.app.get('/engine-statuses', requireSignature, (req, res, next) => {
+            Promise.resolve().then(async () => {
+                res.json({"result": "ok", "data": this.engineStatuses()});
+            }).catch(next);
+        });
+
+        this.app.get('/load', requireSignature, (req, res, next) => {
+            Promise.resolve().then(async () => {
+                res.json({"result": "ok", "data": this.load()});
+            }).catch(next);
+        });
+
         this.app.use('/engine', express.Router().ws('', async (ws : WebSocket, req : express.Request) => {
+            const error = verifyUpgrade(req);
+            if (error !== null) {
+                // 1008 is policy violation
+                ws.close(1008, error);
+                return;
+            }
             this.connectWSEngine(ws);
         }));
 
@@ -88,9 +138,43 @@ class Worker {
             });
         }).then(() => {
             console.log('Express server listening on port ' + this.app.get('port'));
+            if (this.controllerUrl)
+                setInterval(() => this.checkEngineStatuses(), STATUS_CHECK_INTERVAL);
         });
     }
 
+    // reportEvent tells the controller that an engine started, went idle, crashed or stopped,
+    // so it does not have to wait for its next poll. The event is signed like the requests
+    // of the controller, and carries the access token of the engine to name the user. The
+    // hostname of the backend is the name of its pod, the controller drops events from a pod
+    // that is not the current backend of the user.
+    reportEvent(obj : EngineState, event : 'started'|'idle'|'crashed'|'stopped') {
+        if (!this.controllerUrl || !obj.accessToken)
+            return;
+        const url = `${this.controllerUrl}/engine-events`;
+        const body = JSON.stringify({ userId: obj.userId, event, pod: os.hostname() });
+        Tp.Helpers.Http.post(url, body, {
+            dataContentType: 'application/json',
+            auth: `Bearer ${obj.accessToken}`,
+            extraHeaders: signRequest('POST', url, body),
+        }).catch((e) => {
+            console.error(`Failed to report ${event} event of engine ${obj.userId}: ${e.message}`);
+        });
+    }
+
+    checkEngineStatuses() {
+        for (const obj of this.engines.values()) {
+            const status = this.engineStatus(obj.userId);
+            if (status === obj.reportedStatus)
+                continue;
+            obj.reportedStatus = status;
+            if (status === 'running')
+                this.reportEvent(obj, 'started');
+            else if (status === 'idle' && !obj.alwaysOn)
+                this.reportEvent(obj, 'idle');
+        }
+    }
+
     handleSignal() {
         for (const obj of this.engines.values()) {
             console.log('Stopping engine of ' + obj.userId);
@@ -115,6 +199,7 @@ class Worker {
         console.log(`Run engine ${options.userId}`);
         if (this.engines.get(options.userId))
             return true;
+        this.drainResults.delete(options.userId);
 
         const platform = PlatformModule.newInstance(null, options);
 
@@ -122,20 +207,28 @@ class Worker {
             userId: options.userId,
             running: false,
             sockets: new Set,
-            stopped: false
+            stopped: false,
+            draining: false,
+            accessToken: options.dbProxyAccessToken,
+            reportedStatus: 'stopped',
+            alwaysOn: !!options.alwaysOn
         };
 
         platform.init().then(() => {
+            // the engine was killed or drained while the platform initialized
+            if (this.stopped || obj.stopped)
+                return Promise.resolve();
             obj.engine = new Engine(platform, {
                 thingpediaUrl: PlatformModule.thingpediaUrl,
                 nluModelUrl: PlatformModule.nlServerUrl,
                 notifications: PlatformModule.notificationConfig,
-                activityMonitorOptions: PlatformModule.activityMonitorOptions
+                activityMonitorOptions: options.idleTimeoutMillis ? {
+                    ...PlatformModule.activityMonitorOptions,
+                    idleTimeoutMillis: options.idleTimeoutMillis
+                } : PlatformModule.activityMonitorOptions
                 // nlg will be set to the same URL
             });
             obj.engine!.activityMonitor!.name = `Activity monitor ${options.userId}`;
-            if (this.stopped || obj.stopped)
-                return Promise.resolve();
             return obj.engine.open();
         }).then(() => {
             if (this.stopped || obj.stopped)
@@ -144,11 +237,25 @@ class Worker {
             obj.running = true;
             return obj.engine!.run();
         }).then(() => {
-            return obj.engine!.close();
+            if (obj.engine)
+                return obj.engine.close();
+            return Promise.resolve();
+        }).then(async () => {
+            // a drained engine is gone once its state is saved
+            if (obj.draining && this.engines.get(options.userId) === obj) {
+                await platform.checkpoint();
+                this.engines.delete(options.userId);
+                this.setDrainResult(options.userId, 'drained');
+                this.reportEvent(obj, 'stopped');
+            }
         }).catch((e) => {
             console.error('Engine ' + options.userId + ' had a fatal error: ' + e.message);
             console.error(e.stack);
-            this.engines.delete(options.userId);
+            if (this.engines.get(options.userId) === obj)
+                this.engines.delete(options.userId);
+            if (obj.draining)
+                this.setDrainResult(options.userId, 'failed');
+            this.reportEvent(obj, 'crashed');
         });
 
         this.engines.set(options.userId, obj);
@@ -170,8 +277,45 @@ class Worker {
         return true;
     }
 
+    // drainEngine stops an engine that is moving to another backend. Clients are
+    // disconnected so they reconnect to the new backend, and the engine is closed.
+    // Closing does not wait for the preferences, which are written to dbproxy in
+    // the background, so the drain is done only once the platform checkpoint
+    // confirms they are stored. An engine that is still initializing stops once
+    // its platform is ready, so it cannot keep running after the drain.
+    // The engine reports "draining" until its state is stored, then "stopped".
+    //
+    // Draining again returns how the drain is going: 'draining' until the state
+    // of the engine is stored, then 'drained', or 'failed' if it stopped with an
+    // error or its state could not be stored.
+    drainEngine(userId : number) : DrainResult {
+        console.log(`Draining engine ${userId}`);
+        const obj = this.engines.get(userId);
+        if (!obj)
+            return this.drainResults.get(userId) || 'not-running';
+        if (obj.draining)
+            return 'draining';
+        obj.draining = true;
+        obj.stopped = true;
+        for (const sock of obj.sockets)
+            sock.end();
+        if (obj.running)
+            obj.engine!.stop();
+        return 'draining';
+    }
+
+    private setDrainResult(userId : number, result : DrainResult) {
+        this.drainResults.set(userId, result);
+        setTimeout(() => {
+            if (this.drainResults.get(userId) === result)
+                this.drainResults.delete(userId);
+        }, DRAIN_RESULT_TTL);
+    }
+
    engineStatus(userId : number) : string {
         const obj = this.engines.get(userId);
+        if (obj && obj.draining)
+            return "draining";
         if (!obj || !obj.running)
             return "stopped";
         if (obj.engine && obj.engine.activityMonitor)
@@ -179,6 +323,28 @@ class Worker {
         return "running";
     }
 
+    // engineStatuses returns the status of every engine of this worker, keyed by user id,
+    // so the controller can poll all engines with one request.
+    engineStatuses() : Record<number, string> {
+        const statuses : Record<number, string> = {};
+        for (const userId of this.engines.keys())
+            statuses[userId] = this.engineStatus(userId);
+        return statuses;
+    }
+
+    load() {
+        let running = 0;
+        for (const obj of this.engines.values()) {
+            if (obj.running)
+                running++;
+        }
+        return {
+            engines: this.engines.size,
+            running: running,
+            capacity: this.maxEngines,
+        };
+    }
+
     handleDirectSocket(userId : number, replyId : string, jsonSocket : JsonWebSocketAdapter) {
         console.log(`Handling direct connection for ${userId} replyId:${replyId}`);
 
@@ -188,7 +354,7 @@ class Worker {
         });
 
         const obj = this.engines.get(userId);
-        if (!obj || !obj.engine) {
+        if (!obj || !obj.engine || obj.draining) {
             console.log('Could not find an engine with the required user ID');
             rpcSocket.call(replyId, 'error', ['Invalid user ID ' + userId]);
             rpcSocket.end();
@@ -271,6 +437,14 @@ export function initArgparse(subparsers : argparse.SubParser) {
         required: true,
         help: 'FAQ model configuration',
     });
+    parser.add_argument('--max-engines', {
+        type: 'int',
+        help: 'Maximum number of engines reported to the controller, 0 if unlimited',
+        default: 0,
+    });
+    parser.add_argument('--controller-url', {
+        help: 'URL of the engine events endpoint of the controller manager, engine events are not reported if unset',
+    });
     parser.add_argument('--activity-monitor-idle-timeout-millis', {
         type: 'int',
         help: 'ActivityMonitorOptions.idleTimeoutMillis',
@@ -284,9 +458,10 @@ export function initArgparse(subparsers : argparse.SubParser) {
 }
 
 export async function main(argv : any) {
+    checkSigningConfig();
     i18n.init(argv.locale);
     PlatformModule.init(argv);
-    const worker = new Worker(argv.port);
+    const worker = new Worker(argv.port, argv.max_engines, argv.controller_url || null);
     process.on('SIGINT', () => { worker.handleSignal(); });
     process.on('SIGTERM', () => { worker.handleSignal(); });
     worker.start();
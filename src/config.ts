@@ -74,6 +74,27 @@ export let SECRET_KEY : string = process.env.SECRET_KEY!;
 */
 export let JWT_SIGNING_KEY : string = process.env.JWT_SIGNING_KEY!;
 
+/**
+  Secret key for signing requests to the engine API of backends.
+
+  This is shared between the Kubernetes controller, the frontends and the backends,
+  which sign `/run-engine`, `/kill-engine`, the `/engine` websocket, engine events
+  and the other engine API calls with HMAC-SHA256. It is recommended to choose 64
+  random HEX characters (256 bit security).
+
+  The backends, the controller and the frontends in Kubernetes refuse to start if
+  this option is not set, unless `ENGINE_API_ALLOW_UNSIGNED` is set.
+*/
+export let ENGINE_API_SIGNING_KEY : string|null = null;
+
+/**
+  Allow the engine API to run unsigned when `ENGINE_API_SIGNING_KEY` is not set.
+
+  Engine API requests are then not signed and backends accept any request, so the
+  backends must not be reachable from untrusted parts of the network.
+*/
+export let ENGINE_API_ALLOW_UNSIGNED = false;
+
 /**
   Symmetric encryption key for user authentication material
 
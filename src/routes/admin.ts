@@ -224,11 +224,10 @@ router.post('/users/promote/:id', user.requireRole(user.Role.ADMIN), (req, res,
             await model.update(dbClient, user.id, { developer_status: user.developer_status + 1 });
             return false;
         }
-    }).then((needsRestart) => {
+    }).then(async (needsRestart) => {
+        await EngineManager.get().invalidateUser(id);
         if (needsRestart)
-            return EngineManager.get().restartUser(id);
-        else
-            return Promise.resolve();
+            await EngineManager.get().restartUser(id);
     }).then(() => {
         res.redirect(303, '/admin/users/search?q=' + id);
     }).catch(next);
@@ -248,7 +247,7 @@ router.post('/users/demote/:id', user.requireRole(user.Role.ADMIN), (req, res, n
         if (user.developer_status <= 0)
             return;
         await model.update(dbClient, id, { developer_status: user.developer_status - 1 });
-    }).then(() => {
+    }).then(() => EngineManager.get().invalidateUser(id)).then(() => {
         res.redirect(303, '/admin/users/search?q=' + req.params.id);
     }).catch(next);
 });
@@ -360,6 +359,7 @@ router.post('/organizations/add-member', user.requireRole(user.Role.THINGPEDIA_A
         return user.id;
     }).then(async (userId) => {
         if (userId !== null) {
+            await EngineManager.get().invalidateUser(userId);
             await EngineManager.get().restartUser(userId);
             res.redirect(303, '/admin/organizations/details/' + req.body.id);
         }
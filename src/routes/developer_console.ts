@@ -159,6 +159,7 @@ router.get('/organization/accept-invitation/:id_hash', user.requireLogIn, (req,
         return [req.user!.id, org.name] as const;
     }).then(async ([userId, orgName]) => {
         if (userId !== null) {
+            await EngineManager.get().invalidateUser(userId);
             await EngineManager.get().restartUser(userId);
             res.render('message', {
                 page_title: req._("Genie - Developer Invitation"),
@@ -191,7 +192,9 @@ router.post('/organization/remove-member', user.requireLogIn, user.requireDevelo
             throw new BadRequestError(req._("The user is not a member of your developer organization."));
 
         await user.makeDeveloper(dbClient, users[0].id, null);
-        const userId = users[0].id;
+        return users[0].id;
+    }).then(async (userId) => {
+        // the controller must not reload the user before the transaction commits
         await EngineManager.get().restartUserWithoutCache(userId);
         res.redirect(303, '/developers');
     }).catch(next);
@@ -210,7 +213,10 @@ router.post('/organization/promote', user.requireLogIn, user.requireDeveloper(us
         await userModel.update(dbClient, users[0].id, {
             developer_status: users[0].developer_status + 1,
         });
-    }).then(() => {
+        return users[0].id;
+    }).then(async (userId) => {
+        if (userId !== undefined)
+            await EngineManager.get().invalidateUser(userId);
         res.redirect(303, '/developers');
     }).catch(next);
 });
@@ -230,7 +236,10 @@ router.post('/organization/demote', user.requireLogIn, user.requireDeveloper(use
         await userModel.update(dbClient, users[0].id, {
             developer_status: users[0].developer_status - 1,
         });
-    }).then(() => {
+        return users[0].id;
+    }).then(async (userId) => {
+        if (userId !== undefined)
+            await EngineManager.get().invalidateUser(userId);
         res.redirect(303, '/developers');
     }).catch(next);
 });
@@ -241,7 +241,7 @@ router.post('/2fa/setup', userUtils.requireLogIn, iv.validatePOST({ encrypted_ke
             page_title: req._("Genie - Two-Factor Authentication"),
             message: req._("Two-factor authentication was set up successfully. You will need to use your Authenticator app at the next login.")
         });
-    }).catch(next);
+    }).then(() => EngineManager.get().invalidateUser(req.user!.id)).catch(next);
 });
 
 router.get('/register', (req, res, next) => {
@@ -447,7 +447,7 @@ router.get('/verify-email/:token', userUtils.requireLogIn, (req, res, next) => {
         res.render('email_verified', {
             page_title: req._("Genie - Verification Successful")
         });
-    }).catch(next);
+    }).then(() => EngineManager.get().invalidateUser(req.user!.id)).catch(next);
 });
 
 router.post('/resend-verification', userUtils.requireLogIn, (req, res, next) => {
@@ -639,6 +639,11 @@ router.post('/recovery/continue', iv.validatePOST({ token: 'string', password: '
             page_title: req._("Genie - Password Reset"),
             message: req._("Your password was reset successfully.")
         });
+        return user.id;
+    }).then((userId) => {
+        if (userId !== undefined)
+            return EngineManager.get().invalidateUser(userId);
+        return Promise.resolve();
     }).catch(next);
 });
 
@@ -757,6 +762,7 @@ router.post('/profile', userUtils.requireLogIn, iv.validatePOST({
         return getProfile(req, res, undefined, error);
     }).then(async () => {
         // this must happen outside of the transaction, or the restarted engine will not see the new locale data
+        await EngineManager.get().invalidateUser(req.user!.id);
         if (mustRestartEngine)
             await EngineManager.get().restartUser(req.user!.id);
     }).catch(next);
@@ -789,7 +795,7 @@ router.post('/change-password', userUtils.requireLogIn, iv.validatePOST({ passwo
 
         return db.withTransaction((dbClient) => {
             return userUtils.update(dbClient, req.user!, oldpassword, password);
-        }).then(() => {
+        }).then(() => EngineManager.get().invalidateUser(req.user!.id)).then(() => {
             res.redirect(303, '/user/profile');
         });
     }).catch((e) => {
@@ -892,6 +898,7 @@ router.post('/request-developer', userUtils.requireLogIn, iv.validatePOST({
         await sendNewOrgNotificationEmail(req);
         return org;
     }).then(async (org) => {
+        await EngineManager.get().invalidateUser(req.user!.id);
         await EngineManager.get().restartUser(req.user!.id);
         req.user!.developer_org = org.id;
         req.user!.developer_org_name = org.name;
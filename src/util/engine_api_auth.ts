@@ -0,0 +1,187 @@
+// -*- mode: typescript; indent-tabs-mode: nil; js-basic-offset: 4 -*-
+//
+// This file is part of Almond
+//
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Signatures of requests to the engine API of backends.
+//
+// The signature is the hex HMAC-SHA256, keyed with ENGINE_API_SIGNING_KEY, of
+//   METHOD "\n" REQUEST_URI "\n" TIMESTAMP "\n" NONCE "\n" hex(sha256(BODY))
+// where TIMESTAMP is in unix seconds and NONCE is random for every request.
+// Requests that change state are accepted once per nonce. This must match
+// go/enginesig.
+
+import * as crypto from 'crypto';
+import * as http from 'http';
+import express from 'express';
+import { URL } from 'url';
+
+import * as Config from '../config';
+
+export const TIMESTAMP_HEADER = 'X-Almond-Timestamp';
+export const NONCE_HEADER = 'X-Almond-Nonce';
+export const SIGNATURE_HEADER = 'X-Almond-Signature';
+
+// how far the timestamp of a request may be from the time it is verified, in seconds
+const MAX_SKEW = 300;
+
+function computeSignature(key : string, method : string, requestUri : string, timestamp : string,
+                          nonce : string, body : Buffer|string) {
+    const bodyHash = crypto.createHash('sha256').update(body).digest('hex');
+    return crypto.createHmac('sha256', key)
+        .update(`${method}\n${requestUri}\n${timestamp}\n${nonce}\n${bodyHash}`)
+        .digest('hex');
+}
+
+/**
+ * Check that the engine API can be used with the configuration.
+ *
+ * Throws if ENGINE_API_SIGNING_KEY is not set, unless ENGINE_API_ALLOW_UNSIGNED is.
+ */
+export function checkSigningConfig() {
+    if (!Config.ENGINE_API_SIGNING_KEY && !Config.ENGINE_API_ALLOW_UNSIGNED)
+        throw new Error('Invalid configuration, ENGINE_API_SIGNING_KEY must be set, or ENGINE_API_ALLOW_UNSIGNED to use the engine API unsigned');
+}
+
+/**
+ * Compute the headers that sign a request to the engine API.
+ *
+ * Returns no headers if ENGINE_API_SIGNING_KEY is not set.
+ */
+export function signRequest(method : string, url : string, body : string = '') : Record<string, string> {
+    const key = Config.ENGINE_API_SIGNING_KEY;
+    if (!key)
+        return {};
+    const parsed = new URL(url);
+    const timestamp = String(Math.floor(Date.now() / 1000));
+    const nonce = crypto.randomBytes(16).toString('hex');
+    return {
+        [TIMESTAMP_HEADER]: timestamp,
+        [NONCE_HEADER]: nonce,
+        [SIGNATURE_HEADER]: computeSignature(key, method, parsed.pathname + parsed.search, timestamp, nonce, body)
+    };
+}
+
+/**
+ * Check the signature of a request to the engine API.
+ *
+ * Returns an error message, or null if the request is signed correctly.
+ */
+export function verifyRequest(key : string, method : string, requestUri : string,
+                              timestamp : string|undefined, nonce : string|undefined, signature : string|undefined,
+                              body : Buffer|string, now = Date.now()) : string|null {
+    if (!timestamp || !nonce || !signature)
+        return 'missing request signature';
+    const ts = Number(timestamp);
+    if (!/^[0-9]+$/.test(timestamp) || !Number.isFinite(ts))
+        return 'malformed request timestamp';
+    if (Math.abs(now / 1000 - ts) > MAX_SKEW)
+        return 'request timestamp out of range';
+    const expected = Buffer.from(computeSignature(key, method, requestUri, timestamp, nonce, body));
+    const actual = Buffer.from(signature);
+    if (expected.length !== actual.length || !crypto.timingSafeEqual(expected, actual))
+        return 'invalid request signature';
+    return null;
+}
+
+// the nonces of accepted requests that change state, with the time their timestamp
+// expires, in unix seconds
+const usedNonces = new Map<string, number>();
+let nextNonceSweep = 0;
+
+/**
+ * Record the nonce of a request that changes state.
+ *
+ * Returns false if the nonce was used before, and the request is a replay.
+ */
+export function useNonce(nonce : string, timestamp : string, now = Date.now()) : boolean {
+    const nowSeconds = now / 1000;
+    if (nowSeconds >= nextNonceSweep) {
+        for (const [used, expires] of usedNonces) {
+            if (expires < nowSeconds)
+                usedNonces.delete(used);
+        }
+        nextNonceSweep = nowSeconds + MAX_SKEW;
+    }
+    if (usedNonces.has(nonce))
+        return false;
+    usedNonces.set(nonce, Number(timestamp) + MAX_SKEW);
+    return true;
+}
+
+/**
+ * Keep the raw body of a request, to verify its signature after the body is parsed.
+ *
+ * Pass as the `verify` option of the express body parsers.
+ */
+export function keepRawBody(req : http.IncomingMessage, res : http.ServerResponse, buf : Buffer) {
+    (req as any).rawBody = buf;
+}
+
+function checkRequest(req : express.Request, requestUri : string, once : boolean) : string|null {
+    const key = Config.ENGINE_API_SIGNING_KEY;
+    if (!key)
+        return Config.ENGINE_API_ALLOW_UNSIGNED ? null : 'engine API signing key not configured';
+    const timestamp = req.get(TIMESTAMP_HEADER);
+    const nonce = req.get(NONCE_HEADER);
+    const error = verifyRequest(key, req.method, requestUri, timestamp, nonce,
+        req.get(SIGNATURE_HEADER), (req as any).rawBody || '');
+    if (error !== null)
+        return error;
+    if (once && !useNonce(nonce!, timestamp!))
+        return 'request replayed';
+    return null;
+}
+
+/**
+ * Express middleware that rejects requests not signed with ENGINE_API_SIGNING_KEY.
+ *
+ * If the key is not set, all requests are accepted with ENGINE_API_ALLOW_UNSIGNED,
+ * and rejected otherwise.
+ */
+export function requireSignature(req : express.Request, res : express.Response, next : express.NextFunction) {
+    const error = checkRequest(req, req.originalUrl, false);
+    if (error !== null) {
+        res.status(401).json({ result: 'error', data: error });
+        return;
+    }
+    next();
+}
+
+/**
+ * Express middleware for requests that change state: like requireSignature, but each
+ * signed request is accepted only once, so it cannot be replayed.
+ */
+export function requireFreshSignature(req : express.Request, res : express.Response, next : express.NextFunction) {
+    const error = checkRequest(req, req.originalUrl, true);
+    if (error !== null) {
+        res.status(401).json({ result: 'error', data: error });
+        return;
+    }
+    next();
+}
+
+/**
+ * Check the signature of a websocket upgrade to the engine API.
+ *
+ * express-ws routes the upgrade under a URL with "/.websocket" appended to the path,
+ * the signature covers the URL requested by the client. Like requests that change
+ * state, each upgrade is accepted only once. Returns an error message, or null if
+ * the upgrade is signed correctly or unsigned upgrades are allowed.
+ */
+export function verifyUpgrade(req : express.Request) : string|null {
+    return checkRequest(req, req.originalUrl.replace(/\/\.websocket(?=\?|$)/, ''), true);
+}
@@ -96,6 +96,7 @@ async function autoAdjustUsername(dbClient : db.Client, username : string) : Pro
 
 function authenticateGoogle(req : Request, accessToken : string, refreshToken : string|undefined, profile : any,
                             done : (err ?: Error|null, user ?: Express.User) => void) {
+    let associated = false;
     db.withTransaction(async (dbClient) : Promise<Express.User> =>  {
         const rows = await model.getByGoogleAccount(dbClient, profile.id);
         if (rows.length > 0) {
@@ -113,6 +114,7 @@ function authenticateGoogle(req : Request, accessToken : string, refreshToken :
                 throw new ForbiddenError(req._("A user with this email already exist, but the email was not verified before."));
 
             await model.update(dbClient, byEmail[0].id, { google_id: profile.id });
+            associated = true;
             await model.recordLogin(dbClient, byEmail[0].id);
             byEmail[0].google_id = profile.id;
             return byEmail[0];
@@ -139,6 +141,8 @@ function authenticateGoogle(req : Request, accessToken : string, refreshToken :
         user.newly_created = true;
         return user;
     }).then(async (user) : Promise<Express.User> => {
+        if (associated)
+            await EngineManager.get().invalidateUser(user.id);
         if (!user.newly_created)
             return user;
 
@@ -163,23 +167,24 @@ function authenticateGoogle(req : Request, accessToken : string, refreshToken :
 function associateGoogle(user : Express.User, accessToken : string, refreshToken : string|undefined, profile : any,
                          done : (err ?: Error|null, user ?: Express.User) => void) {
     db.withTransaction((dbClient) => {
-        return model.update(dbClient, user.id, { google_id: profile.id }).then(() => {
-            // asynchronously inject google-account device
-            EngineManager.get().getEngine(user.id).then((engine : any /* FIXME */) => {
-                return engine.createDeviceAndReturnInfo({
-                    kind: 'com.google',
-                    profileId: profile.id,
-                    accessToken: accessToken,
-                    refreshToken: refreshToken
-                });
+        return model.update(dbClient, user.id, { google_id: profile.id });
+    }).then(() => EngineManager.get().invalidateUser(user.id)).then(() => {
+        // asynchronously inject google-account device
+        EngineManager.get().getEngine(user.id).then((engine : any /* FIXME */) => {
+            return engine.createDeviceAndReturnInfo({
+                kind: 'com.google',
+                profileId: profile.id,
+                accessToken: accessToken,
+                refreshToken: refreshToken
             });
-            return user;
         });
+        return user;
     }).then((user) => done(null, user), done);
 }
 
 function authenticateGithub(req : Request, accessToken : string, refreshToken : string|undefined, profile : any,
                             done : (err ?: Error|null, user ?: Express.User) => void) {
+    let associated = false;
     db.withTransaction(async (dbClient) => {
         const rows = await model.getByGithubAccount(dbClient, profile.id);
         if (rows.length > 0) {
@@ -199,6 +204,7 @@ function authenticateGithub(req : Request, accessToken : string, refreshToken :
                 throw new ForbiddenError(req._("A user with this email already exist, but the email was not verified before."));
 
             await model.update(dbClient, byEmail[0].id, { github_id: profile.id });
+            associated = true;
             await model.recordLogin(dbClient, byEmail[0].id);
             byEmail[0].github_id = profile.id;
             return byEmail[0];
@@ -222,6 +228,10 @@ function authenticateGithub(req : Request, accessToken : string, refreshToken :
         const user : Express.User = await model.get(dbClient, row.id);
         user.newly_created = true;
         return user;
+    }).then(async (user) => {
+        if (associated)
+            await EngineManager.get().invalidateUser(user.id);
+        return user;
     }).then((user) => done(null, user), done);
 }
 
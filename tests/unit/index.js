@@ -42,5 +42,6 @@ seq([
     ('./test_k8s_api'),
     ('./test_kf_inference_url'),
     ('./test_json_websocket'),
+    ('./test_sql_preferences'),
     ('./test_class_validation')
 ]);
@@ -0,0 +1,111 @@
+// -*- mode: typescript; indent-tabs-mode: nil; js-basic-offset: 4 -*-
+//
+// This file is part of Almond
+//
+// Copyright 2021 The Board of Trustees of the Leland Stanford Junior University
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+import assert from 'assert';
+import http from 'http';
+import { AddressInfo } from 'net';
+
+import SQLPreferences from '../../src/almond/preferences';
+
+// a dbproxy that stores preferences slowly, and fails the writes it is told to
+class FakeDBProxy {
+    stored : Record<string, unknown> = {};
+    failures : Record<string, number> = {};
+    private _server : http.Server;
+
+    constructor() {
+        this._server = http.createServer((req, res) => {
+            const key = decodeURIComponent(req.url!.substring('/localtable/user_preference/'.length));
+            let body = '';
+            req.on('data', (chunk) => body += chunk);
+            req.on('end', () => {
+                setTimeout(() => {
+                    if (this.failures[key] > 0) {
+                        this.failures[key]--;
+                        res.statusCode = 500;
+                        res.end();
+                        return;
+                    }
+                    if (req.method === 'DELETE')
+                        delete this.stored[key];
+                    else
+                        this.stored[key] = JSON.parse(JSON.parse(body).value);
+                    res.setHeader('Content-Type', 'application/json');
+                    res.end(JSON.stringify({ result: 'ok' }));
+                }, 50);
+            });
+        });
+    }
+
+    async start() {
+        await new Promise<void>((resolve) => this._server.listen(0, '127.0.0.1', resolve));
+        return `http://127.0.0.1:${(this._server.address() as AddressInfo).port}`;
+    }
+
+    stop() {
+        this._server.close();
+    }
+}
+
+async function testCheckpointWaitsForWrites() {
+    const proxy = new FakeDBProxy();
+    const prefs = new SQLPreferences(await proxy.start(), 'token');
+    try {
+        prefs.set('a', 1);
+        prefs.set('b', { x: 2 });
+        assert.deepStrictEqual(proxy.stored, {});
+        await prefs.checkpoint();
+        assert.deepStrictEqual(proxy.stored, { a: 1, b: { x: 2 } });
+
+        prefs.delete('a');
+        await prefs.checkpoint();
+        assert.deepStrictEqual(proxy.stored, { b: { x: 2 } });
+    } finally {
+        proxy.stop();
+    }
+}
+
+async function testCheckpointRetriesFailedWrites() {
+    const proxy = new FakeDBProxy();
+    const prefs = new SQLPreferences(await proxy.start(), 'token');
+    try {
+        // a write that failed in the background is written again
+        proxy.failures['a'] = 1;
+        prefs.set('a', 1);
+        await prefs.checkpoint();
+        assert.deepStrictEqual(proxy.stored, { a: 1 });
+
+        // a write that keeps failing fails the checkpoint
+        proxy.failures['b'] = 2;
+        prefs.set('b', 2);
+        await assert.rejects(prefs.checkpoint(), /Failed to write preferences b to database/);
+
+        await prefs.checkpoint();
+        assert.deepStrictEqual(proxy.stored, { a: 1, b: 2 });
+    } finally {
+        proxy.stop();
+    }
+}
+
+export default async function main() {
+    await testCheckpointWaitsForWrites();
+    await testCheckpointRetriesFailedWrites();
+}
+if (!module.parent)
+    main();